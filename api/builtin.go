@@ -0,0 +1,189 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// BuiltinRepository is the repository reported for components compiled into v2c.
+// Built-in components are referenced as builtin:<name> in the same way that
+// image components are referenced as repository:tag.
+const BuiltinRepository = `builtin`
+
+// BuiltinDetective is a detective that runs in-process. Detect is handed the
+// unpacked filesystem (what container detectives see at /v2c/disk) and
+// follows the container contract: returning true is the equivalent of
+// exiting with 0 and anything written to out is passed to the related
+// provisioner.
+type BuiltinDetective interface {
+	Describe() Detective
+	Detect(ctx context.Context, d Disk, out io.Writer) (bool, error)
+}
+
+// BuiltinProvisioner is a provisioner that runs in-process. Provision reads
+// the material contributed by a detective from in and writes a tar archive to
+// out, optionally containing a Dockerfile fragment at its root.
+type BuiltinProvisioner interface {
+	Describe() Provisioner
+	Provision(ctx context.Context, in io.Reader, out io.Writer) error
+}
+
+// BuiltinPackager is a packager that runs in-process. Package reads the
+// partition named by device, as container packagers see it in
+// V2C_ROOT_PARTITION, from the input disks and writes its contents to out as
+// a tar archive.
+type BuiltinPackager interface {
+	Describe() Packager
+	Package(ctx context.Context, inputs []string, device string, out io.Writer) error
+}
+
+var (
+	builtinMu           sync.RWMutex
+	builtinDetectives   = map[string]BuiltinDetective{}
+	builtinProvisioners = map[string]BuiltinProvisioner{}
+	builtinPackagers    = map[string]BuiltinPackager{}
+)
+
+// RegisterDetective makes a built-in detective available to the workflow.
+// It panics if a detective with the same tag is already registered.
+func RegisterDetective(d BuiltinDetective) {
+	builtinMu.Lock()
+	defer builtinMu.Unlock()
+	t := d.Describe().Tag
+	if _, dup := builtinDetectives[t]; dup {
+		panic(fmt.Sprintf(`Built-in detective registered twice: %v`, t))
+	}
+	builtinDetectives[t] = d
+}
+
+// RegisterProvisioner makes a built-in provisioner available to the workflow.
+// It panics if a provisioner with the same tag is already registered.
+func RegisterProvisioner(p BuiltinProvisioner) {
+	builtinMu.Lock()
+	defer builtinMu.Unlock()
+	t := p.Describe().Tag
+	if _, dup := builtinProvisioners[t]; dup {
+		panic(fmt.Sprintf(`Built-in provisioner registered twice: %v`, t))
+	}
+	builtinProvisioners[t] = p
+}
+
+// RegisterPackager makes a built-in packager available to the workflow.
+// It panics if a packager with the same tag is already registered.
+func RegisterPackager(p BuiltinPackager) {
+	builtinMu.Lock()
+	defer builtinMu.Unlock()
+	t := p.Describe().Tag
+	if _, dup := builtinPackagers[t]; dup {
+		panic(fmt.Sprintf(`Built-in packager registered twice: %v`, t))
+	}
+	builtinPackagers[t] = p
+}
+
+// BuiltinDetectives describes the registered built-in detectives, sorted by
+// tag.
+func BuiltinDetectives() []Detective {
+	builtinMu.RLock()
+	defer builtinMu.RUnlock()
+	result := []Detective{}
+	for _, d := range builtinDetectives {
+		result = append(result, describeDetective(d))
+	}
+	sort.Sort(detectivesByTag(result))
+	return result
+}
+
+// BuiltinProvisioners describes the registered built-in provisioners, sorted
+// by tag.
+func BuiltinProvisioners() []Provisioner {
+	builtinMu.RLock()
+	defer builtinMu.RUnlock()
+	result := []Provisioner{}
+	for _, p := range builtinProvisioners {
+		result = append(result, describeProvisioner(p))
+	}
+	sort.Sort(provisionersByTag(result))
+	return result
+}
+
+// BuiltinPackagers describes the registered built-in packagers, sorted by
+// tag.
+func BuiltinPackagers() []Packager {
+	builtinMu.RLock()
+	defer builtinMu.RUnlock()
+	result := []Packager{}
+	for _, p := range builtinPackagers {
+		result = append(result, describePackager(p))
+	}
+	sort.Sort(packagersByTag(result))
+	return result
+}
+
+// LookupDetective returns the built-in detective registered with tag.
+func LookupDetective(tag string) (BuiltinDetective, bool) {
+	builtinMu.RLock()
+	defer builtinMu.RUnlock()
+	d, ok := builtinDetectives[tag]
+	return d, ok
+}
+
+// LookupProvisioner returns the built-in provisioner registered with tag.
+func LookupProvisioner(tag string) (BuiltinProvisioner, bool) {
+	builtinMu.RLock()
+	defer builtinMu.RUnlock()
+	p, ok := builtinProvisioners[tag]
+	return p, ok
+}
+
+// LookupPackager returns the built-in packager registered with tag.
+func LookupPackager(tag string) (BuiltinPackager, bool) {
+	builtinMu.RLock()
+	defer builtinMu.RUnlock()
+	p, ok := builtinPackagers[tag]
+	return p, ok
+}
+
+func describeDetective(d BuiltinDetective) Detective {
+	r := d.Describe()
+	r.ImageID = ``
+	r.Repository = BuiltinRepository
+	r.InProcess = true
+	return r
+}
+
+func describeProvisioner(p BuiltinProvisioner) Provisioner {
+	r := p.Describe()
+	r.ImageID = ``
+	r.Repository = BuiltinRepository
+	r.InProcess = true
+	return r
+}
+
+func describePackager(p BuiltinPackager) Packager {
+	r := p.Describe()
+	r.ImageID = ``
+	r.Repository = BuiltinRepository
+	r.InProcess = true
+	return r
+}
+
+type detectivesByTag []Detective
+
+func (s detectivesByTag) Len() int           { return len(s) }
+func (s detectivesByTag) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s detectivesByTag) Less(i, j int) bool { return s[i].Tag < s[j].Tag }
+
+type provisionersByTag []Provisioner
+
+func (s provisionersByTag) Len() int           { return len(s) }
+func (s provisionersByTag) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s provisionersByTag) Less(i, j int) bool { return s[i].Tag < s[j].Tag }
+
+type packagersByTag []Packager
+
+func (s packagersByTag) Len() int           { return len(s) }
+func (s packagersByTag) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s packagersByTag) Less(i, j int) bool { return s[i].Tag < s[j].Tag }
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Disk is the filesystem built-in detectives read, what container detectives
+// see at /v2c/disk. Names are absolute paths on it and symbolic links in the
+// last element are not followed. Missing files are reported with errors that
+// satisfy os.IsNotExist.
+type Disk interface {
+	// Lstat returns the mode of name.
+	Lstat(name string) (os.FileMode, error)
+	// Readlink returns the target of the symbolic link name.
+	Readlink(name string) (string, error)
+	// ReadFile returns the contents of the regular file name.
+	ReadFile(name string) ([]byte, error)
+}
+
+// DirDisk is a Disk rooted at a directory of this host.
+type DirDisk string
+
+func (d DirDisk) host(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(path.Clean(`/`+name)))
+}
+
+// Lstat returns the mode of name below the directory.
+func (d DirDisk) Lstat(name string) (os.FileMode, error) {
+	fi, err := os.Lstat(d.host(name))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Mode(), nil
+}
+
+// Readlink returns the target of the symbolic link name below the directory.
+func (d DirDisk) Readlink(name string) (string, error) {
+	return os.Readlink(d.host(name))
+}
+
+// ReadFile returns the contents of the file name below the directory.
+func (d DirDisk) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(d.host(name))
+}
+
+var errTooManyLinks = errors.New(`too many levels of symbolic links`)
+
+// ResolvePath follows the symbolic links in name as if d were the root
+// filesystem, so that an absolute link such as
+// /etc/os-release -> /usr/lib/os-release never escapes it. What is left of
+// name below a missing element is kept as it is.
+func ResolvePath(d Disk, name string) (string, error) {
+	todo := strings.Split(strings.Trim(name, `/`), `/`)
+	current := `/`
+	hops := 0
+	for len(todo) > 0 {
+		c := todo[0]
+		todo = todo[1:]
+		switch c {
+		case ``, `.`:
+			continue
+		case `..`:
+			current = path.Dir(current)
+			continue
+		}
+		next := path.Join(current, c)
+		mode, err := d.Lstat(next)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return path.Join(append([]string{next}, todo...)...), nil
+			}
+			return ``, err
+		}
+		if mode&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		if hops++; hops > 40 {
+			return ``, errTooManyLinks
+		}
+		target, err := d.Readlink(next)
+		if err != nil {
+			return ``, err
+		}
+		if path.IsAbs(target) {
+			current = `/`
+		}
+		todo = append(strings.Split(target, `/`), todo...)
+	}
+	return current, nil
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"strings"
+)
+
+// FactOS is the fact name components declare in the
+// com.docker.v2c.component.facts label to receive OSFacts.
+const FactOS = `os`
+
+// OSFacts describes the operating system found on an input disk.
+type OSFacts struct {
+	ID         string
+	IDLike     []string `json:",omitempty"`
+	VersionID  string
+	Name       string `json:",omitempty"`
+	PrettyName string `json:",omitempty"`
+	Source     string `json:",omitempty"`
+}
+
+// PackageManager names the package manager used by the distribution, or
+// returns an empty string when it is unknown.
+func (f OSFacts) PackageManager() string {
+	for _, id := range append([]string{f.ID}, f.IDLike...) {
+		switch strings.ToLower(id) {
+		case `debian`, `ubuntu`:
+			return `apt`
+		case `rhel`, `centos`, `fedora`, `scientific`, `ol`, `amzn`:
+			return `yum`
+		case `alpine`:
+			return `apk`
+		case `suse`, `opensuse`, `sles`:
+			return `zypper`
+		}
+	}
+	return ``
+}
+
+// Environment renders the facts as the environment variables handed to
+// container components that consume them.
+func (f OSFacts) Environment() []string {
+	return []string{
+		`V2C_OS_ID=` + f.ID,
+		`V2C_OS_ID_LIKE=` + strings.Join(f.IDLike, ` `),
+		`V2C_OS_VERSION_ID=` + f.VersionID,
+		`V2C_OS_PACKAGE_MANAGER=` + f.PackageManager(),
+	}
+}
+
+type osFactsKey struct{}
+
+// WithOSFacts hands facts to built-in components that consume them.
+func WithOSFacts(ctx context.Context, f OSFacts) context.Context {
+	return context.WithValue(ctx, osFactsKey{}, f)
+}
+
+// OSFactsFrom returns the facts attached to ctx by WithOSFacts.
+func OSFactsFrom(ctx context.Context) (OSFacts, bool) {
+	f, ok := ctx.Value(osFactsKey{}).(OSFacts)
+	return f, ok
+}
+
+// Consumes reports whether a component declaring facts consumes the fact f.
+func Consumes(facts []string, f string) bool {
+	for _, c := range facts {
+		if c == f {
+			return true
+		}
+	}
+	return false
+}
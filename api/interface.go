@@ -7,6 +7,8 @@ type Detective struct {
 	Category    string
 	Description string
 	Related     string
+	Facts       []string
+	InProcess   bool
 }
 
 type Provisioner struct {
@@ -15,6 +17,10 @@ type Provisioner struct {
 	Tag         string
 	Category    string
 	Description string
+	Facts       []string
+	Service     string   `json:",omitempty"`
+	Depends     []string `json:",omitempty"`
+	InProcess   bool
 }
 
 type Packager struct {
@@ -23,6 +29,10 @@ type Packager struct {
 	Tag         string
 	Category    string
 	Description string
+	Formats     []string
+	Filesystems []string
+	Privileged  bool
+	InProcess   bool
 }
 
 type Product struct {
@@ -0,0 +1,131 @@
+package builtin
+
+import (
+	"fmt"
+	"github.com/docker/v2c/api"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// BaseImage maps a distribution and version to the image contributed as FROM.
+// An empty Version matches every release of the distribution. Otherwise it
+// matches the release and any point release below it, so 6 matches 6.8. The
+// image may use ${version} and ${major} to refer to the detected release.
+type BaseImage struct {
+	Distro  string `yaml:"distro"`
+	Version string `yaml:"version,omitempty"`
+	Image   string `yaml:"image"`
+}
+
+var defaultBaseImages = []BaseImage{
+	{Distro: `ubuntu`, Image: `ubuntu:${version}`},
+	{Distro: `debian`, Image: `debian:${major}`},
+	{Distro: `centos`, Image: `centos:${version}`},
+	{Distro: `rhel`, Image: `centos:${major}`},
+	{Distro: `scientific`, Image: `centos:${major}`},
+	{Distro: `ol`, Image: `oraclelinux:${major}`},
+	{Distro: `fedora`, Image: `fedora:${major}`},
+	{Distro: `alpine`, Image: `alpine:${version}`},
+	{Distro: `opensuse`, Image: `opensuse:${version}`},
+	{Distro: `opensuse-leap`, Image: `opensuse/leap:${version}`},
+	{Distro: `opensuse-tumbleweed`, Image: `opensuse/tumbleweed:latest`},
+	{Distro: `amzn`, Image: `amazonlinux:latest`},
+}
+
+var (
+	baseImagesMu   sync.RWMutex
+	userBaseImages []BaseImage
+)
+
+// LoadBaseImages reads a YAML list of base image mappings from fn. Entries in
+// the file take precedence over the built-in table.
+func LoadBaseImages(fn string) error {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	bis := []BaseImage{}
+	if err = yaml.Unmarshal(b, &bis); err != nil {
+		return fmt.Errorf(`Unable to parse base image mappings in %v: %v`, fn, err)
+	}
+	for i, bi := range bis {
+		if bi.Distro == `` || bi.Image == `` {
+			return fmt.Errorf(`Base image mapping %v in %v requires a distro and an image`, i+1, fn)
+		}
+	}
+	baseImagesMu.Lock()
+	defer baseImagesMu.Unlock()
+	userBaseImages = bis
+	return nil
+}
+
+// BaseImageFor returns the image that should be used as FROM for f.
+func BaseImageFor(f api.OSFacts) (string, bool) {
+	baseImagesMu.RLock()
+	defer baseImagesMu.RUnlock()
+	if bi, ok := matchBaseImage(userBaseImages, f); ok {
+		return expandBaseImage(bi.Image, f), true
+	}
+	if bi, ok := matchBaseImage(defaultBaseImages, f); ok {
+		return expandBaseImage(bi.Image, f), true
+	}
+	return ``, false
+}
+
+// UserBaseImageFor returns the image the mappings loaded with LoadBaseImages
+// choose for f, ignoring the built-in table.
+func UserBaseImageFor(f api.OSFacts) (string, bool) {
+	baseImagesMu.RLock()
+	defer baseImagesMu.RUnlock()
+	if bi, ok := matchBaseImage(userBaseImages, f); ok {
+		return expandBaseImage(bi.Image, f), true
+	}
+	return ``, false
+}
+
+// matchBaseImage picks the entry with the most specific matching version.
+func matchBaseImage(bis []BaseImage, f api.OSFacts) (BaseImage, bool) {
+	best, depth := BaseImage{}, -1
+	for _, bi := range bis {
+		if !strings.EqualFold(bi.Distro, f.ID) {
+			continue
+		}
+		d := versionDepth(bi.Version, f.VersionID)
+		if d > depth {
+			best, depth = bi, d
+		}
+	}
+	return best, depth >= 0
+}
+
+// versionDepth returns the number of version components in pattern when it is
+// a prefix of version, or -1 when it is not.
+func versionDepth(pattern, version string) int {
+	if pattern == `` {
+		return 0
+	}
+	ps := strings.Split(pattern, `.`)
+	vs := strings.Split(version, `.`)
+	if len(ps) > len(vs) {
+		return -1
+	}
+	for i := range ps {
+		if ps[i] != vs[i] {
+			return -1
+		}
+	}
+	return len(ps)
+}
+
+func expandBaseImage(image string, f api.OSFacts) string {
+	v := f.VersionID
+	if v == `` {
+		v = `latest`
+	}
+	return strings.NewReplacer(
+		`${version}`, v,
+		`${major}`, strings.SplitN(v, `.`, 2)[0],
+	).Replace(image)
+}
@@ -0,0 +1,80 @@
+package builtin
+
+import (
+	"github.com/docker/v2c/api"
+	"testing"
+)
+
+func TestMatchBaseImage(t *testing.T) {
+	bis := []BaseImage{
+		{Distro: `centos`, Image: `centos:${major}`},
+		{Distro: `centos`, Version: `6`, Image: `centos:6-six`},
+		{Distro: `centos`, Version: `6.8`, Image: `centos:6.8-exact`},
+		{Distro: `Debian`, Version: `8`, Image: `debian:jessie`},
+	}
+	for _, c := range []struct {
+		f     api.OSFacts
+		ok    bool
+		wants string
+	}{
+		{api.OSFacts{ID: `centos`, VersionID: `7.4`}, true, `centos:${major}`},
+		{api.OSFacts{ID: `centos`, VersionID: `6.9`}, true, `centos:6-six`},
+		{api.OSFacts{ID: `centos`, VersionID: `6.8`}, true, `centos:6.8-exact`},
+		{api.OSFacts{ID: `centos`, VersionID: `6.8.1`}, true, `centos:6.8-exact`},
+		{api.OSFacts{ID: `centos`, VersionID: `66`}, true, `centos:${major}`},
+		{api.OSFacts{ID: `centos`}, true, `centos:${major}`},
+		{api.OSFacts{ID: `debian`, VersionID: `8`}, true, `debian:jessie`},
+		{api.OSFacts{ID: `debian`, VersionID: `9`}, false, ``},
+		{api.OSFacts{ID: `ubuntu`, VersionID: `16.04`}, false, ``},
+	} {
+		bi, ok := matchBaseImage(bis, c.f)
+		if ok != c.ok || bi.Image != c.wants {
+			t.Errorf("%v %v: got %q %v, want %q %v", c.f.ID, c.f.VersionID, bi.Image, ok, c.wants, c.ok)
+		}
+	}
+}
+
+func TestExpandBaseImage(t *testing.T) {
+	for _, c := range []struct {
+		image string
+		f     api.OSFacts
+		wants string
+	}{
+		{`ubuntu:${version}`, api.OSFacts{VersionID: `16.04`}, `ubuntu:16.04`},
+		{`centos:${major}`, api.OSFacts{VersionID: `6.8`}, `centos:6`},
+		{`centos:${major}`, api.OSFacts{VersionID: `7`}, `centos:7`},
+		{`registry.example.com/${major}/os:${version}`, api.OSFacts{VersionID: `3.6.2`}, `registry.example.com/3/os:3.6.2`},
+		{`alpine:${version}`, api.OSFacts{}, `alpine:latest`},
+		{`amazonlinux:latest`, api.OSFacts{VersionID: `2017.09`}, `amazonlinux:latest`},
+	} {
+		if got := expandBaseImage(c.image, c.f); got != c.wants {
+			t.Errorf("%v with %q: got %v, want %v", c.image, c.f.VersionID, got, c.wants)
+		}
+	}
+}
+
+func TestDefaultBaseImages(t *testing.T) {
+	seen := map[string]bool{}
+	for _, bi := range defaultBaseImages {
+		k := bi.Distro + `/` + bi.Version
+		if seen[k] {
+			t.Errorf("%v is mapped more than once", k)
+		}
+		seen[k] = true
+	}
+	for _, c := range []struct {
+		f     api.OSFacts
+		wants string
+	}{
+		{api.OSFacts{ID: `centos`, VersionID: `7`}, `centos:7`},
+		{api.OSFacts{ID: `rhel`, VersionID: `7.4`}, `centos:7`},
+		{api.OSFacts{ID: `debian`, VersionID: `9`}, `debian:9`},
+		{api.OSFacts{ID: `opensuse-leap`, VersionID: `42.3`}, `opensuse/leap:42.3`},
+		{api.OSFacts{ID: `opensuse-tumbleweed`, VersionID: `20171220`}, `opensuse/tumbleweed:latest`},
+	} {
+		bi, ok := matchBaseImage(defaultBaseImages, c.f)
+		if got := expandBaseImage(bi.Image, c.f); !ok || got != c.wants {
+			t.Errorf("%v %v: got %q, want %v", c.f.ID, c.f.VersionID, got, c.wants)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package builtin
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/v2c/api"
+	"github.com/docker/v2c/disk"
+	"github.com/docker/v2c/disk/ext4"
+	"io"
+)
+
+func init() {
+	api.RegisterPackager(ext4Packager{})
+}
+
+// ext4Packager reads ext2, ext3 and ext4 filesystems straight from the disk
+// images, so it needs neither a loop mount nor a privileged container.
+type ext4Packager struct{}
+
+func (ext4Packager) Describe() api.Packager {
+	return api.Packager{
+		Tag:         `ext4`,
+		Category:    `export`,
+		Description: `Copies ext2, ext3 and ext4 filesystems into /v2c/disk without mounting them`,
+		Formats:     []string{string(disk.FormatRaw), string(disk.FormatVMDK)},
+		Filesystems: []string{`ext2`, `ext3`, `ext4`},
+	}
+}
+
+func (ext4Packager) Package(ctx context.Context, inputs []string, device string, out io.Writer) error {
+	for i, in := range inputs {
+		img, err := disk.Open(in)
+		if err != nil {
+			return err
+		}
+		defer img.Close()
+		parts, err := disk.Partitions(img, img.Size())
+		if err != nil {
+			return fmt.Errorf(`%v: %v`, in, err)
+		}
+		for _, p := range parts {
+			if p.Device(i) != device {
+				continue
+			}
+			fs, err := ext4.Open(p.Reader(img))
+			if err != nil {
+				return fmt.Errorf(`%v: %v`, device, err)
+			}
+			return fs.WriteTar(out)
+		}
+	}
+	return fmt.Errorf(`%v is not a partition on the input disks`, device)
+}
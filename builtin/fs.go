@@ -0,0 +1,14 @@
+package builtin
+
+import (
+	"github.com/docker/v2c/api"
+)
+
+// readFile reads a file from the disk d, following symbolic links within it.
+func readFile(d api.Disk, name string) ([]byte, error) {
+	p, err := api.ResolvePath(d, name)
+	if err != nil {
+		return nil, err
+	}
+	return d.ReadFile(p)
+}
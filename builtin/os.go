@@ -0,0 +1,89 @@
+// Package builtin contains the components compiled into v2c.
+// Importing it registers them with the api package.
+package builtin
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/v2c/api"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+func init() {
+	api.RegisterDetective(osDetective{})
+	api.RegisterProvisioner(osProvisioner{})
+}
+
+// osDetective identifies the operating system from release files and
+// passes the facts it found to the os provisioner as JSON.
+type osDetective struct{}
+
+func (osDetective) Describe() api.Detective {
+	return api.Detective{
+		Tag:         `os-release`,
+		Category:    `os`,
+		Description: `Detects the operating system from release files`,
+		Related:     api.BuiltinRepository + `:os`,
+	}
+}
+
+func (osDetective) Detect(ctx context.Context, d api.Disk, out io.Writer) (bool, error) {
+	f, ok, err := detectRelease(d)
+	if err != nil || !ok {
+		return false, err
+	}
+	if _, ok = BaseImageFor(f); !ok {
+		return false, nil
+	}
+	return true, json.NewEncoder(out).Encode(f)
+}
+
+// osProvisioner contributes a FROM instruction chosen from the base image
+// mappings for the detected operating system.
+type osProvisioner struct{}
+
+func (osProvisioner) Describe() api.Provisioner {
+	return api.Provisioner{
+		Tag:         `os`,
+		Category:    `os`,
+		Description: `Provisions the mapped base image for the detected operating system`,
+	}
+}
+
+func (osProvisioner) Provision(ctx context.Context, in io.Reader, out io.Writer) error {
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	f := api.OSFacts{}
+	if err = json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	image, ok := BaseImageFor(f)
+	if !ok {
+		return fmt.Errorf(`No base image is mapped for %v %v`, f.ID, f.VersionID)
+	}
+	return WriteDockerfileTar(out, []byte(fmt.Sprintf("FROM %v\n", image)))
+}
+
+// WriteDockerfileTar writes a provisioner result holding only a Dockerfile.
+func WriteDockerfileTar(out io.Writer, df []byte) error {
+	w := tar.NewWriter(out)
+	err := w.WriteHeader(&tar.Header{
+		Name:    `Dockerfile`,
+		Mode:    0644,
+		Size:    int64(len(df)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(df); err != nil {
+		return err
+	}
+	return w.Close()
+}
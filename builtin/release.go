@@ -0,0 +1,156 @@
+package builtin
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/docker/v2c/api"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// releaseParsers are tried in order. os-release is the most descriptive and
+// is preferred when present. The others cover releases that predate it.
+var releaseParsers = []struct {
+	name  string
+	parse func([]byte) (api.OSFacts, bool)
+}{
+	{`/etc/os-release`, parseOSRelease},
+	{`/usr/lib/os-release`, parseOSRelease},
+	{`/etc/lsb-release`, parseLSBRelease},
+	{`/etc/redhat-release`, parseRedhatRelease},
+	{`/etc/alpine-release`, parseAlpineRelease},
+	{`/etc/debian_version`, parseDebianVersion},
+}
+
+// detectRelease identifies the operating system on the disk d.
+func detectRelease(d api.Disk) (api.OSFacts, bool, error) {
+	for _, rp := range releaseParsers {
+		b, err := readFile(d, rp.name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return api.OSFacts{}, false, err
+		}
+		if f, ok := rp.parse(b); ok {
+			f.Source = rp.name
+			return f, true, nil
+		}
+	}
+	return api.OSFacts{}, false, nil
+}
+
+func parseKeyValues(b []byte) map[string]string {
+	result := map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if len(l) == 0 || strings.HasPrefix(l, `#`) {
+			continue
+		}
+		kv := strings.SplitN(l, `=`, 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := strings.TrimSpace(kv[1])
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		result[strings.TrimSpace(kv[0])] = v
+	}
+	return result
+}
+
+func parseOSRelease(b []byte) (api.OSFacts, bool) {
+	kv := parseKeyValues(b)
+	if kv[`ID`] == `` {
+		return api.OSFacts{}, false
+	}
+	f := api.OSFacts{
+		ID:         strings.ToLower(kv[`ID`]),
+		VersionID:  kv[`VERSION_ID`],
+		Name:       kv[`NAME`],
+		PrettyName: kv[`PRETTY_NAME`],
+	}
+	if len(kv[`ID_LIKE`]) > 0 {
+		f.IDLike = strings.Fields(kv[`ID_LIKE`])
+	}
+	return f, true
+}
+
+func parseLSBRelease(b []byte) (api.OSFacts, bool) {
+	kv := parseKeyValues(b)
+	if kv[`DISTRIB_ID`] == `` {
+		return api.OSFacts{}, false
+	}
+	return api.OSFacts{
+		ID:         strings.ToLower(kv[`DISTRIB_ID`]),
+		VersionID:  kv[`DISTRIB_RELEASE`],
+		Name:       kv[`DISTRIB_ID`],
+		PrettyName: kv[`DISTRIB_DESCRIPTION`],
+	}, true
+}
+
+var (
+	redhatRelease = regexp.MustCompile(`^(.*?)\s+release\s+([0-9][0-9.]*)`)
+	redhatIDs     = []struct{ prefix, id string }{
+		{`CentOS`, `centos`},
+		{`Red Hat`, `rhel`},
+		{`Fedora`, `fedora`},
+		{`Scientific`, `scientific`},
+		{`Oracle`, `ol`},
+	}
+)
+
+func parseRedhatRelease(b []byte) (api.OSFacts, bool) {
+	l := strings.TrimSpace(string(b))
+	m := redhatRelease.FindStringSubmatch(l)
+	if m == nil {
+		return api.OSFacts{}, false
+	}
+	f := api.OSFacts{
+		VersionID:  m[2],
+		Name:       m[1],
+		PrettyName: l,
+		IDLike:     []string{`rhel`, `fedora`},
+	}
+	for _, r := range redhatIDs {
+		if strings.HasPrefix(m[1], r.prefix) {
+			f.ID = r.id
+			break
+		}
+	}
+	if f.ID == `` {
+		return api.OSFacts{}, false
+	}
+	return f, true
+}
+
+func parseAlpineRelease(b []byte) (api.OSFacts, bool) {
+	v := strings.TrimSpace(string(b))
+	if v == `` {
+		return api.OSFacts{}, false
+	}
+	return api.OSFacts{
+		ID:         `alpine`,
+		VersionID:  v,
+		Name:       `Alpine Linux`,
+		PrettyName: `Alpine Linux v` + v,
+	}, true
+}
+
+// parseDebianVersion only reports numbered releases. Testing and unstable
+// installs carry a codename such as stretch/sid which maps to no stable image.
+func parseDebianVersion(b []byte) (api.OSFacts, bool) {
+	v := strings.TrimSpace(string(b))
+	if v == `` || v[0] < '0' || v[0] > '9' {
+		return api.OSFacts{}, false
+	}
+	return api.OSFacts{
+		ID:         `debian`,
+		VersionID:  strings.SplitN(v, `.`, 2)[0],
+		Name:       `Debian GNU/Linux`,
+		PrettyName: `Debian GNU/Linux ` + v,
+	}, true
+}
@@ -0,0 +1,45 @@
+package builtin
+
+import (
+	"github.com/docker/v2c/api"
+	"reflect"
+	"testing"
+)
+
+func TestReleaseParsers(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		parse func([]byte) (api.OSFacts, bool)
+		in    string
+		ok    bool
+		wants api.OSFacts
+	}{
+		{`os-release`, parseOSRelease, "NAME=\"Ubuntu\"\nVERSION_ID=\"16.04\"\nID=ubuntu\nID_LIKE=debian\nPRETTY_NAME=\"Ubuntu 16.04.3 LTS\"\n", true,
+			api.OSFacts{ID: `ubuntu`, IDLike: []string{`debian`}, VersionID: `16.04`, Name: `Ubuntu`, PrettyName: `Ubuntu 16.04.3 LTS`}},
+		{`os-release with comments and quotes`, parseOSRelease, "# comment\nID='CentOS'\nID_LIKE=\"rhel fedora\"\nVERSION_ID=\"7\"\nbroken line\n", true,
+			api.OSFacts{ID: `centos`, IDLike: []string{`rhel`, `fedora`}, VersionID: `7`}},
+		{`os-release of tumbleweed`, parseOSRelease, "NAME=\"openSUSE Tumbleweed\"\nID=\"opensuse-tumbleweed\"\nID_LIKE=\"opensuse suse\"\nVERSION_ID=\"20171220\"\n", true,
+			api.OSFacts{ID: `opensuse-tumbleweed`, IDLike: []string{`opensuse`, `suse`}, VersionID: `20171220`, Name: `openSUSE Tumbleweed`}},
+		{`os-release without ID`, parseOSRelease, "NAME=Linux\n", false, api.OSFacts{}},
+		{`lsb-release`, parseLSBRelease, "DISTRIB_ID=Ubuntu\nDISTRIB_RELEASE=14.04\nDISTRIB_CODENAME=trusty\nDISTRIB_DESCRIPTION=\"Ubuntu 14.04.5 LTS\"\n", true,
+			api.OSFacts{ID: `ubuntu`, VersionID: `14.04`, Name: `Ubuntu`, PrettyName: `Ubuntu 14.04.5 LTS`}},
+		{`lsb-release without DISTRIB_ID`, parseLSBRelease, "DISTRIB_RELEASE=14.04\n", false, api.OSFacts{}},
+		{`redhat-release of CentOS`, parseRedhatRelease, "CentOS release 6.8 (Final)\n", true,
+			api.OSFacts{ID: `centos`, IDLike: []string{`rhel`, `fedora`}, VersionID: `6.8`, Name: `CentOS`, PrettyName: `CentOS release 6.8 (Final)`}},
+		{`redhat-release of RHEL`, parseRedhatRelease, "Red Hat Enterprise Linux Server release 5.11 (Tikanga)\n", true,
+			api.OSFacts{ID: `rhel`, IDLike: []string{`rhel`, `fedora`}, VersionID: `5.11`, Name: `Red Hat Enterprise Linux Server`, PrettyName: `Red Hat Enterprise Linux Server release 5.11 (Tikanga)`}},
+		{`redhat-release of an unknown distribution`, parseRedhatRelease, "Example Linux release 1.0\n", false, api.OSFacts{}},
+		{`redhat-release without a release`, parseRedhatRelease, "CentOS Stream\n", false, api.OSFacts{}},
+		{`alpine-release`, parseAlpineRelease, "3.6.2\n", true,
+			api.OSFacts{ID: `alpine`, VersionID: `3.6.2`, Name: `Alpine Linux`, PrettyName: `Alpine Linux v3.6.2`}},
+		{`empty alpine-release`, parseAlpineRelease, "\n", false, api.OSFacts{}},
+		{`debian_version`, parseDebianVersion, "8.10\n", true,
+			api.OSFacts{ID: `debian`, VersionID: `8`, Name: `Debian GNU/Linux`, PrettyName: `Debian GNU/Linux 8.10`}},
+		{`debian_version of testing`, parseDebianVersion, "buster/sid\n", false, api.OSFacts{}},
+	} {
+		f, ok := c.parse([]byte(c.in))
+		if ok != c.ok || !reflect.DeepEqual(f, c.wants) {
+			t.Errorf("%v: got %+v %v, want %+v %v", c.name, f, ok, c.wants, c.ok)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Package disk opens virtual disk images and discovers the partitions and
+// filesystems on them without mounting anything.
+package disk
+
+import (
+	"github.com/docker/v2c/disk/vmdk"
+	"io"
+	"os"
+)
+
+// Image is a virtual disk opened for reading.
+type Image interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// Open opens the disk image at fn. VMDK disks are read through their extents
+// and raw disks directly. Other formats are reported as ErrUnreadable.
+func Open(fn string) (Image, error) {
+	format, err := Sniff(fn)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatVMDK:
+		return vmdk.Open(fn)
+	case FormatRaw:
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		return newRaw(f)
+	}
+	return nil, ErrUnreadable{Format: format}
+}
+
+type raw struct {
+	*os.File
+	size int64
+}
+
+func newRaw(f *os.File) (Image, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return raw{File: f, size: fi.Size()}, nil
+}
+
+func (r raw) Size() int64 {
+	return r.size
+}
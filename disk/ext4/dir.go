@@ -0,0 +1,149 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// DirEntry is an entry of a directory.
+type DirEntry struct {
+	Name  string
+	Inode uint32
+}
+
+// ReadDir lists a directory, leaving out . and .. entries. Hashed (htree)
+// directories keep their index in blocks that read as empty entries, so
+// they are listed the same way as linear ones.
+func (i *Inode) ReadDir() ([]DirEntry, error) {
+	if !i.IsDir() {
+		return nil, fmt.Errorf(`inode %v is not a directory`, i.Number)
+	}
+	if i.Flags&flagInlineData != 0 {
+		return i.readInlineDir()
+	}
+	r, err := i.Open()
+	if err != nil {
+		return nil, err
+	}
+	result := []DirEntry{}
+	b := make([]byte, i.fs.blockSize)
+	for off := int64(0); off < i.Size; off += i.fs.blockSize {
+		if _, err := r.ReadAt(b, off); err != nil {
+			return nil, fmt.Errorf(`unable to read directory inode %v: %v`, i.Number, err)
+		}
+		if result, err = i.fs.parseDirEntries(b, result); err != nil {
+			return nil, fmt.Errorf(`directory inode %v: %v`, i.Number, err)
+		}
+	}
+	return result, nil
+}
+
+// readInlineDir lists a directory stored in the inode. It starts with the
+// parent inode number and has no . or .. entries.
+func (i *Inode) readInlineDir() ([]DirEntry, error) {
+	d, err := i.inlineData()
+	if err != nil {
+		return nil, err
+	}
+	if len(d) < 4 {
+		return nil, errors.New(`malformed inline directory`)
+	}
+	result, err := i.fs.parseDirEntries(d[4:minInt(len(d), len(i.block))], nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) > len(i.block) {
+		return i.fs.parseDirEntries(d[len(i.block):], result)
+	}
+	return result, nil
+}
+
+func (fs *FS) parseDirEntries(b []byte, result []DirEntry) ([]DirEntry, error) {
+	le := binary.LittleEndian
+	for len(b) >= 8 {
+		ino := le.Uint32(b[0:])
+		recLen := int(le.Uint16(b[4:]))
+		nameLen := int(b[6])
+		if fs.incompat&incompatFiletype == 0 {
+			nameLen = int(le.Uint16(b[6:]))
+		}
+		if recLen < 8 || recLen > len(b) || 8+nameLen > recLen {
+			return result, errors.New(`malformed directory entry`)
+		}
+		name := string(b[8 : 8+nameLen])
+		if ino != 0 && name != `.` && name != `..` {
+			result = append(result, DirEntry{Name: name, Inode: ino})
+		}
+		b = b[recLen:]
+	}
+	return result, nil
+}
+
+// Lookup finds the file at name. Symlinks in the directories leading to
+// it are followed as if the filesystem were the root, the final component is
+// not followed.
+func (fs *FS) Lookup(name string) (*Inode, error) {
+	return fs.lookup(name, 0)
+}
+
+func (fs *FS) lookup(name string, depth int) (*Inode, error) {
+	if depth > 40 {
+		return nil, fmt.Errorf(`%v: too many levels of symbolic links`, name)
+	}
+	cur, err := fs.Root()
+	if err != nil {
+		return nil, err
+	}
+	dir := `/`
+	parts := strings.Split(path.Clean(`/`+name), `/`)[1:]
+	for n, p := range parts {
+		if p == `` {
+			continue
+		}
+		if cur.IsSymlink() {
+			target, err := cur.Readlink()
+			if err != nil {
+				return nil, err
+			}
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(dir), target)
+			}
+			if cur, err = fs.lookup(target, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		if !cur.IsDir() {
+			return nil, &os.PathError{Op: `lookup`, Path: name, Err: errors.New(`not a directory`)}
+		}
+		es, err := cur.ReadDir()
+		if err != nil {
+			return nil, err
+		}
+		found := uint32(0)
+		for _, e := range es {
+			if e.Name == p {
+				found = e.Inode
+				break
+			}
+		}
+		if found == 0 {
+			return nil, &os.PathError{Op: `lookup`, Path: name, Err: os.ErrNotExist}
+		}
+		if cur, err = fs.Inode(found); err != nil {
+			return nil, err
+		}
+		dir = path.Join(`/`, path.Join(parts[:n+1]...))
+	}
+	return cur, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,124 @@
+// Package ext4 reads ext2, ext3 and ext4 filesystems without mounting them.
+// It understands 32 and 64-bit group descriptors, extent and indirect block
+// maps, inline data, linear and htree directories, symlinks and extended
+// attributes. The journal is not replayed, so a filesystem that was not
+// cleanly unmounted is read as it was last checkpointed.
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	superblockOffset = 1024
+	magic            = 0xef53
+	rootInode        = 2
+)
+
+// incompatible features
+const (
+	incompatCompression = 0x1
+	incompatFiletype    = 0x2
+	incompatJournalDev  = 0x8
+	incompatMetaBG      = 0x10
+	incompatExtents     = 0x40
+	incompat64Bit       = 0x80
+	incompatDirData     = 0x1000
+	incompatInlineData  = 0x8000
+	incompatEncrypt     = 0x10000
+
+	unsupported = incompatCompression | incompatJournalDev | incompatMetaBG | incompatDirData | incompatEncrypt
+)
+
+var ErrNotExt = errors.New(`not an ext2, ext3 or ext4 filesystem`)
+
+// FS is an ext2, ext3 or ext4 filesystem opened for reading.
+type FS struct {
+	r              io.ReaderAt
+	blockSize      int64
+	inodeSize      int64
+	inodesPerGroup uint32
+	inodeCount     uint32
+	incompat       uint32
+	inodeTables    []int64
+}
+
+// Open reads the superblock and group descriptors of the filesystem in r.
+func Open(r io.ReaderAt) (*FS, error) {
+	sb := make([]byte, 1024)
+	if _, err := r.ReadAt(sb, superblockOffset); err != nil {
+		return nil, ErrNotExt
+	}
+	le := binary.LittleEndian
+	if le.Uint16(sb[0x38:]) != magic {
+		return nil, ErrNotExt
+	}
+	fs := &FS{
+		r:              r,
+		blockSize:      1024 << le.Uint32(sb[0x18:]),
+		inodeSize:      128,
+		inodesPerGroup: le.Uint32(sb[0x28:]),
+		inodeCount:     le.Uint32(sb[0x0:]),
+		incompat:       le.Uint32(sb[0x60:]),
+	}
+	if f := fs.incompat & unsupported; f != 0 {
+		return nil, fmt.Errorf(`unsupported ext filesystem features 0x%x`, f)
+	}
+	if le.Uint32(sb[0x4c:]) >= 1 {
+		fs.inodeSize = int64(le.Uint16(sb[0x58:]))
+	}
+	if fs.blockSize > 64*1024 || fs.inodeSize < 128 || fs.inodesPerGroup == 0 {
+		return nil, errors.New(`malformed ext superblock`)
+	}
+
+	blocks := uint64(le.Uint32(sb[0x4:]))
+	descSize := int64(32)
+	if fs.incompat&incompat64Bit != 0 {
+		blocks |= uint64(le.Uint32(sb[0x150:])) << 32
+		if ds := int64(le.Uint16(sb[0xfe:])); ds >= 64 {
+			descSize = ds
+		}
+	}
+	firstData := uint64(le.Uint32(sb[0x14:]))
+	perGroup := uint64(le.Uint32(sb[0x20:]))
+	if perGroup == 0 || blocks <= firstData {
+		return nil, errors.New(`malformed ext superblock`)
+	}
+	groups := (blocks - firstData + perGroup - 1) / perGroup
+
+	gdt := make([]byte, int64(groups)*descSize)
+	if _, err := r.ReadAt(gdt, int64(firstData+1)*fs.blockSize); err != nil {
+		return nil, fmt.Errorf(`unable to read the ext group descriptors: %v`, err)
+	}
+	for g := int64(0); g < int64(groups); g++ {
+		d := gdt[g*descSize:]
+		t := int64(le.Uint32(d[0x8:]))
+		if descSize >= 64 {
+			t |= int64(le.Uint32(d[0x28:])) << 32
+		}
+		fs.inodeTables = append(fs.inodeTables, t)
+	}
+	return fs, nil
+}
+
+// BlockSize returns the filesystem block size in bytes.
+func (fs *FS) BlockSize() int64 {
+	return fs.blockSize
+}
+
+// Root returns the root directory.
+func (fs *FS) Root() (*Inode, error) {
+	return fs.Inode(rootInode)
+}
+
+// readBlock reads block n of the filesystem.
+func (fs *FS) readBlock(n uint64) ([]byte, error) {
+	b := make([]byte, fs.blockSize)
+	if _, err := fs.r.ReadAt(b, int64(n)*fs.blockSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b, nil
+}
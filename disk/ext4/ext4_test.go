@@ -0,0 +1,233 @@
+package ext4
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fixtures are written by testdata/generate.sh and hold the same tree
+// with extents, indirect block maps, inline data and 64-bit descriptors.
+var fixtures = []string{`testdata/ext4.img.gz`, `testdata/ext2.img.gz`, `testdata/inline.img.gz`, `testdata/64bit.img.gz`}
+
+// blockSizes are the block sizes of the fixtures.
+var blockSizes = map[string]int64{`testdata/64bit.img.gz`: 4096}
+
+const longTarget = `/a/target/that/is/longer/than/the/sixty/bytes/of/an/inode/block/map`
+
+func openFixture(t *testing.T, fn string) *FS {
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := Open(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("%v: %v", fn, err)
+	}
+	return fs
+}
+
+// pattern returns the bytes i%251 for offsets start to end.
+func pattern(start, end int) []byte {
+	b := make([]byte, end-start)
+	for i := range b {
+		b[i] = byte((start + i) % 251)
+	}
+	return b
+}
+
+// sparseContents is /sparse, six runs of 2 KiB 8 KiB apart.
+func sparseContents() []byte {
+	b := make([]byte, 5*8192+2048)
+	for n := 0; n < 6; n++ {
+		copy(b[n*8192:], pattern(n*8192, n*8192+2048))
+	}
+	return b
+}
+
+func TestFiles(t *testing.T) {
+	for _, fn := range fixtures {
+		fs := openFixture(t, fn)
+		size := blockSizes[fn]
+		if size == 0 {
+			size = 1024
+		}
+		if fs.BlockSize() != size {
+			t.Errorf("%v: the block size is %v, want %v", fn, fs.BlockSize(), size)
+		}
+		for _, c := range []struct {
+			name  string
+			mode  os.FileMode
+			wants []byte
+		}{
+			{`/etc/fstab`, 0644, []byte("/dev/sda1 / ext4 defaults 0 1\n")},
+			{`/usr/lib/os-release`, 0644, []byte("ID=alpine\nVERSION_ID=3.6.2\n")},
+			{`/usr/bin/tool`, 0755 | os.ModeSetuid, pattern(0, 20480)},
+			{`/sparse`, 0644, sparseContents()},
+		} {
+			i, err := fs.Lookup(c.name)
+			if err != nil {
+				t.Errorf("%v: %v", fn, err)
+				continue
+			}
+			if i.FileMode() != c.mode {
+				t.Errorf("%v: %v has mode %v, want %v", fn, c.name, i.FileMode(), c.mode)
+			}
+			if !i.Mtime.Equal(time.Unix(1500000000, 0)) {
+				t.Errorf("%v: %v was modified at %v", fn, c.name, i.Mtime)
+			}
+			if got, err := i.ReadAll(); err != nil {
+				t.Errorf("%v: %v: %v", fn, c.name, err)
+			} else if !bytes.Equal(got, c.wants) {
+				t.Errorf("%v: the contents of %v differ from the fixture", fn, c.name)
+			}
+		}
+
+		if i, err := fs.Lookup(`/etc/fstab`); err != nil || i.Uid != 1000 || i.Gid != 1000 || i.Links != 2 {
+			t.Errorf("%v: /etc/fstab is %+v, %v", fn, i, err)
+		}
+		if i, err := fs.Lookup(`/usr/lib/os-release`); err != nil {
+			t.Errorf("%v: %v", fn, err)
+		} else if xs, err := i.Xattrs(); err != nil || !reflect.DeepEqual(xs, map[string]string{`user.v2c`: `fixture`}) {
+			t.Errorf("%v: the attributes of /usr/lib/os-release are %v, %v", fn, xs, err)
+		}
+		if i, err := fs.Lookup(`/many`); err != nil {
+			t.Errorf("%v: %v", fn, err)
+		} else if i.Flags&flagIndex == 0 {
+			t.Errorf("%v: /many is not an htree directory", fn)
+		} else if es, err := i.ReadDir(); err != nil || len(es) != 100 {
+			t.Errorf("%v: /many has %v entries, %v", fn, len(es), err)
+		}
+		name := `/many/file-57` + strings.Repeat(`x`, 93)
+		if i, err := fs.Lookup(name); err != nil || !i.IsRegular() {
+			t.Errorf("%v: looking up %v in the htree returned %+v, %v", fn, name, i, err)
+		}
+		if _, err := fs.Lookup(`/etc/missing`); !os.IsNotExist(err) {
+			t.Errorf("%v: looking up a missing file returned %v", fn, err)
+		}
+		if _, err := fs.Lookup(`/etc/fstab/x`); err == nil {
+			t.Errorf("%v: looking below a file succeeded", fn)
+		}
+	}
+}
+
+func TestReadlink(t *testing.T) {
+	for _, fn := range fixtures {
+		fs := openFixture(t, fn)
+		for _, c := range []struct {
+			name  string
+			wants string
+		}{
+			{`/etc/os-release`, `../usr/lib/os-release`},
+			{`/long-link`, longTarget},
+		} {
+			i, err := fs.Lookup(c.name)
+			if err != nil {
+				t.Errorf("%v: %v", fn, err)
+				continue
+			}
+			if i.FileMode() != os.ModeSymlink|0777 {
+				t.Errorf("%v: %v has mode %v", fn, c.name, i.FileMode())
+			}
+			if got, err := i.Readlink(); err != nil || got != c.wants {
+				t.Errorf("%v: %v points to %v, %v, want %v", fn, c.name, got, err, c.wants)
+			}
+		}
+		if _, err := fs.Lookup(`/etc/os-release/x`); err == nil {
+			t.Errorf("%v: looking below a link to a file succeeded", fn)
+		}
+	}
+}
+
+func TestWriteTar(t *testing.T) {
+	for _, fn := range fixtures {
+		fs := openFixture(t, fn)
+		b := new(bytes.Buffer)
+		if err := fs.WriteTar(b); err != nil {
+			t.Errorf("%v: %v", fn, err)
+			continue
+		}
+		headers := map[string]*tar.Header{}
+		contents := map[string][]byte{}
+		tr := tar.NewReader(b)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%v: %v", fn, err)
+			}
+			if len(headers) == 0 && (h.Name != `./` || h.Typeflag != tar.TypeDir || h.Mode != 0755 || h.Uid != 0 || h.Gid != 0) {
+				t.Errorf("%v: the archive starts with %v %c %o %v:%v, want the root directory", fn, h.Name, h.Typeflag, h.Mode, h.Uid, h.Gid)
+			}
+			headers[h.Name] = h
+			if contents[h.Name], err = ioutil.ReadAll(tr); err != nil {
+				t.Fatalf("%v: %v", fn, err)
+			}
+		}
+
+		for _, c := range []struct {
+			name     string
+			typeflag byte
+			mode     int64
+			linkname string
+		}{
+			{`etc/`, tar.TypeDir, 0755, ``},
+			{`etc/fstab`, tar.TypeReg, 0644, ``},
+			{`etc/hostname`, tar.TypeLink, 0644, `etc/fstab`},
+			{`etc/os-release`, tar.TypeSymlink, 0777, `../usr/lib/os-release`},
+			{`fifo`, tar.TypeFifo, 0644, ``},
+			{`long-link`, tar.TypeSymlink, 0777, longTarget},
+			{`usr/bin/tool`, tar.TypeReg, 04755, ``},
+		} {
+			h, ok := headers[c.name]
+			if !ok {
+				t.Errorf("%v: %v is missing from the archive", fn, c.name)
+				continue
+			}
+			if h.Typeflag != c.typeflag || h.Mode != c.mode || h.Linkname != c.linkname {
+				t.Errorf("%v: %v is %c %o %v, want %c %o %v", fn, c.name,
+					h.Typeflag, h.Mode, h.Linkname, c.typeflag, c.mode, c.linkname)
+			}
+		}
+		if h := headers[`etc/fstab`]; h != nil && (h.Uid != 1000 || h.Gid != 1000) {
+			t.Errorf("%v: etc/fstab is owned by %v:%v", fn, h.Uid, h.Gid)
+		}
+		if h := headers[`usr/lib/os-release`]; h == nil || h.Xattrs[`user.v2c`] != `fixture` {
+			t.Errorf("%v: usr/lib/os-release lost its attributes", fn)
+		}
+		if !bytes.Equal(contents[`sparse`], sparseContents()) {
+			t.Errorf("%v: the archived sparse differs from the fixture", fn)
+		}
+		// The root and 6 directories with lost+found, 104 files, a hard link,
+		// 2 symlinks and a pipe
+		if len(headers) != 115 {
+			t.Errorf("%v: the archive has %v entries, want 115", fn, len(headers))
+		}
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	for _, b := range [][]byte{make([]byte, 4096), make([]byte, 100)} {
+		if _, err := Open(bytes.NewReader(b)); err != ErrNotExt {
+			t.Errorf("%v bytes: got %v, want %v", len(b), err, ErrNotExt)
+		}
+	}
+}
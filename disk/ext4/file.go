@@ -0,0 +1,243 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+const extentMagic = 0xf30a
+
+// run maps length blocks starting at logical block logical to physical
+// blocks. Uninitialized runs read as zeros.
+type run struct {
+	logical  uint64
+	physical uint64
+	length   uint64
+	zero     bool
+}
+
+type runs []run
+
+func (s runs) Len() int           { return len(s) }
+func (s runs) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s runs) Less(i, j int) bool { return s[i].logical < s[j].logical }
+
+// Open returns a reader over the contents of a regular file, directory or
+// symlink. Holes read as zeros.
+func (i *Inode) Open() (*io.SectionReader, error) {
+	if i.Flags&flagInlineData != 0 {
+		d, err := i.inlineData()
+		if err != nil {
+			return nil, err
+		}
+		return io.NewSectionReader(byteReaderAt(d), 0, i.Size), nil
+	}
+	rs, err := i.blockMap()
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(&fileReader{fs: i.fs, runs: rs}, 0, i.Size), nil
+}
+
+// ReadAll returns the contents of a file.
+func (i *Inode) ReadAll() ([]byte, error) {
+	r, err := i.Open()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func (i *Inode) blockMap() (runs, error) {
+	rs := runs{}
+	var err error
+	if i.Flags&flagExtents != 0 {
+		err = i.fs.extents(i.block, &rs, 0)
+	} else {
+		err = i.indirect(&rs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf(`unable to map the blocks of inode %v: %v`, i.Number, err)
+	}
+	sort.Sort(rs)
+	return rs, nil
+}
+
+// extents walks an extent tree node, which is either the inode block map or
+// a tree block.
+func (fs *FS) extents(node []byte, rs *runs, level int) error {
+	le := binary.LittleEndian
+	if len(node) < 12 || le.Uint16(node[0:]) != extentMagic {
+		return errors.New(`malformed extent header`)
+	}
+	if level > 5 {
+		return errors.New(`extent tree is too deep`)
+	}
+	entries := int(le.Uint16(node[2:]))
+	depth := le.Uint16(node[6:])
+	if 12+entries*12 > len(node) {
+		return errors.New(`malformed extent header`)
+	}
+	for n := 0; n < entries; n++ {
+		e := node[12+n*12:]
+		if depth == 0 {
+			length := uint64(le.Uint16(e[4:]))
+			zero := false
+			if length > 32768 {
+				length -= 32768
+				zero = true
+			}
+			*rs = append(*rs, run{
+				logical:  uint64(le.Uint32(e[0:])),
+				physical: uint64(le.Uint16(e[6:]))<<32 | uint64(le.Uint32(e[8:])),
+				length:   length,
+				zero:     zero,
+			})
+			continue
+		}
+		leaf := uint64(le.Uint32(e[4:])) | uint64(le.Uint16(e[8:]))<<32
+		b, err := fs.readBlock(leaf)
+		if err != nil {
+			return err
+		}
+		if err = fs.extents(b, rs, level+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indirect walks the direct and indirect block pointers of ext2 and ext3.
+func (i *Inode) indirect(rs *runs) error {
+	le := binary.LittleEndian
+	bs := uint64(i.fs.blockSize)
+	total := (uint64(i.Size) + bs - 1) / bs
+	per := bs / 4
+	logical := uint64(0)
+
+	add := func(p uint64) {
+		if p != 0 {
+			if n := len(*rs); n > 0 {
+				last := &(*rs)[n-1]
+				if last.logical+last.length == logical && last.physical+last.length == p {
+					last.length++
+					logical++
+					return
+				}
+			}
+			*rs = append(*rs, run{logical: logical, physical: p, length: 1})
+		}
+		logical++
+	}
+
+	var walk func(p uint64, level int) error
+	walk = func(p uint64, level int) error {
+		coverage := uint64(1)
+		for l := 0; l < level; l++ {
+			coverage *= per
+		}
+		if p == 0 {
+			logical += coverage
+			return nil
+		}
+		b, err := i.fs.readBlock(p)
+		if err != nil {
+			return err
+		}
+		for n := uint64(0); n < per && logical < total; n++ {
+			c := uint64(le.Uint32(b[n*4:]))
+			if level == 1 {
+				add(c)
+			} else if err = walk(c, level-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for n := 0; n < 12 && logical < total; n++ {
+		add(uint64(le.Uint32(i.block[n*4:])))
+	}
+	for level := 1; level <= 3 && logical < total; level++ {
+		if err := walk(uint64(le.Uint32(i.block[(11+level)*4:])), level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inlineData returns the contents of a file stored in the inode itself.
+func (i *Inode) inlineData() ([]byte, error) {
+	d := append([]byte{}, i.block...)
+	xs, err := i.rawXattrs()
+	if err != nil {
+		return nil, err
+	}
+	d = append(d, xs[`system.data`]...)
+	if int64(len(d)) > i.Size {
+		d = d[:i.Size]
+	}
+	return d, nil
+}
+
+type fileReader struct {
+	fs   *FS
+	runs runs
+}
+
+func (f *fileReader) ReadAt(p []byte, off int64) (int, error) {
+	bs := f.fs.blockSize
+	n := 0
+	for len(p) > 0 {
+		lb := uint64(off / bs)
+		within := off % bs
+		l := bs - within
+		if l > int64(len(p)) {
+			l = int64(len(p))
+		}
+		chunk := p[:l]
+
+		i := sort.Search(len(f.runs), func(i int) bool {
+			return f.runs[i].logical+f.runs[i].length > lb
+		})
+		if i < len(f.runs) && f.runs[i].logical <= lb && !f.runs[i].zero {
+			r := f.runs[i]
+			// Read as much of the run as fits at once
+			rest := int64(r.logical+r.length-lb)*bs - within
+			if rest < int64(len(p)) {
+				chunk = p[:rest]
+			} else {
+				chunk = p
+			}
+			pos := int64(r.physical+(lb-r.logical))*bs + within
+			if _, err := f.fs.r.ReadAt(chunk, pos); err != nil && err != io.EOF {
+				return n, err
+			}
+		} else {
+			for j := range chunk {
+				chunk[j] = 0
+			}
+		}
+		n += len(chunk)
+		off += int64(len(chunk))
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+type byteReaderAt []byte
+
+func (b byteReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,166 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+)
+
+// inode flags
+const (
+	flagIndex      = 0x1000
+	flagExtents    = 0x80000
+	flagInlineData = 0x10000000
+)
+
+// file types in the mode
+const (
+	modeFIFO    = 0x1000
+	modeChar    = 0x2000
+	modeDir     = 0x4000
+	modeBlock   = 0x6000
+	modeRegular = 0x8000
+	modeSymlink = 0xa000
+	modeSocket  = 0xc000
+	modeType    = 0xf000
+)
+
+// Inode is the metadata of a file.
+type Inode struct {
+	Number uint32
+	Mode   uint16
+	Uid    uint32
+	Gid    uint32
+	Size   int64
+	Links  uint16
+	Flags  uint32
+	Atime  time.Time
+	Mtime  time.Time
+	Ctime  time.Time
+
+	fs      *FS
+	raw     []byte
+	block   []byte
+	fileACL uint64
+}
+
+// Inode reads inode n.
+func (fs *FS) Inode(n uint32) (*Inode, error) {
+	if n == 0 || n > fs.inodeCount {
+		return nil, fmt.Errorf(`inode %v is out of range`, n)
+	}
+	g := (n - 1) / fs.inodesPerGroup
+	if int(g) >= len(fs.inodeTables) {
+		return nil, fmt.Errorf(`inode %v is out of range`, n)
+	}
+	raw := make([]byte, fs.inodeSize)
+	off := fs.inodeTables[g]*fs.blockSize + int64((n-1)%fs.inodesPerGroup)*fs.inodeSize
+	if _, err := fs.r.ReadAt(raw, off); err != nil {
+		return nil, fmt.Errorf(`unable to read inode %v: %v`, n, err)
+	}
+
+	le := binary.LittleEndian
+	i := &Inode{
+		Number:  n,
+		Mode:    le.Uint16(raw[0x0:]),
+		Uid:     uint32(le.Uint16(raw[0x2:])) | uint32(le.Uint16(raw[0x78:]))<<16,
+		Gid:     uint32(le.Uint16(raw[0x18:])) | uint32(le.Uint16(raw[0x7a:]))<<16,
+		Size:    int64(le.Uint32(raw[0x4:])) | int64(le.Uint32(raw[0x6c:]))<<32,
+		Links:   le.Uint16(raw[0x1a:]),
+		Flags:   le.Uint32(raw[0x20:]),
+		fs:      fs,
+		raw:     raw,
+		block:   raw[0x28:0x64],
+		fileACL: uint64(le.Uint32(raw[0x68:])) | uint64(le.Uint16(raw[0x76:]))<<32,
+	}
+	i.Ctime = i.timestamp(0x0c, 0x84)
+	i.Mtime = i.timestamp(0x10, 0x88)
+	i.Atime = i.timestamp(0x08, 0x8c)
+	return i, nil
+}
+
+// extraSize is the size of the fields beyond the original 128 byte inode.
+func (i *Inode) extraSize() int {
+	if len(i.raw) <= 128 {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint16(i.raw[0x80:]))
+}
+
+// timestamp decodes seconds at off and, for large inodes, the nanoseconds
+// and epoch bits at extra.
+func (i *Inode) timestamp(off int, extra int) time.Time {
+	sec := int64(int32(binary.LittleEndian.Uint32(i.raw[off:])))
+	nsec := int64(0)
+	if extra+4 <= 128+i.extraSize() && extra+4 <= len(i.raw) {
+		x := binary.LittleEndian.Uint32(i.raw[extra:])
+		sec += int64(x&3) << 32
+		nsec = int64(x >> 2)
+	}
+	return time.Unix(sec, nsec)
+}
+
+func (i *Inode) IsDir() bool     { return i.Mode&modeType == modeDir }
+func (i *Inode) IsRegular() bool { return i.Mode&modeType == modeRegular }
+func (i *Inode) IsSymlink() bool { return i.Mode&modeType == modeSymlink }
+
+// Perm returns the permission bits including setuid, setgid and sticky.
+func (i *Inode) Perm() int64 {
+	return int64(i.Mode & 07777)
+}
+
+// FileMode returns the mode in the form used by the os package.
+func (i *Inode) FileMode() os.FileMode {
+	m := os.FileMode(i.Mode & 0777)
+	if i.Mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if i.Mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if i.Mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	switch i.Mode & modeType {
+	case modeDir:
+		m |= os.ModeDir
+	case modeSymlink:
+		m |= os.ModeSymlink
+	case modeFIFO:
+		m |= os.ModeNamedPipe
+	case modeChar:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case modeBlock:
+		m |= os.ModeDevice
+	case modeSocket:
+		m |= os.ModeSocket
+	}
+	return m
+}
+
+// Device returns the major and minor numbers of a device node.
+func (i *Inode) Device() (int64, int64) {
+	le := binary.LittleEndian
+	if old := le.Uint32(i.block[0:]); old != 0 {
+		return int64((old >> 8) & 0xff), int64(old & 0xff)
+	}
+	d := le.Uint32(i.block[4:])
+	return int64((d & 0xfff00) >> 8), int64((d & 0xff) | ((d >> 12) & 0xfff00))
+}
+
+// Readlink returns the target of a symlink.
+func (i *Inode) Readlink() (string, error) {
+	if !i.IsSymlink() {
+		return ``, fmt.Errorf(`inode %v is not a symlink`, i.Number)
+	}
+	// Short targets are stored in place of the block map
+	if i.Flags&(flagExtents|flagInlineData) == 0 && i.Size < int64(len(i.block)) {
+		return string(i.block[:i.Size]), nil
+	}
+	b, err := i.ReadAll()
+	if err != nil {
+		return ``, err
+	}
+	return string(b), nil
+}
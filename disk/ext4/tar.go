@@ -0,0 +1,126 @@
+package ext4
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+)
+
+type entriesByName []DirEntry
+
+func (s entriesByName) Len() int           { return len(s) }
+func (s entriesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s entriesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// WriteTar streams the whole filesystem to w as a tar archive. It starts
+// with a ./ entry for the root directory, so that the mode and owner of the
+// root survive unpacking. Ownership, permissions, timestamps and extended
+// attributes are kept, files with several links are archived once and
+// linked after that. Sockets are left out.
+func (fs *FS) WriteTar(w io.Writer) error {
+	root, err := fs.Root()
+	if err != nil {
+		return err
+	}
+	t := &tarWriter{fs: fs, tw: tar.NewWriter(w), links: map[uint32]string{}, seen: map[uint32]bool{}}
+	if err = t.entry(root, `.`); err != nil {
+		return err
+	}
+	return t.tw.Close()
+}
+
+type tarWriter struct {
+	fs    *FS
+	tw    *tar.Writer
+	links map[uint32]string
+	seen  map[uint32]bool
+}
+
+func (t *tarWriter) dir(d *Inode, name string) error {
+	if t.seen[d.Number] {
+		return fmt.Errorf(`%v: directory loop`, name)
+	}
+	t.seen[d.Number] = true
+
+	es, err := d.ReadDir()
+	if err != nil {
+		return err
+	}
+	sort.Sort(entriesByName(es))
+	for _, e := range es {
+		i, err := t.fs.Inode(e.Inode)
+		if err != nil {
+			return err
+		}
+		if err = t.entry(i, path.Join(name, e.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tarWriter) entry(i *Inode, name string) error {
+	h := &tar.Header{
+		Name:    name,
+		Mode:    i.Perm(),
+		Uid:     int(i.Uid),
+		Gid:     int(i.Gid),
+		ModTime: i.Mtime,
+	}
+	xs, err := i.Xattrs()
+	if err != nil {
+		return fmt.Errorf(`%v: %v`, name, err)
+	}
+	if len(xs) > 0 {
+		h.Xattrs = xs
+	}
+
+	if !i.IsDir() && i.Links > 1 {
+		if first, ok := t.links[i.Number]; ok {
+			h.Typeflag = tar.TypeLink
+			h.Linkname = first
+			return t.tw.WriteHeader(h)
+		}
+		t.links[i.Number] = name
+	}
+
+	switch i.Mode & modeType {
+	case modeDir:
+		h.Typeflag = tar.TypeDir
+		h.Name += `/`
+		if err = t.tw.WriteHeader(h); err != nil {
+			return err
+		}
+		return t.dir(i, name)
+	case modeRegular:
+		h.Typeflag = tar.TypeReg
+		h.Size = i.Size
+		if err = t.tw.WriteHeader(h); err != nil {
+			return err
+		}
+		r, err := i.Open()
+		if err != nil {
+			return fmt.Errorf(`%v: %v`, name, err)
+		}
+		_, err = io.Copy(t.tw, r)
+		return err
+	case modeSymlink:
+		h.Typeflag = tar.TypeSymlink
+		if h.Linkname, err = i.Readlink(); err != nil {
+			return fmt.Errorf(`%v: %v`, name, err)
+		}
+	case modeChar, modeBlock:
+		h.Typeflag = tar.TypeChar
+		if i.Mode&modeType == modeBlock {
+			h.Typeflag = tar.TypeBlock
+		}
+		h.Devmajor, h.Devminor = i.Device()
+	case modeFIFO:
+		h.Typeflag = tar.TypeFifo
+	default:
+		return nil
+	}
+	return t.tw.WriteHeader(h)
+}
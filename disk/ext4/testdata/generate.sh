@@ -0,0 +1,72 @@
+#!/bin/sh
+# generate.sh writes the filesystem fixtures of the ext4 tests. Run it as
+# root, so that ownership is kept, with e2fsprogs 1.43 or later and python3
+# for the extended attributes.
+#
+# ext4.img.gz uses extents, ext2.img.gz indirect block maps and
+# inline.img.gz inline data, all with 1 KiB blocks. 64bit.img.gz uses
+# extents, 4 KiB blocks, 64-bit group descriptors and flex_bg, which keeps
+# the inode tables of its four groups together. e2fsck -D indexes the
+# directories of more than one block, so /many is an htree. They hold the
+# same tree:
+#
+#   /                     mode 0755, owned by 0:0
+#   /etc/fstab            a small file owned by 1000:1000
+#   /etc/os-release       -> ../usr/lib/os-release
+#   /etc/hostname         a hard link to /etc/fstab
+#   /usr/lib/os-release   a small file with the user.v2c attribute
+#   /usr/bin/tool         a setuid file of 20 KiB, past the direct blocks
+#   /sparse               six runs of 2 KiB, 8 KiB apart, with holes between
+#   /long-link            a symlink too long to be kept in the inode
+#   /many/file-N-...      100 empty files with names of 100 bytes, a
+#                         directory of 11 KiB
+#   /fifo                 a named pipe
+set -e
+cd "$(dirname "$0")"
+
+src=$(mktemp -d)
+trap 'rm -rf "$src"' EXIT
+
+mkdir -p "$src/etc" "$src/usr/lib" "$src/usr/bin" "$src/many"
+printf '/dev/sda1 / ext4 defaults 0 1\n' >"$src/etc/fstab"
+chown 1000:1000 "$src/etc/fstab"
+ln "$src/etc/fstab" "$src/etc/hostname"
+printf 'ID=alpine\nVERSION_ID=3.6.2\n' >"$src/usr/lib/os-release"
+python3 -c 'import os, sys; os.setxattr(sys.argv[1], "user.v2c", b"fixture")' "$src/usr/lib/os-release"
+ln -s ../usr/lib/os-release "$src/etc/os-release"
+ln -s /a/target/that/is/longer/than/the/sixty/bytes/of/an/inode/block/map "$src/long-link"
+mkfifo "$src/fifo"
+
+# The byte at offset i of the data is i%251
+python3 -c 'import sys; sys.stdout.buffer.write(bytes(i % 251 for i in range(20480)))' >"$src/usr/bin/tool"
+chmod 4755 "$src/usr/bin/tool"
+python3 -c '
+import sys
+with open(sys.argv[1], "wb") as f:
+    for n in range(6):
+        f.seek(n * 8192)
+        f.write(bytes(i % 251 for i in range(n * 8192, n * 8192 + 2048)))
+' "$src/sparse"
+for n in $(seq 1 100); do
+	: >"$src/many/$(printf 'file-%-95s' "$n" | tr ' ' x)"
+done
+chmod 0755 "$src"
+chown 0:0 "$src"
+find "$src" -exec touch -h -d @1500000000 {} +
+
+export E2FSPROGS_FAKE_TIME=1500000000
+image() {
+	fn=$1
+	blocks=$2
+	shift 2
+	rm -f "$fn" "$fn.gz"
+	mke2fs -q -F -N 256 -U 7ea4b0a6-6e41-4c4e-9f0e-3f2a1b6d2c01 \
+		-E hash_seed=7ea4b0a6-6e41-4c4e-9f0e-3f2a1b6d2c01 -L v2c-test -d "$src" "$@" "$fn" "$blocks"
+	# 1 means that the directories were indexed
+	e2fsck -fyD "$fn" >/dev/null 2>&1 || [ $? -eq 1 ]
+	gzip -9n "$fn"
+}
+image ext4.img 512 -b 1024 -t ext4 -O ^has_journal
+image ext2.img 512 -b 1024 -t ext2
+image inline.img 512 -b 1024 -t ext4 -O ^has_journal,inline_data
+image 64bit.img 2048 -b 4096 -g 512 -t ext4 -O ^has_journal,64bit,flex_bg -G 4
@@ -0,0 +1,132 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const xattrMagic = 0xea020000
+
+var xattrPrefixes = map[byte]string{
+	1: `user.`,
+	2: `system.posix_acl_access`,
+	3: `system.posix_acl_default`,
+	4: `trusted.`,
+	6: `security.`,
+	7: `system.`,
+	8: `system.richacl`,
+}
+
+// Xattrs returns the extended attributes of the file. POSIX ACLs are
+// converted from their compact on-disk form to the form getxattr returns.
+func (i *Inode) Xattrs() (map[string]string, error) {
+	raw, err := i.rawXattrs()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]string{}
+	for k, v := range raw {
+		switch k {
+		case `system.data`:
+			// inline file data rather than an attribute
+			continue
+		case `system.posix_acl_access`, `system.posix_acl_default`:
+			if v, err = convertACL(v); err != nil {
+				return nil, err
+			}
+		}
+		result[k] = string(v)
+	}
+	return result, nil
+}
+
+func (i *Inode) rawXattrs() (map[string][]byte, error) {
+	result := map[string][]byte{}
+	le := binary.LittleEndian
+
+	// Attributes stored in the inode after the extra fields
+	if start := 128 + i.extraSize(); start+4 <= len(i.raw) && le.Uint32(i.raw[start:]) == xattrMagic {
+		entries := i.raw[start+4:]
+		if err := parseXattrs(entries, entries, result); err != nil {
+			return nil, err
+		}
+	}
+
+	// Attributes stored in a separate block
+	if i.fileACL != 0 {
+		b, err := i.fs.readBlock(i.fileACL)
+		if err != nil {
+			return nil, err
+		}
+		if le.Uint32(b) != xattrMagic {
+			return nil, errors.New(`malformed extended attribute block`)
+		}
+		if err = parseXattrs(b[32:], b, result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// parseXattrs reads the entries at the start of entries. Value offsets are
+// relative to base.
+func parseXattrs(entries []byte, base []byte, result map[string][]byte) error {
+	le := binary.LittleEndian
+	for len(entries) >= 16 && le.Uint32(entries) != 0 {
+		nameLen := int(entries[0])
+		index := entries[1]
+		valueOff := int(le.Uint16(entries[2:]))
+		valueInode := le.Uint32(entries[4:])
+		valueSize := int(le.Uint32(entries[8:]))
+		if 16+nameLen > len(entries) {
+			return errors.New(`malformed extended attribute entry`)
+		}
+		name := xattrPrefixes[index] + string(entries[16:16+nameLen])
+		entries = entries[(16+nameLen+3)&^3:]
+
+		// Values in separate inodes are not supported
+		if valueInode != 0 {
+			continue
+		}
+		if valueOff+valueSize > len(base) {
+			return errors.New(`malformed extended attribute entry`)
+		}
+		result[name] = append([]byte{}, base[valueOff:valueOff+valueSize]...)
+	}
+	return nil
+}
+
+// ACL entry tags that carry a user or group ID
+const (
+	aclUser  = 0x02
+	aclGroup = 0x08
+)
+
+// convertACL expands an ext4 ACL, which omits the ID of entries that do not
+// name a user or group, into the generic version 2 format.
+func convertACL(b []byte) ([]byte, error) {
+	le := binary.LittleEndian
+	if len(b) < 4 || le.Uint32(b) != 1 {
+		return nil, errors.New(`malformed ACL`)
+	}
+	out := make([]byte, 4, len(b)*2)
+	le.PutUint32(out, 2)
+	b = b[4:]
+	for len(b) >= 4 {
+		tag := le.Uint16(b)
+		e := make([]byte, 8)
+		copy(e, b[:4])
+		if tag == aclUser || tag == aclGroup {
+			if len(b) < 8 {
+				return nil, errors.New(`malformed ACL`)
+			}
+			copy(e[4:], b[4:8])
+			b = b[8:]
+		} else {
+			le.PutUint32(e[4:], 0xffffffff)
+			b = b[4:]
+		}
+		out = append(out, e...)
+	}
+	return out, nil
+}
@@ -0,0 +1,114 @@
+package disk
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Format is the container format of an input file.
+type Format string
+
+const (
+	FormatRaw   Format = `raw`
+	FormatQCOW2 Format = `qcow2`
+	FormatVHD   Format = `vhd`
+	FormatVHDX  Format = `vhdx`
+	FormatVMDK  Format = `vmdk`
+	FormatOVA   Format = `ova`
+	FormatTar   Format = `tar`
+	FormatGzip  Format = `gzip`
+	FormatXz    Format = `xz`
+	FormatZstd  Format = `zstd`
+)
+
+// Compressed reports whether the format wraps another one in a compressed
+// stream.
+func (f Format) Compressed() bool {
+	return f == FormatGzip || f == FormatXz || f == FormatZstd
+}
+
+// Readable reports whether Open can read disks in the format.
+func (f Format) Readable() bool {
+	return f == FormatRaw || f == FormatVMDK
+}
+
+// IsTar reports whether b starts with a POSIX or GNU tar header.
+func IsTar(b []byte) bool {
+	return len(b) >= 262 && bytes.HasPrefix(b[257:], []byte(`ustar`))
+}
+
+// Sniff identifies the format of the file at fn by its magic bytes. Files
+// that match nothing are raw disks.
+func Sniff(fn string) (Format, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return ``, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return ``, err
+	}
+
+	b := make([]byte, 512)
+	n, _ := f.ReadAt(b, 0)
+	b = b[:n]
+	switch {
+	case bytes.HasPrefix(b, []byte("QFI\xfb")):
+		return FormatQCOW2, nil
+	case bytes.HasPrefix(b, []byte(`vhdxfile`)):
+		return FormatVHDX, nil
+	case bytes.HasPrefix(b, []byte(`KDMV`)), bytes.HasPrefix(b, []byte(`# Disk DescriptorFile`)):
+		return FormatVMDK, nil
+	case bytes.HasPrefix(b, []byte{0x1f, 0x8b}):
+		return FormatGzip, nil
+	case bytes.HasPrefix(b, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return FormatXz, nil
+	case bytes.HasPrefix(b, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return FormatZstd, nil
+	case bytes.HasPrefix(b, []byte(`conectix`)):
+		// dynamic and differencing disks start with a copy of the footer
+		return FormatVHD, nil
+	case IsTar(b):
+		if isOVA(f) {
+			return FormatOVA, nil
+		}
+		return FormatTar, nil
+	}
+
+	// fixed disks only carry the footer
+	if fi.Size() >= 512 {
+		footer := make([]byte, 8)
+		if _, err = f.ReadAt(footer, fi.Size()-512); err == nil && string(footer) == `conectix` {
+			return FormatVHD, nil
+		}
+	}
+	return FormatRaw, nil
+}
+
+// isOVA reports whether the tar archive in r contains an OVF descriptor.
+func isOVA(r io.Reader) bool {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			return false
+		}
+		if strings.HasSuffix(strings.ToLower(h.Name), `.ovf`) {
+			return true
+		}
+	}
+}
+
+// ErrUnreadable is returned by Open for disks in formats it cannot read.
+type ErrUnreadable struct {
+	Format Format
+}
+
+func (e ErrUnreadable) Error() string {
+	return fmt.Sprintf(`%v disks cannot be read directly`, e.Format)
+}
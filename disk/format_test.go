@@ -0,0 +1,74 @@
+package disk
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarOf returns a tar archive holding an empty file for each name.
+func tarOf(t *testing.T, names ...string) []byte {
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	for _, n := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: n, Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestSniff(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `v2c-sniff`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	withTail := func(head []byte, size int) []byte {
+		return append(head, make([]byte, size-len(head))...)
+	}
+	vhdFixed := make([]byte, 4096)
+	copy(vhdFixed[4096-512:], `conectix`)
+	for _, c := range []struct {
+		name  string
+		b     []byte
+		wants Format
+	}{
+		{`qcow2`, withTail([]byte("QFI\xfb\x00\x00\x00\x03"), 1024), FormatQCOW2},
+		{`vhdx`, withTail([]byte(`vhdxfile`), 1024), FormatVHDX},
+		{`vhd dynamic`, withTail([]byte(`conectix`), 1024), FormatVHD},
+		{`vhd fixed`, vhdFixed, FormatVHD},
+		{`vmdk sparse`, withTail([]byte("KDMV\x01\x00\x00\x00"), 1024), FormatVMDK},
+		{`vmdk descriptor`, []byte("# Disk DescriptorFile\nversion=1\n"), FormatVMDK},
+		{`gzip`, []byte{0x1f, 0x8b, 0x08, 0x00}, FormatGzip},
+		{`xz`, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00, 0x04}, FormatXz},
+		{`zstd`, []byte{0x28, 0xb5, 0x2f, 0xfd, 0x24}, FormatZstd},
+		{`ova`, tarOf(t, `appliance.ovf`, `appliance.mf`, `appliance-disk1.vmdk`), FormatOVA},
+		{`ova uppercase`, tarOf(t, `APPLIANCE.OVF`), FormatOVA},
+		{`tar`, tarOf(t, `etc/hostname`), FormatTar},
+		{`raw`, withTail([]byte{0xeb, 0x63, 0x90}, 4096), FormatRaw},
+		{`short raw`, []byte(`boot`), FormatRaw},
+		{`empty`, []byte{}, FormatRaw},
+	} {
+		fn := filepath.Join(dir, c.name)
+		if err = ioutil.WriteFile(fn, c.b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := Sniff(fn)
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+		} else if got != c.wants {
+			t.Errorf("%v: got %v, want %v", c.name, got, c.wants)
+		}
+	}
+	if _, err = Sniff(filepath.Join(dir, `missing`)); err == nil {
+		t.Error(`a missing file was sniffed`)
+	}
+}
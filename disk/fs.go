@@ -0,0 +1,109 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ext feature flags that tell the revisions apart
+const (
+	extCompatHasJournal  = 0x4
+	extIncompatExtents   = 0x40
+	extIncompat64Bit     = 0x80
+	extIncompatFlexBG    = 0x200
+	extROCompatHugeFile  = 0x8
+	extROCompatGDTCsum   = 0x10
+	extROCompatDirNlink  = 0x20
+	extROCompatExtraSize = 0x40
+)
+
+// sniffFilesystem identifies the filesystem at the start of p by its magic
+// numbers and records its UUID and label.
+func sniffFilesystem(r io.ReaderAt, p *Partition) {
+	b := make([]byte, 68*1024)
+	n, _ := r.ReadAt(b, p.Start)
+	b = b[:n]
+	if int64(len(b)) > p.Size {
+		b = b[:p.Size]
+	}
+	at := func(off int, magic string) bool {
+		return len(b) >= off+len(magic) && string(b[off:off+len(magic)]) == magic
+	}
+
+	switch {
+	case len(b) >= 2048 && binary.LittleEndian.Uint16(b[1024+56:]) == 0xef53:
+		sb := b[1024:]
+		compat := binary.LittleEndian.Uint32(sb[92:])
+		incompat := binary.LittleEndian.Uint32(sb[96:])
+		rocompat := binary.LittleEndian.Uint32(sb[100:])
+		switch {
+		case incompat&(extIncompatExtents|extIncompat64Bit|extIncompatFlexBG) != 0 ||
+			rocompat&(extROCompatHugeFile|extROCompatGDTCsum|extROCompatDirNlink|extROCompatExtraSize) != 0:
+			p.Filesystem = `ext4`
+		case compat&extCompatHasJournal != 0:
+			p.Filesystem = `ext3`
+		default:
+			p.Filesystem = `ext2`
+		}
+		p.UUID = formatUUID(sb[104:120])
+		p.Label = cString(sb[120:136])
+	case at(0, `XFSB`):
+		p.Filesystem = `xfs`
+		p.UUID = formatUUID(b[32:48])
+		p.Label = cString(b[108:120])
+	case at(0x10040, `_BHRfS_M`):
+		p.Filesystem = `btrfs`
+		p.UUID = formatUUID(b[0x10020:0x10030])
+		p.Label = cString(b[0x1012b : 0x1012b+256])
+	case at(4096-10, `SWAPSPACE2`) || at(4096-10, `SWAP-SPACE`):
+		p.Filesystem = `swap`
+		p.UUID = formatUUID(b[1024+12 : 1024+28])
+		p.Label = cString(b[1024+28 : 1024+44])
+	case at(512, `LABELONE`) && at(512+24, `LVM2 001`):
+		p.Filesystem = `LVM2_member`
+	case at(3, `NTFS    `):
+		p.Filesystem = `ntfs`
+		p.UUID = fmt.Sprintf(`%X`, reverse(b[72:80]))
+	case at(82, `FAT32`):
+		p.Filesystem = `vfat`
+		p.UUID = fatSerial(b[67:71])
+		p.Label = cString(b[71:82])
+	case at(54, `FAT12`) || at(54, `FAT16`):
+		p.Filesystem = `vfat`
+		p.UUID = fatSerial(b[39:43])
+		p.Label = cString(b[43:54])
+	case at(32769, `CD001`):
+		p.Filesystem = `iso9660`
+	}
+	if p.Label == `NO NAME` {
+		p.Label = ``
+	}
+}
+
+func formatUUID(b []byte) string {
+	if bytes.Equal(b, make([]byte, 16)) {
+		return ``
+	}
+	return fmt.Sprintf(`%x-%x-%x-%x-%x`, b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func fatSerial(b []byte) string {
+	return fmt.Sprintf(`%04X-%04X`, binary.LittleEndian.Uint16(b[2:]), binary.LittleEndian.Uint16(b[0:]))
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(bytes.TrimSpace(b))
+}
+
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
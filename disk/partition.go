@@ -0,0 +1,330 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/docker/v2c/disk/ext4"
+	"io"
+	"strings"
+)
+
+const sectorSize = 512
+
+// Partition is a partition, or a filesystem spanning a whole disk when
+// Number is 0.
+type Partition struct {
+	Number     int
+	Start      int64
+	Size       int64
+	Scheme     string
+	Type       string
+	Name       string
+	Filesystem string
+	UUID       string
+	Label      string
+}
+
+// Device names the partition as the packagers see it, where the disk at
+// index i is attached as /dev/sd{a+i}.
+func (p Partition) Device(i int) string {
+	d := fmt.Sprintf(`/dev/sd%c`, 'a'+i)
+	if p.Number == 0 {
+		return d
+	}
+	return fmt.Sprintf(`%v%v`, d, p.Number)
+}
+
+// Reader returns a reader over the contents of the partition.
+func (p Partition) Reader(r io.ReaderAt) *io.SectionReader {
+	return io.NewSectionReader(r, p.Start, p.Size)
+}
+
+// Linux reports whether the partition holds a filesystem that can be a Linux
+// root.
+func (p Partition) Linux() bool {
+	switch p.Filesystem {
+	case `ext2`, `ext3`, `ext4`, `xfs`, `btrfs`:
+		return true
+	}
+	return false
+}
+
+var errNoPartitions = errors.New(`no partition table or filesystem found`)
+
+// Partitions lists the partitions on a disk of the given size. A disk
+// without a partition table holding a filesystem is reported as partition 0.
+func Partitions(r io.ReaderAt, size int64) ([]Partition, error) {
+	mbr := make([]byte, sectorSize)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return nil, err
+	}
+
+	var parts []Partition
+	var err error
+	switch {
+	case mbr[510] == 0x55 && mbr[511] == 0xaa && hasProtectiveMBR(mbr):
+		parts, err = gptPartitions(r, size)
+	case mbr[510] == 0x55 && mbr[511] == 0xaa && !isBootSector(mbr):
+		parts, err = mbrPartitions(r, mbr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parts) == 0 {
+		p := Partition{Size: size}
+		sniffFilesystem(r, &p)
+		if p.Filesystem == `` {
+			return nil, errNoPartitions
+		}
+		return []Partition{p}, nil
+	}
+	for i := range parts {
+		sniffFilesystem(r, &parts[i])
+	}
+	return parts, nil
+}
+
+// isBootSector tells a FAT or NTFS volume boot record, which carries the same
+// signature, apart from a master boot record.
+func isBootSector(b []byte) bool {
+	return bytes.Equal(b[3:11], []byte(`NTFS    `)) ||
+		bytes.Equal(b[54:59], []byte(`FAT12`)) ||
+		bytes.Equal(b[54:59], []byte(`FAT16`)) ||
+		bytes.Equal(b[82:87], []byte(`FAT32`))
+}
+
+func hasProtectiveMBR(mbr []byte) bool {
+	for i := 0; i < 4; i++ {
+		if mbr[446+i*16+4] == 0xee {
+			return true
+		}
+	}
+	return false
+}
+
+func mbrPartitions(r io.ReaderAt, mbr []byte) ([]Partition, error) {
+	parts := []Partition{}
+	for i := 0; i < 4; i++ {
+		e := mbr[446+i*16 : 446+(i+1)*16]
+		t := e[4]
+		start := int64(binary.LittleEndian.Uint32(e[8:])) * sectorSize
+		length := int64(binary.LittleEndian.Uint32(e[12:])) * sectorSize
+		if t == 0 || length == 0 {
+			continue
+		}
+		if t == 0x05 || t == 0x0f || t == 0x85 {
+			logical, err := ebrPartitions(r, start)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, logical...)
+			continue
+		}
+		parts = append(parts, Partition{
+			Number: i + 1,
+			Start:  start,
+			Size:   length,
+			Scheme: `mbr`,
+			Type:   fmt.Sprintf(`0x%02x`, t),
+		})
+	}
+	return parts, nil
+}
+
+// ebrPartitions follows the chain of extended boot records. Logical
+// partitions are numbered from 5.
+func ebrPartitions(r io.ReaderAt, extended int64) ([]Partition, error) {
+	parts := []Partition{}
+	ebr := make([]byte, sectorSize)
+	next := extended
+	for n := 5; n < 5+128; n++ {
+		if _, err := r.ReadAt(ebr, next); err != nil {
+			return nil, fmt.Errorf(`unable to read an extended boot record: %v`, err)
+		}
+		if ebr[510] != 0x55 || ebr[511] != 0xaa {
+			break
+		}
+		e := ebr[446:462]
+		if e[4] != 0 {
+			parts = append(parts, Partition{
+				Number: n,
+				Start:  next + int64(binary.LittleEndian.Uint32(e[8:]))*sectorSize,
+				Size:   int64(binary.LittleEndian.Uint32(e[12:])) * sectorSize,
+				Scheme: `mbr`,
+				Type:   fmt.Sprintf(`0x%02x`, e[4]),
+			})
+		}
+		link := ebr[462:478]
+		if link[4] == 0 {
+			break
+		}
+		next = extended + int64(binary.LittleEndian.Uint32(link[8:]))*sectorSize
+	}
+	return parts, nil
+}
+
+type gptHeader struct {
+	Signature      [8]byte
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCRC      uint32
+	Reserved       uint32
+	CurrentLBA     uint64
+	BackupLBA      uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       [16]byte
+	EntriesLBA     uint64
+	NumEntries     uint32
+	EntrySize      uint32
+	EntriesCRC     uint32
+}
+
+var gptTypes = map[string]string{
+	`0fc63daf-8483-4772-8e79-3d69d8477de4`: `linux`,
+	`4f68bce3-e8cd-4db1-96e7-fbcaf984b709`: `linux-root-x86-64`,
+	`44479540-f297-41b2-9af7-d131d5f0458a`: `linux-root-x86`,
+	`b921b045-1df0-41c3-af44-4c6f280d3fae`: `linux-root-arm64`,
+	`69dad710-2ce4-4e3c-b16c-21a1d49abed3`: `linux-root-arm`,
+	`933ac7e1-2eb4-4f13-b844-0e14e2aef915`: `linux-home`,
+	`0657fd6d-a4ab-43c4-84e5-0933c84b4f4f`: `linux-swap`,
+	`e6d6d379-f507-44c2-a23c-238f2a3df928`: `linux-lvm`,
+	`a19d880f-05fc-4d3b-a006-743f0f84911e`: `linux-raid`,
+	`c12a7328-f81f-11d2-ba4b-00a0c93ec93b`: `efi`,
+	`21686148-6449-6e6f-744e-656564454649`: `bios-boot`,
+	`ebd0a0a2-b9e5-4433-87c0-68b6b72699c7`: `basic-data`,
+}
+
+func gptPartitions(r io.ReaderAt, size int64) ([]Partition, error) {
+	b := make([]byte, sectorSize)
+	if _, err := r.ReadAt(b, sectorSize); err != nil {
+		return nil, err
+	}
+	h := gptHeader{}
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	if string(h.Signature[:]) != `EFI PART` {
+		return nil, errors.New(`the protective MBR is not followed by a GPT header`)
+	}
+	if h.EntrySize < 128 || h.EntrySize > 4096 || h.EntrySize%128 != 0 || h.NumEntries > 1024 {
+		return nil, errors.New(`malformed GPT header`)
+	}
+
+	entries := make([]byte, int64(h.NumEntries)*int64(h.EntrySize))
+	if _, err := r.ReadAt(entries, int64(h.EntriesLBA)*sectorSize); err != nil {
+		return nil, fmt.Errorf(`unable to read the GPT partition entries: %v`, err)
+	}
+	parts := []Partition{}
+	for i := 0; i < int(h.NumEntries); i++ {
+		e := entries[i*int(h.EntrySize) : (i+1)*int(h.EntrySize)]
+		t := formatGUID(e[0:16])
+		if t == `00000000-0000-0000-0000-000000000000` {
+			continue
+		}
+		first := int64(binary.LittleEndian.Uint64(e[32:]))
+		last := int64(binary.LittleEndian.Uint64(e[40:]))
+		p := Partition{
+			Number: i + 1,
+			Start:  first * sectorSize,
+			Size:   (last - first + 1) * sectorSize,
+			Scheme: `gpt`,
+			Type:   t,
+			Name:   decodeUTF16(e[56:128]),
+		}
+		if n, ok := gptTypes[t]; ok {
+			p.Type = n
+		}
+		parts = append(parts, p)
+	}
+	return parts, nil
+}
+
+// formatGUID renders a mixed-endian GUID as stored in GPT structures.
+func formatGUID(b []byte) string {
+	return fmt.Sprintf(`%08x-%04x-%04x-%x-%x`,
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10], b[10:16])
+}
+
+func decodeUTF16(b []byte) string {
+	rs := []rune{}
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		rs = append(rs, rune(c))
+	}
+	return strings.TrimSpace(string(rs))
+}
+
+// Reasons ChooseRoot gives for its choice.
+const (
+	RootByType  = `its GPT partition type marks a Linux root`
+	RootByFstab = `it holds /etc/fstab`
+	RootBySize  = `it is the largest Linux filesystem`
+	RootOnLVM   = `the root filesystem is most likely a logical volume on the LVM physical volumes`
+)
+
+// ChooseRoot picks the partition most likely to hold the root filesystem and
+// says why. Partitions whose GPT type marks a Linux root come first, then
+// those probe finds /etc/fstab on and finally the largest one with a Linux
+// filesystem. Among equals the largest wins. probe may be nil. When neither
+// the type nor /etc/fstab tells and there are LVM physical volumes, no
+// partition is chosen and the reason is RootOnLVM, since the largest
+// partition is then usually /boot.
+func ChooseRoot(parts []Partition, probe func(Partition) bool) (Partition, string, bool) {
+	linux := []Partition{}
+	for _, p := range parts {
+		if p.Linux() {
+			linux = append(linux, p)
+		}
+	}
+	if p, ok := largest(linux, func(p Partition) bool { return strings.HasPrefix(p.Type, `linux-root`) }); ok {
+		return p, RootByType, true
+	}
+	if probe != nil {
+		if p, ok := largest(linux, probe); ok {
+			return p, RootByFstab, true
+		}
+	}
+	for _, p := range parts {
+		if p.Filesystem == `LVM2_member` {
+			return Partition{}, RootOnLVM, false
+		}
+	}
+	p, ok := largest(linux, func(Partition) bool { return true })
+	return p, RootBySize, ok
+}
+
+func largest(parts []Partition, match func(Partition) bool) (Partition, bool) {
+	best, found := Partition{}, false
+	for _, p := range parts {
+		if (!found || p.Size > best.Size) && match(p) {
+			best, found = p, true
+		}
+	}
+	return best, found
+}
+
+// HasFstab reports whether the partition p of the disk r holds /etc/fstab.
+// Only ext filesystems can be looked into.
+func HasFstab(r io.ReaderAt, p Partition) bool {
+	switch p.Filesystem {
+	case `ext2`, `ext3`, `ext4`:
+	default:
+		return false
+	}
+	fs, err := ext4.Open(p.Reader(r))
+	if err != nil {
+		return false
+	}
+	i, err := fs.Lookup(`/etc/fstab`)
+	return err == nil && i.IsRegular()
+}
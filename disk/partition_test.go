@@ -0,0 +1,138 @@
+package disk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// readFixture returns a disk written by testdata/generate.go.
+func readFixture(t *testing.T, fn string) *bytes.Reader {
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(b)
+}
+
+func TestPartitions(t *testing.T) {
+	for _, c := range []struct {
+		fn    string
+		wants []Partition
+	}{
+		{`testdata/mbr.img.gz`, []Partition{
+			{Number: 1, Start: 2048 * 512, Size: 2048 * 512, Scheme: `mbr`, Type: `0x83`,
+				Filesystem: `ext4`, UUID: `1b4e28ba-2fa1-11d2-883f-0016d3cca427`, Label: `mbr-root`},
+			{Number: 5, Start: 6144 * 512, Size: 4096 * 512, Scheme: `mbr`, Type: `0x83`,
+				Filesystem: `ext2`, UUID: `2c5f39cb-3fb2-12e3-994f-1127e4ddb538`, Label: `mbr-data`},
+			{Number: 6, Start: 10368 * 512, Size: 1920 * 512, Scheme: `mbr`, Type: `0x82`,
+				Filesystem: `swap`, UUID: `3d6a4adc-40c3-23f4-aa50-2238f5eec649`, Label: `mbr-swap`},
+		}},
+		{`testdata/gpt.img.gz`, []Partition{
+			{Number: 1, Start: 2048 * 512, Size: 2048 * 512, Scheme: `gpt`, Type: `efi`, Name: `EFI System`},
+			{Number: 2, Start: 4096 * 512, Size: 6144 * 512, Scheme: `gpt`, Type: `linux`, Name: `data`,
+				Filesystem: `ext4`, UUID: `4e7b5bed-51d4-34a5-bb61-3349a6ffd75a`, Label: `gpt-data`},
+			{Number: 3, Start: 10240 * 512, Size: 4096 * 512, Scheme: `gpt`, Type: `linux`, Name: `root`,
+				Filesystem: `ext4`, UUID: `5f8c6cfe-62e5-45b6-8c72-445ab7a0e86b`, Label: `gpt-root`},
+		}},
+		{`testdata/whole.img.gz`, []Partition{
+			{Size: 2048 * 512, Filesystem: `ext4`, UUID: `7bae8f10-8407-4fd8-ae94-667cd9c20a8d`, Label: `whole`},
+		}},
+	} {
+		r := readFixture(t, c.fn)
+		got, err := Partitions(r, r.Size())
+		if err != nil {
+			t.Errorf("%v: %v", c.fn, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.wants) {
+			t.Errorf("%v: got %+v, want %+v", c.fn, got, c.wants)
+		}
+	}
+
+	if _, err := Partitions(bytes.NewReader(make([]byte, 64*1024)), 64*1024); err != errNoPartitions {
+		t.Errorf("a blank disk returned %v, want %v", err, errNoPartitions)
+	}
+}
+
+func TestChooseRoot(t *testing.T) {
+	mbr := readFixture(t, `testdata/mbr.img.gz`)
+	gpt := readFixture(t, `testdata/gpt.img.gz`)
+	for _, c := range []struct {
+		name   string
+		r      *bytes.Reader
+		probe  bool
+		number int
+		reason string
+	}{
+		{`MBR by fstab`, mbr, true, 1, RootByFstab},
+		{`MBR by size`, mbr, false, 5, RootBySize},
+		{`GPT by fstab`, gpt, true, 3, RootByFstab},
+		{`GPT by size`, gpt, false, 2, RootBySize},
+	} {
+		parts, err := Partitions(c.r, c.r.Size())
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		var probe func(Partition) bool
+		if c.probe {
+			r := c.r
+			probe = func(p Partition) bool { return HasFstab(r, p) }
+		}
+		p, reason, ok := ChooseRoot(parts, probe)
+		if !ok || p.Number != c.number || reason != c.reason {
+			t.Errorf("%v: chose %v because %v, want %v because %v", c.name, p.Number, reason, c.number, c.reason)
+		}
+	}
+
+	// The partition type wins over /etc/fstab and size
+	parts := []Partition{
+		{Number: 1, Size: 4096, Type: `linux`, Filesystem: `ext4`},
+		{Number: 2, Size: 1024, Type: `linux-root-arm64`, Filesystem: `xfs`},
+		{Number: 3, Size: 8192, Type: `linux-swap`, Filesystem: `swap`},
+	}
+	if p, reason, ok := ChooseRoot(parts, func(Partition) bool { return true }); !ok || p.Number != 2 || reason != RootByType {
+		t.Errorf("chose %v because %v, want 2 because %v", p.Number, reason, RootByType)
+	}
+	if _, _, ok := ChooseRoot(parts[2:], nil); ok {
+		t.Errorf("a root was chosen among swap partitions")
+	}
+
+	// The root of an xfs /boot and a volume group is a logical volume
+	lvm := []Partition{
+		{Number: 1, Size: 1 << 30, Type: `0x83`, Filesystem: `xfs`},
+		{Number: 2, Size: 1 << 20, Type: `0x8e`, Filesystem: `LVM2_member`},
+	}
+	if p, reason, ok := ChooseRoot(lvm, func(Partition) bool { return false }); ok || reason != RootOnLVM {
+		t.Errorf("chose %v because %v, want no choice because %v", p.Number, reason, RootOnLVM)
+	}
+	lvm[0].Type = `linux-root-x86-64`
+	if p, reason, ok := ChooseRoot(lvm, nil); !ok || p.Number != 1 || reason != RootByType {
+		t.Errorf("chose %v because %v, want 1 because %v", p.Number, reason, RootByType)
+	}
+}
+
+func TestGPTEntrySize(t *testing.T) {
+	r := readFixture(t, `testdata/gpt.img.gz`)
+	b := make([]byte, r.Size())
+	r.ReadAt(b, 0)
+	for _, size := range []uint32{0x10000, 200, 64} {
+		binary.LittleEndian.PutUint32(b[512+84:], size)
+		if _, err := Partitions(bytes.NewReader(b), int64(len(b))); err == nil {
+			t.Errorf("an entry size of %v was accepted", size)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+//go:build ignore
+// +build ignore
+
+// generate writes the partitioned disk fixtures of the disk tests. Run it
+// from this directory with go run generate.go. It needs mke2fs 1.43 or
+// later and mkswap.
+//
+// mbr.img.gz is 6 MiB with a MBR:
+//
+//	1  sectors 2048-4095   0x83  ext4 holding /etc/fstab
+//	2  sectors 4096-12287  0x05  extended, holding
+//	5  sectors 6144-10239  0x83  ext2 without /etc/fstab
+//	6  sectors 10368-12287 0x82  swap
+//
+// gpt.img.gz is 8 MiB with a GPT:
+//
+//	1  sectors 2048-4095   efi    left blank
+//	2  sectors 4096-10239  linux  ext4 without /etc/fstab
+//	3  sectors 10240-14335 linux  ext4 holding /etc/fstab
+//
+// whole.img.gz is an ext4 filesystem of 1 MiB without a partition table.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const sector = 512
+
+// filesystem runs mkfs with args on a file of the given number of sectors
+// and returns its contents.
+func filesystem(sectors int, mkfs string, args ...string) []byte {
+	f, err := ioutil.TempFile(``, `v2c-fixture`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if err = f.Truncate(int64(sectors) * sector); err != nil {
+		log.Fatal(err)
+	}
+	f.Close()
+	cmd := exec.Command(mkfs, append(args, f.Name())...)
+	cmd.Env = append(os.Environ(), `E2FSPROGS_FAKE_TIME=1500000000`)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Fatalf("%v: %v\n%s", mkfs, err, out)
+	}
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return b
+}
+
+// extfs makes an ext filesystem of the given kind, with /etc/fstab when
+// root is set.
+func extfs(sectors int, kind, uuid, label string, root bool) []byte {
+	args := []string{`-q`, `-F`, `-t`, kind, `-b`, `1024`, `-U`, uuid, `-L`, label}
+	if root {
+		src, err := ioutil.TempDir(``, `v2c-fixture`)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(src)
+		os.Mkdir(filepath.Join(src, `etc`), 0755)
+		if err = ioutil.WriteFile(filepath.Join(src, `etc`, `fstab`), []byte("LABEL="+label+" / "+kind+" defaults 0 1\n"), 0644); err != nil {
+			log.Fatal(err)
+		}
+		args = append(args, `-d`, src)
+	}
+	return filesystem(sectors, `mke2fs`, args...)
+}
+
+// mbrEntry writes a partition entry at b, with sectors relative to the
+// table.
+func mbrEntry(b []byte, kind byte, start, sectors uint32) {
+	b[4] = kind
+	binary.LittleEndian.PutUint32(b[8:], start)
+	binary.LittleEndian.PutUint32(b[12:], sectors)
+}
+
+func signature(b []byte) {
+	b[510], b[511] = 0x55, 0xaa
+}
+
+func mbrDisk() []byte {
+	d := make([]byte, 12288*sector)
+	mbrEntry(d[446:], 0x83, 2048, 2048)
+	mbrEntry(d[462:], 0x05, 4096, 8192)
+	signature(d)
+	copy(d[2048*sector:], extfs(2048, `ext4`, `1b4e28ba-2fa1-11d2-883f-0016d3cca427`, `mbr-root`, true))
+
+	// The first extended boot record locates logical partition 5 from
+	// itself and the next record from the start of the extended partition
+	ebr := d[4096*sector:]
+	mbrEntry(ebr[446:], 0x83, 2048, 4096)
+	mbrEntry(ebr[462:], 0x05, 6144, 2048)
+	signature(ebr)
+	copy(d[6144*sector:], extfs(4096, `ext2`, `2c5f39cb-3fb2-12e3-994f-1127e4ddb538`, `mbr-data`, false))
+
+	ebr = d[10240*sector:]
+	mbrEntry(ebr[446:], 0x82, 128, 1920)
+	signature(ebr)
+	copy(d[10368*sector:], filesystem(1920, `mkswap`, `-p`, `4096`,
+		`-U`, `3d6a4adc-40c3-23f4-aa50-2238f5eec649`, `-L`, `mbr-swap`))
+	return d
+}
+
+// guid encodes a GUID in the mixed-endian form of GPT structures.
+func guid(s string) []byte {
+	var v [16]byte
+	h := []byte{}
+	for _, c := range s {
+		if c != '-' {
+			h = append(h, byte(c))
+		}
+	}
+	for i := range v {
+		var x byte
+		for _, c := range h[2*i : 2*i+2] {
+			x <<= 4
+			switch {
+			case c >= 'a':
+				x |= c - 'a' + 10
+			default:
+				x |= c - '0'
+			}
+		}
+		v[i] = x
+	}
+	v[0], v[1], v[2], v[3] = v[3], v[2], v[1], v[0]
+	v[4], v[5] = v[5], v[4]
+	v[6], v[7] = v[7], v[6]
+	return v[:]
+}
+
+type gptPartition struct {
+	kind        string
+	first, last uint64
+	name        string
+}
+
+func gptDisk() []byte {
+	const sectors, entries = 16384, 128
+	d := make([]byte, sectors*sector)
+	mbrEntry(d[446:], 0xee, 1, sectors-1)
+	signature(d)
+
+	table := make([]byte, entries*128)
+	for i, p := range []gptPartition{
+		{`c12a7328-f81f-11d2-ba4b-00a0c93ec93b`, 2048, 4095, `EFI System`},
+		{`0fc63daf-8483-4772-8e79-3d69d8477de4`, 4096, 10239, `data`},
+		{`0fc63daf-8483-4772-8e79-3d69d8477de4`, 10240, 14335, `root`},
+	} {
+		e := table[i*128:]
+		copy(e, guid(p.kind))
+		copy(e[16:], guid(fmt.Sprintf(`5e0a3c1b-0000-4000-8000-%012x`, i+1)))
+		binary.LittleEndian.PutUint64(e[32:], p.first)
+		binary.LittleEndian.PutUint64(e[40:], p.last)
+		for j, c := range p.name {
+			binary.LittleEndian.PutUint16(e[56+2*j:], uint16(c))
+		}
+	}
+	copy(d[4096*sector:], extfs(6144, `ext4`, `4e7b5bed-51d4-34a5-bb61-3349a6ffd75a`, `gpt-data`, false))
+	copy(d[10240*sector:], extfs(4096, `ext4`, `5f8c6cfe-62e5-45b6-8c72-445ab7a0e86b`, `gpt-root`, true))
+
+	// The primary header and table come first, the backup table and header
+	// last
+	header := func(current, backup, entriesLBA uint64) []byte {
+		h := make([]byte, 92)
+		copy(h, `EFI PART`)
+		binary.LittleEndian.PutUint32(h[8:], 0x10000)
+		binary.LittleEndian.PutUint32(h[12:], 92)
+		binary.LittleEndian.PutUint64(h[24:], current)
+		binary.LittleEndian.PutUint64(h[32:], backup)
+		binary.LittleEndian.PutUint64(h[40:], 34)
+		binary.LittleEndian.PutUint64(h[48:], sectors-34)
+		copy(h[56:], guid(`6a9d7e0f-73f6-4ec7-9d83-556bc8b1f97c`))
+		binary.LittleEndian.PutUint64(h[72:], entriesLBA)
+		binary.LittleEndian.PutUint32(h[80:], entries)
+		binary.LittleEndian.PutUint32(h[84:], 128)
+		binary.LittleEndian.PutUint32(h[88:], crc32.ChecksumIEEE(table))
+		binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h))
+		return h
+	}
+	copy(d[1*sector:], header(1, sectors-1, 2))
+	copy(d[2*sector:], table)
+	copy(d[(sectors-33)*sector:], table)
+	copy(d[(sectors-1)*sector:], header(sectors-1, 1, sectors-33))
+	return d
+}
+
+func write(fn string, b []byte) {
+	z := new(bytes.Buffer)
+	zw, _ := gzip.NewWriterLevel(z, gzip.BestCompression)
+	zw.Write(b)
+	zw.Close()
+	if err := ioutil.WriteFile(fn, z.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func main() {
+	write(`mbr.img.gz`, mbrDisk())
+	write(`gpt.img.gz`, gptDisk())
+	write(`whole.img.gz`, extfs(2048, `ext4`, `7bae8f10-8407-4fd8-ae94-667cd9c20a8d`, `whole`, true))
+}
@@ -0,0 +1,260 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var sparseMagic = []byte(`KDMV`)
+
+const (
+	flagCompressed = 1 << 16
+	flagMarkers    = 1 << 17
+
+	gdAtEnd = 0xffffffffffffffff
+
+	// grain table entries with this value are allocated but zeroed
+	grainZero = 1
+)
+
+// sparseHeader is the on-disk header of a hosted sparse extent.
+type sparseHeader struct {
+	Magic              [4]byte
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RGDOffset          uint64
+	GDOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+}
+
+// sparseExtent reads a monolithicSparse or streamOptimized extent.
+type sparseExtent struct {
+	r          io.ReaderAt
+	h          sparseHeader
+	capacity   int64
+	grainBytes int64
+	gd         []uint32
+
+	mu         sync.Mutex
+	tables     map[uint32][]uint32
+	grainIndex int64
+	grain      []byte
+}
+
+func openSparse(r io.ReaderAt) (*sparseExtent, error) {
+	h, err := readSparseHeader(r, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// streamOptimized extents keep the grain directory location in a footer
+	if h.GDOffset == gdAtEnd {
+		size, err := readerSize(r)
+		if err != nil {
+			return nil, err
+		}
+		if h, err = readSparseHeader(r, size-2*sectorSize); err != nil {
+			return nil, fmt.Errorf(`unable to read the VMDK footer: %v`, err)
+		}
+	}
+	if h.GrainSize == 0 || h.NumGTEsPerGT == 0 {
+		return nil, errors.New(`malformed VMDK sparse header`)
+	}
+	if h.Flags&flagCompressed != 0 && h.CompressAlgorithm != 1 {
+		return nil, fmt.Errorf(`unsupported VMDK compression algorithm %v`, h.CompressAlgorithm)
+	}
+
+	e := &sparseExtent{
+		r:          r,
+		h:          h,
+		capacity:   int64(h.Capacity) * sectorSize,
+		grainBytes: int64(h.GrainSize) * sectorSize,
+		tables:     map[uint32][]uint32{},
+		grainIndex: -1,
+	}
+	gtCoverage := h.GrainSize * uint64(h.NumGTEsPerGT)
+	n := (h.Capacity + gtCoverage - 1) / gtCoverage
+	gdb := make([]byte, n*4)
+	if _, err = r.ReadAt(gdb, int64(h.GDOffset)*sectorSize); err != nil {
+		return nil, fmt.Errorf(`unable to read the VMDK grain directory: %v`, err)
+	}
+	e.gd = make([]uint32, n)
+	if err = binary.Read(bytes.NewReader(gdb), binary.LittleEndian, e.gd); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func readSparseHeader(r io.ReaderAt, off int64) (sparseHeader, error) {
+	h := sparseHeader{}
+	b := make([]byte, sectorSize)
+	if _, err := r.ReadAt(b, off); err != nil {
+		return h, err
+	}
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &h); err != nil {
+		return h, err
+	}
+	if !bytes.Equal(h.Magic[:], sparseMagic) {
+		return h, ErrNotVMDK
+	}
+	return h, nil
+}
+
+func readerSize(r io.ReaderAt) (int64, error) {
+	switch v := r.(type) {
+	case interface {
+		Size() int64
+	}:
+		return v.Size(), nil
+	case interface {
+		Stat() (os.FileInfo, error)
+	}:
+		fi, err := v.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+	return 0, errors.New(`unable to determine the size of the VMDK extent`)
+}
+
+// createType names the kind of VMDK a sparse extent without a descriptor
+// is. Compressed grains with markers are what makes it streamOptimized.
+func (e *sparseExtent) createType() string {
+	if e.h.Flags&(flagCompressed|flagMarkers) == flagCompressed|flagMarkers {
+		return `streamOptimized`
+	}
+	return `monolithicSparse`
+}
+
+// descriptor returns the embedded descriptor, if any.
+func (e *sparseExtent) descriptor() ([]byte, error) {
+	if e.h.DescriptorOffset == 0 || e.h.DescriptorSize == 0 {
+		return nil, nil
+	}
+	b := make([]byte, e.h.DescriptorSize*sectorSize)
+	if _, err := e.r.ReadAt(b, int64(e.h.DescriptorOffset)*sectorSize); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(b, "\x00"), nil
+}
+
+func (e *sparseExtent) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if off >= e.capacity {
+			return n, io.EOF
+		}
+		gi := off / e.grainBytes
+		within := off % e.grainBytes
+		l := e.grainBytes - within
+		if l > int64(len(p)) {
+			l = int64(len(p))
+		}
+		if rest := e.capacity - off; l > rest {
+			l = rest
+		}
+		if err := e.readGrain(p[:l], gi, within); err != nil {
+			return n, err
+		}
+		n += int(l)
+		off += l
+		p = p[l:]
+	}
+	return n, nil
+}
+
+// readGrain fills p with data from grain gi starting at within.
+func (e *sparseExtent) readGrain(p []byte, gi int64, within int64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	sector, err := e.grainSector(gi)
+	if err != nil {
+		return err
+	}
+	if sector == 0 || sector == grainZero {
+		for i := range p {
+			p[i] = 0
+		}
+		return nil
+	}
+	if e.h.Flags&flagCompressed == 0 {
+		_, err = e.r.ReadAt(p, int64(sector)*sectorSize+within)
+		return err
+	}
+
+	// Compressed grains are inflated whole, keep the last one for
+	// sequential readers
+	if e.grainIndex != gi {
+		if e.grain, err = e.inflate(sector); err != nil {
+			return err
+		}
+		e.grainIndex = gi
+	}
+	copy(p, e.grain[within:])
+	return nil
+}
+
+func (e *sparseExtent) grainSector(gi int64) (uint32, error) {
+	per := int64(e.h.NumGTEsPerGT)
+	gdi := gi / per
+	if gdi >= int64(len(e.gd)) {
+		return 0, nil
+	}
+	gts := e.gd[gdi]
+	if gts == 0 {
+		return 0, nil
+	}
+	gt, ok := e.tables[gts]
+	if !ok {
+		b := make([]byte, per*4)
+		if _, err := e.r.ReadAt(b, int64(gts)*sectorSize); err != nil {
+			return 0, fmt.Errorf(`unable to read a VMDK grain table: %v`, err)
+		}
+		gt = make([]uint32, per)
+		if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, gt); err != nil {
+			return 0, err
+		}
+		e.tables[gts] = gt
+	}
+	return gt[gi%per], nil
+}
+
+// inflate reads a compressed grain. Each is prefixed by its LBA and the size
+// of the compressed data.
+func (e *sparseExtent) inflate(sector uint32) ([]byte, error) {
+	off := int64(sector) * sectorSize
+	hdr := make([]byte, 12)
+	if _, err := e.r.ReadAt(hdr, off); err != nil {
+		return nil, err
+	}
+	size := int64(binary.LittleEndian.Uint32(hdr[8:]))
+	zr, err := zlib.NewReader(io.NewSectionReader(e.r, off+12, size))
+	if err != nil {
+		return nil, fmt.Errorf(`malformed compressed VMDK grain: %v`, err)
+	}
+	defer zr.Close()
+	g := make([]byte, e.grainBytes)
+	if _, err = io.ReadFull(zr, g); err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf(`malformed compressed VMDK grain: %v`, err)
+	}
+	return g, nil
+}
@@ -0,0 +1,272 @@
+//go:build ignore
+// +build ignore
+
+// generate writes the VMDK fixtures of the vmdk tests. Run it from this
+// directory with go run generate.go.
+//
+// Every disk is 64 KiB of 4 KiB grains. Grain 0 and grain 5 hold data, grain
+// 2 is allocated but zeroed and the rest are unallocated. The byte at offset
+// i of the virtual disk is byte(i%251) in the grains that hold data.
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+)
+
+const (
+	sector    = 512
+	grain     = 8 // sectors
+	capacity  = 128
+	gtEntries = 512
+)
+
+var data = []int{0, 5}
+
+type header struct {
+	Magic              [4]byte
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RGDOffset          uint64
+	GDOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+}
+
+func newHeader(flags uint32) header {
+	return header{
+		Magic:              [4]byte{'K', 'D', 'M', 'V'},
+		Version:            1,
+		Flags:              flags,
+		Capacity:           capacity,
+		GrainSize:          grain,
+		NumGTEsPerGT:       gtEntries,
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+	}
+}
+
+func grainData(g int) []byte {
+	b := make([]byte, grain*sector)
+	for i := range b {
+		b[i] = byte((g*grain*sector + i) % 251)
+	}
+	return b
+}
+
+// sectorOf writes v padded to whole sectors.
+func sectorOf(v interface{}) []byte {
+	b := new(bytes.Buffer)
+	if err := binary.Write(b, binary.LittleEndian, v); err != nil {
+		log.Fatal(err)
+	}
+	return pad(b.Bytes())
+}
+
+func pad(b []byte) []byte {
+	if r := len(b) % sector; r != 0 {
+		b = append(b, make([]byte, sector-r)...)
+	}
+	return b
+}
+
+// monolithicSparse lays out header, descriptor, grain directory, grain table
+// and grains.
+func monolithicSparse(descriptor string) []byte {
+	h := newHeader(0x3)
+	desc := pad([]byte(descriptor))
+	if descriptor != `` {
+		h.DescriptorOffset = 1
+		h.DescriptorSize = uint64(len(desc) / sector)
+	}
+	h.GDOffset = 1 + h.DescriptorSize
+	gt := h.GDOffset + 1
+	h.OverHead = gt + gtEntries*4/sector
+	h.RGDOffset = h.GDOffset
+
+	table := make([]uint32, gtEntries)
+	table[2] = 1
+	for i, g := range data {
+		table[g] = uint32(h.OverHead) + uint32(i*grain)
+	}
+	out := sectorOf(h)
+	out = append(out, desc...)
+	out = append(out, sectorOf([]uint32{uint32(gt)})...)
+	out = append(out, sectorOf(table)...)
+	for _, g := range data {
+		out = append(out, grainData(g)...)
+	}
+	return out
+}
+
+// streamOptimized lays out header, compressed grains, grain table, grain
+// directory, footer and end of stream marker.
+func streamOptimized() []byte {
+	h := newHeader(0x30001)
+	h.GDOffset = 0xffffffffffffffff
+	h.CompressAlgorithm = 1
+	// Grain sectors 0 and 1 mean unallocated and zeroed, so the grains
+	// start after the header and a reserved sector
+	h.OverHead = 2
+	out := append(sectorOf(h), make([]byte, sector)...)
+
+	table := make([]uint32, gtEntries)
+	table[2] = 1
+	for _, g := range data {
+		table[g] = uint32(len(out) / sector)
+		z := new(bytes.Buffer)
+		zw := zlib.NewWriter(z)
+		zw.Write(grainData(g))
+		zw.Close()
+		m := new(bytes.Buffer)
+		binary.Write(m, binary.LittleEndian, uint64(g*grain))
+		binary.Write(m, binary.LittleEndian, uint32(z.Len()))
+		m.Write(z.Bytes())
+		out = append(out, pad(m.Bytes())...)
+	}
+
+	marker := func(kind uint32, sectors uint64) []byte {
+		m := make([]byte, sector)
+		binary.LittleEndian.PutUint64(m, sectors)
+		binary.LittleEndian.PutUint32(m[12:], kind)
+		return m
+	}
+	out = append(out, marker(1, gtEntries*4/sector)...)
+	gt := len(out) / sector
+	out = append(out, sectorOf(table)...)
+	out = append(out, marker(2, 1)...)
+	h.GDOffset = uint64(len(out) / sector)
+	out = append(out, sectorOf([]uint32{uint32(gt)})...)
+	out = append(out, marker(3, 1)...)
+	out = append(out, sectorOf(h)...)
+	return append(out, make([]byte, sector)...)
+}
+
+// qemuStreamOptimized lays out a disk the way qemu-img convert -O vmdk -o
+// subformat=streamOptimized does: a version 3 header with the compressed,
+// markers, redundant grain directory and newline detection flags, a 20
+// sector embedded descriptor, both grain directories and their tables
+// preallocated after it, grains of 64 KiB from the first grain boundary and
+// an end of stream marker. qemu-img was not at hand when it was written, so
+// the layout follows the qemu sources rather than a file it wrote.
+func qemuStreamOptimized(fn string) []byte {
+	const (
+		qemuGrain = 128 // sectors
+		descSize  = 20
+		gtSectors = gtEntries * 4 / sector
+	)
+	h := newHeader(0x30003)
+	h.Version = 3
+	h.GrainSize = qemuGrain
+	h.CompressAlgorithm = 1
+	h.DescriptorOffset = 1
+	h.DescriptorSize = descSize
+	h.RGDOffset = h.DescriptorOffset + descSize
+	h.GDOffset = h.RGDOffset + 1 + gtSectors
+	h.OverHead = qemuGrain
+	desc := []byte(`# Disk DescriptorFile
+version=1
+CID=52a0c2b1
+parentCID=ffffffff
+createType="streamOptimized"
+
+# Extent description
+RW 128 SPARSE "` + fn + `"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.geometry.cylinders = "0"
+ddb.geometry.heads = "16"
+ddb.geometry.sectors = "63"
+ddb.adapterType = "ide"
+`)
+	desc = append(desc, make([]byte, descSize*sector-len(desc))...)
+
+	// The only grain holds the data of the 4 KiB grains of the other fixtures
+	disk := make([]byte, capacity*sector)
+	for _, g := range data {
+		copy(disk[g*grain*sector:], grainData(g))
+	}
+	table := make([]uint32, gtEntries)
+	table[0] = qemuGrain
+
+	out := append(sectorOf(h), desc...)
+	for _, gd := range []uint64{h.RGDOffset, h.GDOffset} {
+		out = append(out, sectorOf([]uint32{uint32(gd + 1)})...)
+		out = append(out, sectorOf(table)...)
+	}
+	out = append(out, make([]byte, qemuGrain*sector-len(out))...)
+	z := new(bytes.Buffer)
+	zw := zlib.NewWriter(z)
+	zw.Write(disk)
+	zw.Close()
+	m := new(bytes.Buffer)
+	binary.Write(m, binary.LittleEndian, uint64(0))
+	binary.Write(m, binary.LittleEndian, uint32(z.Len()))
+	m.Write(z.Bytes())
+	out = append(out, pad(m.Bytes())...)
+	return append(out, make([]byte, sector)...)
+}
+
+func write(fn string, b []byte) {
+	if err := ioutil.WriteFile(fn, b, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func main() {
+	write(`sparse.vmdk`, monolithicSparse(``))
+	write(`embedded.vmdk`, monolithicSparse(`# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="monolithicSparse"
+
+RW 128 SPARSE "embedded.vmdk"
+`))
+	write(`stream.vmdk`, streamOptimized())
+	write(`qemu-stream.vmdk`, qemuStreamOptimized(`qemu-stream.vmdk`))
+	write(`text.vmdk`, []byte("Not a disk\n"))
+
+	// A descriptor joining a flat extent and a zero extent
+	flat := make([]byte, 0, capacity*sector)
+	for g := 0; g < capacity/grain; g++ {
+		flat = append(flat, grainData(g)...)
+	}
+	write(`flat-flat.vmdk`, flat[:64*sector])
+	write(`flat.vmdk`, []byte(`# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="monolithicFlat"
+
+RW 64 FLAT "flat-flat.vmdk" 0
+RW 64 ZERO
+`))
+	write(`child.vmdk`, []byte(`# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=1234abcd
+createType="monolithicSparse"
+parentFileNameHint="parent.vmdk"
+
+RW 128 SPARSE "child-s001.vmdk"
+`))
+}
@@ -0,0 +1,260 @@
+// Package vmdk reads VMware virtual disks. It supports descriptor files with
+// flat, sparse and zero extents as well as monolithic sparse and
+// streamOptimized files with an embedded descriptor. Differencing disks that
+// depend on a parent are not supported.
+package vmdk
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	path "path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const sectorSize = 512
+
+var (
+	ErrNotVMDK      = errors.New(`not a VMDK disk`)
+	ErrDifferencing = errors.New(`differencing VMDK disks with a parent are not supported`)
+)
+
+// Disk is the virtual disk described by a VMDK. It implements io.ReaderAt
+// over the whole virtual disk.
+type Disk struct {
+	CreateType string
+	extents    []extent
+	size       int64
+	files      []*os.File
+}
+
+type extent struct {
+	start int64 // offset of the extent in the virtual disk
+	size  int64
+	r     io.ReaderAt // nil for zero extents
+}
+
+// Open opens the VMDK at fn, which is either a descriptor file or a sparse
+// extent with an embedded descriptor.
+func Open(fn string) (*Disk, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	d := &Disk{}
+	ok := false
+	defer func() {
+		if !ok {
+			d.Close()
+		}
+	}()
+	d.files = append(d.files, f)
+
+	magic := make([]byte, 4)
+	if _, err = f.ReadAt(magic, 0); err != nil {
+		return nil, ErrNotVMDK
+	}
+
+	var desc []byte
+	var self *sparseExtent
+	if bytes.Equal(magic, sparseMagic) {
+		if self, err = openSparse(f); err != nil {
+			return nil, err
+		}
+		if desc, err = self.descriptor(); err != nil {
+			return nil, err
+		}
+		if len(desc) == 0 {
+			// No descriptor, the file is the only extent
+			d.CreateType = self.createType()
+			d.extents = []extent{{size: self.capacity, r: self}}
+			d.size = self.capacity
+			ok = true
+			return d, nil
+		}
+	} else {
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		// Descriptor files are small text files
+		if fi.Size() > 64*1024 {
+			return nil, ErrNotVMDK
+		}
+		desc = make([]byte, fi.Size())
+		if _, err = f.ReadAt(desc, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	dd, err := parseDescriptor(desc)
+	if err != nil {
+		return nil, err
+	}
+	d.CreateType = dd.createType
+	for _, de := range dd.extents {
+		e := extent{start: d.size, size: de.sectors * sectorSize}
+		switch de.kind {
+		case `ZERO`:
+		case `FLAT`, `VMFS`:
+			ef, err := d.open(fn, de.file, f)
+			if err != nil {
+				return nil, err
+			}
+			e.r = io.NewSectionReader(ef, de.offset*sectorSize, e.size)
+		case `SPARSE`, `VMFSSPARSE`:
+			ef, err := d.open(fn, de.file, f)
+			if err != nil {
+				return nil, err
+			}
+			if ef == f && self != nil {
+				e.r = self
+			} else if e.r, err = openSparse(ef); err != nil {
+				return nil, fmt.Errorf(`%v: %v`, de.file, err)
+			}
+		default:
+			return nil, fmt.Errorf(`unsupported VMDK extent type %v`, de.kind)
+		}
+		d.extents = append(d.extents, e)
+		d.size += e.size
+	}
+	ok = true
+	return d, nil
+}
+
+// open opens an extent file named relative to the descriptor, reusing the
+// descriptor file itself when it is named.
+func (d *Disk) open(desc string, name string, df *os.File) (*os.File, error) {
+	p := path.Join(path.Dir(desc), name)
+	if path.Base(p) == path.Base(desc) {
+		return df, nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	d.files = append(d.files, f)
+	return f, nil
+}
+
+// Size returns the size of the virtual disk in bytes.
+func (d *Disk) Size() int64 {
+	return d.size
+}
+
+func (d *Disk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New(`negative offset`)
+	}
+	n := 0
+	for _, e := range d.extents {
+		if len(p) == 0 {
+			break
+		}
+		if off >= e.start+e.size || off < e.start {
+			continue
+		}
+		l := int64(len(p))
+		if rest := e.start + e.size - off; l > rest {
+			l = rest
+		}
+		chunk := p[:l]
+		if e.r == nil {
+			for i := range chunk {
+				chunk[i] = 0
+			}
+		} else if _, err := e.r.ReadAt(chunk, off-e.start); err != nil && err != io.EOF {
+			return n, err
+		}
+		n += int(l)
+		off += l
+		p = p[l:]
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *Disk) Close() error {
+	var err error
+	for _, f := range d.files {
+		if cerr := f.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	d.files = nil
+	return err
+}
+
+//
+// descriptor parsing
+//
+
+type descriptor struct {
+	createType string
+	extents    []descriptorExtent
+}
+
+type descriptorExtent struct {
+	access  string
+	sectors int64
+	kind    string
+	file    string
+	offset  int64
+}
+
+var extentLine = regexp.MustCompile(`^(RW|RDONLY|NOACCESS)\s+(\d+)\s+(\w+)(?:\s+"([^"]*)"(?:\s+(\d+))?)?`)
+
+func parseDescriptor(b []byte) (descriptor, error) {
+	d := descriptor{}
+	found := false
+	s := bufio.NewScanner(bytes.NewReader(bytes.TrimRight(b, "\x00")))
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(l, `# Disk DescriptorFile`) {
+			found = true
+			continue
+		}
+		if len(l) == 0 || l[0] == '#' {
+			continue
+		}
+		if m := extentLine.FindStringSubmatch(l); m != nil {
+			e := descriptorExtent{access: m[1], kind: m[3], file: m[4]}
+			e.sectors, _ = strconv.ParseInt(m[2], 10, 64)
+			if m[5] != `` {
+				e.offset, _ = strconv.ParseInt(m[5], 10, 64)
+			}
+			d.extents = append(d.extents, e)
+			continue
+		}
+		kv := strings.SplitN(l, `=`, 2)
+		if len(kv) != 2 {
+			continue
+		}
+		k, v := strings.TrimSpace(kv[0]), strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		switch k {
+		case `createType`:
+			d.createType = v
+		case `parentCID`:
+			if strings.ToLower(v) != `ffffffff` {
+				return d, ErrDifferencing
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return d, err
+	}
+	if !found && len(d.extents) == 0 {
+		return d, ErrNotVMDK
+	}
+	if len(d.extents) == 0 {
+		return d, errors.New(`the VMDK descriptor lists no extents`)
+	}
+	return d, nil
+}
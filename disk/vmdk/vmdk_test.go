@@ -0,0 +1,101 @@
+package vmdk
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// The fixtures are written by testdata/generate.go. Grains of 4 KiB that
+// hold data have byte(i%251) at offset i of the virtual disk.
+const testCapacity = 64 * 1024
+
+func sparseContents(grains ...int) []byte {
+	b := make([]byte, testCapacity)
+	for _, g := range grains {
+		for i := g * 4096; i < (g+1)*4096; i++ {
+			b[i] = byte(i % 251)
+		}
+	}
+	return b
+}
+
+func TestOpen(t *testing.T) {
+	flat := sparseContents(0, 1, 2, 3, 4, 5, 6, 7)
+	for _, c := range []struct {
+		fn         string
+		createType string
+		wants      []byte
+	}{
+		{`testdata/sparse.vmdk`, `monolithicSparse`, sparseContents(0, 5)},
+		{`testdata/embedded.vmdk`, `monolithicSparse`, sparseContents(0, 5)},
+		{`testdata/stream.vmdk`, `streamOptimized`, sparseContents(0, 5)},
+		{`testdata/qemu-stream.vmdk`, `streamOptimized`, sparseContents(0, 5)},
+		{`testdata/flat.vmdk`, `monolithicFlat`, flat},
+	} {
+		d, err := Open(c.fn)
+		if err != nil {
+			t.Errorf("%v: %v", c.fn, err)
+			continue
+		}
+		if d.CreateType != c.createType {
+			t.Errorf("%v: the create type is %v, want %v", c.fn, d.CreateType, c.createType)
+		}
+		if d.Size() != testCapacity {
+			t.Errorf("%v: the size is %v, want %v", c.fn, d.Size(), testCapacity)
+		}
+		got := make([]byte, testCapacity)
+		if _, err = d.ReadAt(got, 0); err != nil {
+			t.Errorf("%v: %v", c.fn, err)
+		} else if !bytes.Equal(got, c.wants) {
+			t.Errorf("%v: the contents differ from the fixture", c.fn)
+		}
+
+		// Reads across grain and extent boundaries
+		got = make([]byte, 5000)
+		if _, err = d.ReadAt(got, 30000); err != nil {
+			t.Errorf("%v: %v", c.fn, err)
+		} else if !bytes.Equal(got, c.wants[30000:35000]) {
+			t.Errorf("%v: a read across boundaries differs from the fixture", c.fn)
+		}
+		if _, err = d.ReadAt(make([]byte, 1), testCapacity); err != io.EOF {
+			t.Errorf("%v: a read past the end returned %v, want EOF", c.fn, err)
+		}
+		d.Close()
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	for _, c := range []struct {
+		fn    string
+		wants error
+	}{
+		{`testdata/child.vmdk`, ErrDifferencing},
+		{`testdata/text.vmdk`, ErrNotVMDK},
+	} {
+		if _, err := Open(c.fn); err != c.wants {
+			t.Errorf("%v: got %v, want %v", c.fn, err, c.wants)
+		}
+	}
+}
+
+func TestParseDescriptor(t *testing.T) {
+	d, err := parseDescriptor([]byte("# Disk DescriptorFile\ncreateType=\"twoGbMaxExtentSparse\"\n" +
+		"RW 4192256 SPARSE \"disk-s001.vmdk\"\nRDONLY 2048 FLAT \"disk-f002.vmdk\" 63\nRW 100 ZERO\n\x00\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wants := []descriptorExtent{
+		{access: `RW`, sectors: 4192256, kind: `SPARSE`, file: `disk-s001.vmdk`},
+		{access: `RDONLY`, sectors: 2048, kind: `FLAT`, file: `disk-f002.vmdk`, offset: 63},
+		{access: `RW`, sectors: 100, kind: `ZERO`},
+	}
+	if d.createType != `twoGbMaxExtentSparse` || len(d.extents) != len(wants) {
+		t.Fatalf("got %+v", d)
+	}
+	for i, e := range wants {
+		if d.extents[i] != e {
+			t.Errorf("extent %v is %+v, want %+v", i, d.extents[i], e)
+		}
+	}
+}
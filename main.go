@@ -5,12 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"github.com/docker/v2c/api"
+	"github.com/docker/v2c/builtin"
+	"github.com/docker/v2c/disk"
 	"github.com/docker/v2c/system"
 	"github.com/docker/v2c/workflow"
 	"github.com/urfave/cli"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 )
 
 const name string = `v2c`
@@ -22,6 +25,7 @@ var (
 	errAtLeastOne  = errors.New(`expected at least one argument`)
 	errExactlyOne  = errors.New(`expected exactly one argument`)
 	errExactlyNone = errors.New(`no arguments are expected`)
+	errAtMostOne   = errors.New(`expected at most one argument`)
 )
 
 func main() {
@@ -36,7 +40,7 @@ func newApp() *cli.App {
 	app.Commands = []cli.Command{
 		{
 			Name:     `build`,
-			Usage:    `transform a virtual disk into a container`,
+			Usage:    `transform the virtual disks or filesystem tree of a machine into a container`,
 			Category: `Transform`,
 			Flags: []cli.Flag{
 				cli.StringFlag{
@@ -47,6 +51,66 @@ func newApp() *cli.App {
 					Name:  `no-cleanup, n`,
 					Usage: `Do no delete unpacked disk`,
 				},
+				cli.StringFlag{
+					Name:  `base-images`,
+					Usage: "Read operating system to base image mappings from `FILE`",
+				},
+				cli.StringFlag{
+					Name:  `policy`,
+					Usage: "Enforce the base image policy in `FILE`",
+				},
+				cli.BoolFlag{
+					Name:  `offline`,
+					Usage: `Fail unless the base image is available without a registry`,
+				},
+				cli.StringFlag{
+					Name:  `base-bundle`,
+					Usage: "Load a missing base image from the docker save archive `FILE`",
+				},
+				cli.StringFlag{
+					Name:  `from-image`,
+					Usage: "Decompose the local image `REF` instead of disks",
+				},
+				cli.StringFlag{
+					Name:  `from-container`,
+					Usage: "Decompose the filesystem of container `ID` instead of disks",
+				},
+				cli.StringSliceFlag{
+					Name:  `exclude`,
+					Usage: "Leave `PATH` out when capturing a live host over ssh",
+				},
+				cli.StringSliceFlag{
+					Name:  `detective`,
+					Usage: "Only run the detectives whose REPOSITORY:TAG matches `PATTERN`",
+				},
+				cli.StringSliceFlag{
+					Name:  `skip-detective`,
+					Usage: "Do not run the detectives whose REPOSITORY:TAG matches `PATTERN`",
+				},
+				cli.StringFlag{
+					Name:  `since`,
+					Usage: "Update the earlier product `IMAGE` with only what changed since it was built",
+				},
+				cli.BoolFlag{
+					Name:  `no-cache`,
+					Usage: `Run every detective again instead of reusing cached results`,
+				},
+				cli.BoolFlag{
+					Name:  `split-services`,
+					Usage: `Write a build context per service and a docker-compose.yml`,
+				},
+				cli.StringSliceFlag{
+					Name:  `emit`,
+					Usage: "Also write `OUTPUT`, k8s writes Kubernetes manifests for the tagged image",
+				},
+				cli.StringFlag{
+					Name:  `packager`,
+					Usage: "Unpack the disks with the packager `REPOSITORY:TAG` instead of choosing one",
+				},
+				cli.StringFlag{
+					Name:  `root-partition`,
+					Usage: "Unpack partition `NUMBER` of the first disk, or a device such as /dev/sdb2, as the root filesystem instead of discovering it",
+				},
 			},
 			Action: buildHandler,
 		},
@@ -59,9 +123,129 @@ func newApp() *cli.App {
 					Name:  `tag, t`,
 					Usage: "Tag the resulting image with `REPOSITORY[:TAG]`",
 				},
+				cli.StringFlag{
+					Name:  `base-images`,
+					Usage: "Read operating system to base image mappings from `FILE`",
+				},
+				cli.StringFlag{
+					Name:  `policy`,
+					Usage: "Enforce the base image policy in `FILE`",
+				},
+				cli.BoolFlag{
+					Name:  `offline`,
+					Usage: `Fail unless the base image is available without a registry`,
+				},
+				cli.StringFlag{
+					Name:  `base-bundle`,
+					Usage: "Load a missing base image from the docker save archive `FILE`",
+				},
+				cli.StringSliceFlag{
+					Name:  `exclude`,
+					Usage: "Hide `PATH` from detectives",
+				},
+				cli.BoolFlag{
+					Name:  `split-services`,
+					Usage: `Write a build context per service and a docker-compose.yml`,
+				},
+				cli.StringSliceFlag{
+					Name:  `emit`,
+					Usage: "Also write `OUTPUT`, k8s writes Kubernetes manifests for the tagged image",
+				},
 			},
 			Action: localBuildHandler,
 		},
+		{
+			Name:     `retarget`,
+			Usage:    `move the build context in the working directory onto a different base image`,
+			Category: `Transform`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  `os`,
+					Usage: "Use `IMAGE` or a DISTRO:VERSION from the base image mappings",
+				},
+				cli.StringFlag{
+					Name:  `base-images`,
+					Usage: "Read operating system to base image mappings from `FILE`",
+				},
+				cli.StringFlag{
+					Name:  `policy`,
+					Usage: "Enforce the base image policy in `FILE`",
+				},
+				cli.BoolFlag{
+					Name:  `offline`,
+					Usage: `Fail unless the base image is available without a registry`,
+				},
+				cli.StringFlag{
+					Name:  `base-bundle`,
+					Usage: "Load a missing base image from the docker save archive `FILE`",
+				},
+			},
+			Action: retargetHandler,
+		},
+		{
+			Name:     `assess`,
+			Usage:    `run only the packagers and detectives to inventory many machines`,
+			Category: `Transform`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  `format, f`,
+					Value: `table`,
+					Usage: "Report as a `FORMAT`: table, csv, json or html",
+				},
+				cli.StringFlag{
+					Name:  `output, o`,
+					Usage: "Write the csv, json or html report to `FILE` instead of assessment.FORMAT",
+				},
+				cli.StringSliceFlag{
+					Name:  `detective`,
+					Usage: "Run only detectives matching `PATTERN`",
+				},
+				cli.StringSliceFlag{
+					Name:  `skip-detective`,
+					Usage: "Skip detectives matching `PATTERN`",
+				},
+				cli.BoolFlag{
+					Name:  `no-cache`,
+					Usage: `Run every detective again instead of reusing cached results`,
+				},
+			},
+			Action: assessHandler,
+		},
+		{
+			Name:     `batch`,
+			Usage:    `transform every machine listed in a batch manifest`,
+			Category: `Transform`,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  `parallel, p`,
+					Usage: "Run `N` builds at once instead of the parallel setting of the manifest",
+				},
+				cli.StringFlag{
+					Name:  `report`,
+					Usage: "Write the JSON report to `FILE` instead of report.json in the runs directory",
+				},
+			},
+			Action: batchHandler,
+		},
+		{
+			Name:     `fleet`,
+			Usage:    `options for working with the build contexts of many machines`,
+			Category: `Transform`,
+			Subcommands: []cli.Command{
+				{
+					Name:  `base`,
+					Usage: `move what the build contexts share into a common base image`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  `tag, t`,
+							Value: `v2c-fleet-base:latest`,
+							Usage: "Rewrite the build contexts to build FROM `REPOSITORY[:TAG]`",
+						},
+					},
+					Action: fleetBaseHandler,
+				},
+			},
+		},
 		{
 			Name:     `image`,
 			Usage:    `options for working with transformed images`,
@@ -100,6 +284,78 @@ func newApp() *cli.App {
 				},
 			},
 		},
+		{
+			Name:     `disk`,
+			Usage:    `options for working with input disks`,
+			Category: `Transform`,
+			Subcommands: []cli.Command{
+				{
+					Name:   `inspect`,
+					Usage:  `list the partitions and filesystems on a disk`,
+					Action: inspectDiskHandler,
+				},
+				{
+					Name:   `ls`,
+					Usage:  `list a directory of the unpacked disk`,
+					Action: listDiskHandler,
+				},
+				{
+					Name:   `cat`,
+					Usage:  `print a file of the unpacked disk`,
+					Action: catDiskHandler,
+				},
+				{
+					Name:  `find`,
+					Usage: `search the unpacked disk for files`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  `name`,
+							Usage: "Only list files whose name matches `PATTERN`",
+						},
+						cli.StringFlag{
+							Name:  `type`,
+							Usage: "Only list files of `TYPE` f, d or l",
+						},
+					},
+					Action: findDiskHandler,
+				},
+				{
+					Name:  `shell`,
+					Usage: `open a shell on the unpacked disk the way detectives see it`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  `image`,
+							Value: `busybox:latest`,
+							Usage: "Run the shell in a container of `IMAGE`",
+						},
+					},
+					Action: shellDiskHandler,
+				},
+			},
+		},
+		{
+			Name:     `cache`,
+			Usage:    `options for sharing unpacked disks`,
+			Category: `Transform`,
+			Subcommands: []cli.Command{
+				{
+					Name:  `save`,
+					Usage: `save the unpacked disk with a digest to an archive`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  `output, o`,
+							Usage: "Write to `FILE`, compressed by its extension: .zst, .xz or .gz",
+						},
+					},
+					Action: saveCacheHandler,
+				},
+				{
+					Name:   `load`,
+					Usage:  `load an unpacked disk saved with cache save`,
+					Action: loadCacheHandler,
+				},
+			},
+		},
 		{
 			Name:     `detective`,
 			Usage:    `options for working with detectives`,
@@ -117,6 +373,23 @@ func newApp() *cli.App {
 				},
 			},
 		},
+		{
+			Name:     `packager`,
+			Usage:    `options for working with packagers`,
+			Category: `Component`,
+			Subcommands: []cli.Command{
+				{
+					Name:   `list`,
+					Usage:  `list the installed packagers`,
+					Action: listPackagerHandler,
+				},
+				{
+					Name:   `inspect`,
+					Usage:  `show what a packager reads and how it runs`,
+					Action: inspectPackagerHandler,
+				},
+			},
+		},
 		{
 			Name:     `provisioner`,
 			Usage:    `options for working with provisioners`,
@@ -139,17 +412,39 @@ func newApp() *cli.App {
 }
 
 func buildHandler(c *cli.Context) error {
-	if c.NArg() != 1 {
-		return errExactlyOne
+	fromImage, fromContainer := c.String(`from-image`), c.String(`from-container`)
+	switch {
+	case fromImage != `` && fromContainer != ``:
+		return errors.New(`--from-image and --from-container cannot be combined`)
+	case fromImage != `` || fromContainer != ``:
+		if c.NArg() > 0 {
+			return errExactlyNone
+		}
+	case c.NArg() < 1:
+		return errAtLeastOne
 	}
 	fmt.Println("Running image transformation.")
 
-	abs, err := filepath.Abs(c.Args().Get(0))
-	if err != nil {
-		return err
+	host := ``
+	targets := []string{}
+	for _, a := range c.Args() {
+		if workflow.IsSSHTarget(a) {
+			if c.NArg() > 1 {
+				return fmt.Errorf(`%v is a live host and cannot be combined with other inputs`, a)
+			}
+			host = a
+			continue
+		}
+		abs, err := filepath.Abs(a)
+		if err != nil {
+			return err
+		}
+		if _, err = os.Stat(abs); err != nil {
+			return err
+		}
+		targets = append(targets, abs)
 	}
-	_, err = os.Stat(abs)
-	if err != nil {
+	if err := loadBaseImages(c); err != nil {
 		return err
 	}
 
@@ -170,7 +465,12 @@ func buildHandler(c *cli.Context) error {
 		fmt.Println(`Unpacked input will not be cleaned up upon completion.`)
 	}
 
-	_, err = workflow.Build(ctx, abs, c.Bool(`no-cleanup`))
+	o, err := buildOptions(c)
+	if err != nil {
+		return err
+	}
+	o.FromHost = host
+	_, err = workflow.Build(ctx, targets, o)
 	return err
 }
 
@@ -188,6 +488,9 @@ func localBuildHandler(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	if err = loadBaseImages(c); err != nil {
+		return err
+	}
 
 	var (
 		ctx    context.Context
@@ -201,10 +504,76 @@ func localBuildHandler(c *cli.Context) error {
 		cancel()
 	}(cancel)
 
-	_, err = workflow.BuildLocal(ctx, abs)
+	o, err := buildOptions(c)
+	if err != nil {
+		return err
+	}
+	_, err = workflow.BuildLocal(ctx, abs, o)
 	return err
 }
 
+func retargetHandler(c *cli.Context) error {
+	if c.Args().Present() {
+		return errExactlyNone
+	}
+	if c.String(`os`) == `` {
+		return errors.New(`--os is required`)
+	}
+	if err := loadBaseImages(c); err != nil {
+		return err
+	}
+	o, err := buildOptions(c)
+	if err != nil {
+		return err
+	}
+	return workflow.Retarget(context.Background(), c.String(`os`), o)
+}
+
+func buildOptions(c *cli.Context) (workflow.Options, error) {
+	o := workflow.Options{
+		NoCleanup:      c.Bool(`no-cleanup`),
+		Offline:        c.Bool(`offline`),
+		BaseBundle:     c.String(`base-bundle`),
+		FromImage:      c.String(`from-image`),
+		FromContainer:  c.String(`from-container`),
+		Excludes:       c.StringSlice(`exclude`),
+		NoCache:        c.Bool(`no-cache`),
+		Since:          c.String(`since`),
+		SplitServices:  c.Bool(`split-services`),
+		Tag:            c.String(`tag`),
+		Emit:           c.StringSlice(`emit`),
+		Detectives:     c.StringSlice(`detective`),
+		SkipDetectives: c.StringSlice(`skip-detective`),
+		Packager:       c.String(`packager`),
+		RootPartition:  c.String(`root-partition`),
+	}
+	if o.BaseBundle != `` {
+		abs, err := filepath.Abs(o.BaseBundle)
+		if err != nil {
+			return o, err
+		}
+		if _, err = os.Stat(abs); err != nil {
+			return o, err
+		}
+		o.BaseBundle = abs
+	}
+	if c.IsSet(`policy`) {
+		p, err := workflow.LoadPolicy(c.String(`policy`))
+		if err != nil {
+			return o, err
+		}
+		o.Policy = p
+	}
+	return o, nil
+}
+
+func loadBaseImages(c *cli.Context) error {
+	if !c.IsSet(`base-images`) {
+		return nil
+	}
+	return builtin.LoadBaseImages(c.String(`base-images`))
+}
+
 // management handlers
 
 func installDetectiveHandler(c *cli.Context) error {
@@ -239,6 +608,220 @@ func exportImageHandler(c *cli.Context) error {
 	return fmt.Errorf(`Not yet implemented`)
 }
 
+func assessHandler(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return errAtLeastOne
+	}
+	format := c.String(`format`)
+	switch format {
+	case `table`, `csv`, `json`, `html`:
+	default:
+		return fmt.Errorf(`%v is not a known format, use table, csv, json or html`, format)
+	}
+
+	// A machine made of several disks is given as a comma separated list
+	machines := [][]string{}
+	for _, a := range c.Args() {
+		targets := []string{}
+		for _, t := range strings.Split(a, `,`) {
+			abs, err := filepath.Abs(t)
+			if err != nil {
+				return err
+			}
+			if _, err = os.Stat(abs); err != nil {
+				return err
+			}
+			targets = append(targets, abs)
+		}
+		machines = append(machines, targets)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func(cancel context.CancelFunc) {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt)
+		<-c
+		cancel()
+	}(cancel)
+
+	o, err := buildOptions(c)
+	if err != nil {
+		return err
+	}
+	a, err := workflow.Assess(ctx, machines, o)
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	if format == `table` {
+		return renderTabbed(`assessment`, os.Stdout, a)
+	}
+
+	fn := c.String(`output`)
+	if fn == `` {
+		fn = `assessment.` + format
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	switch format {
+	case `csv`:
+		err = a.WriteCSV(f)
+	case `json`:
+		err = a.WriteJSON(f)
+	default:
+		err = a.WriteHTML(f)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Assessment of %v machines written to %v\n", len(a.Machines), fn)
+	return nil
+}
+
+func fleetBaseHandler(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return errors.New(`expected at least two build contexts`)
+	}
+	return workflow.FleetBase(context.Background(), c.Args(), c.String(`tag`))
+}
+
+func batchHandler(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errExactlyOne
+	}
+	m, err := workflow.LoadBatchManifest(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	if c.Int(`parallel`) > 0 {
+		m.Parallel = c.Int(`parallel`)
+	}
+	report, err := workflow.RunBatch(context.Background(), m)
+	if err != nil {
+		return err
+	}
+	fn := c.String(`report`)
+	if fn == `` {
+		fn = filepath.Join(m.Runs, `report.json`)
+	}
+	if err = workflow.WriteBatchReport(report, fn); err != nil {
+		return err
+	}
+	fmt.Println()
+	if err = renderTabbed(`batchSummary`, os.Stdout, report); err != nil {
+		return err
+	}
+	fmt.Printf("Report written to %v\n", fn)
+	if report.Failed > 0 {
+		return cli.NewExitError(``, 1)
+	}
+	return nil
+}
+
+func saveCacheHandler(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errExactlyOne
+	}
+	if c.String(`output`) == `` {
+		return errors.New(`--output is required`)
+	}
+	return workflow.SaveCache(context.Background(), c.Args().Get(0), c.String(`output`))
+}
+
+func loadCacheHandler(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errExactlyOne
+	}
+	return workflow.LoadCache(context.Background(), c.Args().Get(0))
+}
+
+func inspectDiskHandler(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errExactlyOne
+	}
+	img, err := disk.Open(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	parts, err := disk.Partitions(img, img.Size())
+	if err != nil {
+		return err
+	}
+	root := -1
+	probe := func(p disk.Partition) bool { return disk.HasFstab(img, p) }
+	if p, _, ok := disk.ChooseRoot(parts, probe); ok {
+		root = p.Number
+	}
+	return renderTabbed(`partitionList`, os.Stdout, struct {
+		Partitions []disk.Partition
+		Root       int
+	}{
+		Partitions: parts,
+		Root:       root,
+	})
+}
+
+func listDiskHandler(c *cli.Context) error {
+	if c.NArg() > 1 {
+		return errAtMostOne
+	}
+	name := `/`
+	if c.NArg() == 1 {
+		name = c.Args().Get(0)
+	}
+	es, err := workflow.ListDisk(context.Background(), name)
+	if err != nil {
+		return err
+	}
+	return renderTabbed(`diskList`, os.Stdout, es)
+}
+
+func catDiskHandler(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errExactlyOne
+	}
+	return workflow.CatDisk(context.Background(), c.Args().Get(0), os.Stdout)
+}
+
+func findDiskHandler(c *cli.Context) error {
+	if c.NArg() > 1 {
+		return errAtMostOne
+	}
+	switch c.String(`type`) {
+	case ``, `f`, `d`, `l`:
+	default:
+		return errors.New(`--type must be f, d or l`)
+	}
+	dir := `/`
+	if c.NArg() == 1 {
+		dir = c.Args().Get(0)
+	}
+	es, err := workflow.FindDisk(context.Background(), dir, c.String(`name`), c.String(`type`))
+	if err != nil {
+		return err
+	}
+	for _, e := range es {
+		fmt.Println(e.Path)
+	}
+	return nil
+}
+
+func shellDiskHandler(c *cli.Context) error {
+	code, err := workflow.ShellDisk(context.Background(), c.String(`image`), c.Args())
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return cli.NewExitError(``, int(code))
+	}
+	return nil
+}
+
 // list handlers
 
 func listImageHandler(c *cli.Context) error {
@@ -270,6 +853,34 @@ func listProvisionerHandler(c *cli.Context) error {
 	return renderTabbed(`provisionerList`, os.Stdout, components)
 }
 
+func listPackagerHandler(c *cli.Context) error {
+	if c.NArg() > 0 {
+		return errExactlyNone
+	}
+	components, err := system.DetectComponents()
+	if err != nil {
+		return err
+	}
+
+	return renderTabbed(`packagerList`, os.Stdout, components)
+}
+
+func inspectPackagerHandler(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errExactlyOne
+	}
+	components, err := system.DetectComponents()
+	if err != nil {
+		return err
+	}
+	p, ok := workflow.LookupPackager(components.Packagers, c.Args().Get(0))
+	if !ok {
+		return fmt.Errorf(`No installed packager named %v`, c.Args().Get(0))
+	}
+
+	return render(`packagerInspect`, os.Stdout, p)
+}
+
 func listDetectiveHandler(c *cli.Context) error {
 	if c.NArg() > 0 {
 		return errExactlyNone
@@ -1,2 +1,11 @@
-mkdir /v2c/disk
-guestfish -a /input/input -m /dev/sda1:/ copy-out / /v2c/disk
+TARGET=/v2c/disk${V2C_TARGET:-/}
+mkdir -p $TARGET
+ADD=""
+for i in ${V2C_INPUTS:-/input/input}; do ADD="$ADD -a $i"; done
+# Without a root partition the inspector finds the root filesystem and mounts
+# what its /etc/fstab names, logical volumes included
+if [ -n "$V2C_ROOT_PARTITION" ]; then
+	guestfish --ro $ADD -m $V2C_ROOT_PARTITION:/ copy-out / $TARGET
+else
+	guestfish --ro $ADD -i copy-out / $TARGET
+fi
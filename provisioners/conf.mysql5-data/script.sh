@@ -0,0 +1,12 @@
+#!/bin/sh
+# The detective sends the MySQL configuration and the datadir. Only the
+# datadir, found by its system database or InnoDB system tablespace, is
+# declared a volume.
+cat - > /input.tar
+DATADIR=$(tar tf /input.tar | sed -n -e 's#^\(.*\)/mysql/user\.frm$#\1#p' -e 's#^\(.*\)/ibdata1$#\1#p' | head -n 1)
+if [ -n "$DATADIR" ]; then
+  cd /
+  echo "VOLUME /$DATADIR" > Dockerfile
+  tar rf /input.tar Dockerfile
+fi
+cat /input.tar
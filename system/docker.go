@@ -1,6 +1,7 @@
 package system
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
 	"crypto/sha256"
@@ -15,7 +16,9 @@ import (
 	"github.com/docker/v2c/api"
 	gcontext "golang.org/x/net/context"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -29,6 +32,13 @@ var (
 		`category`:    `com.docker.v2c.component.category`,
 		`description`: `com.docker.v2c.component.description`,
 		`related`:     `com.docker.v2c.component.rel`,
+		`facts`:       `com.docker.v2c.component.facts`,
+		`formats`:     `com.docker.v2c.component.formats`,
+		`filesystems`: `com.docker.v2c.component.filesystems`,
+		`privileged`:  `com.docker.v2c.component.privileged`,
+		`service`:     `com.docker.v2c.component.service`,
+		`depends`:     `com.docker.v2c.component.service.depends`,
+		`digest`:      `com.docker.v2c.disk.digest`,
 	}
 )
 
@@ -63,6 +73,9 @@ func DetectComponents() (Components, error) {
 			panic(`Unknown component type detected: ` + img.ID)
 		}
 	}
+	result.Detectives = append(result.Detectives, api.BuiltinDetectives()...)
+	result.Provisioners = append(result.Provisioners, api.BuiltinProvisioners()...)
+	result.Packagers = append(result.Packagers, api.BuiltinPackagers()...)
 	return result, nil
 }
 
@@ -127,9 +140,37 @@ func RemoveProducts(is []string, f bool, p bool) ([]types.ImageDelete, error) {
 	return result, nil
 }
 
-var VOLNAME = `v2c-transport`
+// VOLNAME is the transport volume. Setting V2C_TRANSPORT_VOLUME gives a run
+// its own volume so that several runs can share an engine.
+var VOLNAME = transportVolumeName()
 
-func LaunchPackager(ctx context.Context, p api.Packager, input string) (string, error) {
+func transportVolumeName() string {
+	if v := os.Getenv(`V2C_TRANSPORT_VOLUME`); v != `` {
+		return v
+	}
+	return `v2c-transport`
+}
+
+// containerName names the container of a component for this run.
+func containerName(repository string, tag string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%v/%v/%v", VOLNAME, repository, tag))))
+}
+
+// PackagerInputs lists where n input disks are mounted in a packager, in the
+// order they are attached.
+func PackagerInputs(n int) []string {
+	result := []string{}
+	for i := 0; i < n; i++ {
+		if i == 0 {
+			result = append(result, `/input/input`)
+		} else {
+			result = append(result, fmt.Sprintf(`/input/input%v`, i))
+		}
+	}
+	return result
+}
+
+func LaunchPackager(ctx context.Context, p api.Packager, inputs []string, env []string) (string, error) {
 	client, err := docker.NewEnvClient()
 	if err != nil {
 		return ``, err
@@ -141,27 +182,31 @@ func LaunchPackager(ctx context.Context, p api.Packager, input string) (string,
 		return ``, err
 	}
 	if !exists {
-		err = CreateTransportVolume(ctx)
+		err = CreateTransportVolume(ctx, ``)
 		if err != nil {
 			return ``, fmt.Errorf(`Unable to create the v2c-transport volume`)
 		}
 	}
 
+	binds := []string{fmt.Sprintf(`%s:/v2c`, VOLNAME)}
+	for i, in := range PackagerInputs(len(inputs)) {
+		binds = append(binds, fmt.Sprintf(`%s:%s`, inputs[i], in))
+	}
+
 	fmt.Printf("Creating container for %v:%v\n", p.Repository, p.Tag)
 	// Create
 	createResult, err := client.ContainerCreate(gcontext.Background(),
 		&container.Config{
 			Image: fmt.Sprintf(`%v:%v`, p.Repository, p.Tag),
+			Env:   env,
 		},
 		&container.HostConfig{
 			NetworkMode: `none`,
-			Binds: []string{
-				fmt.Sprintf(`%s:/input/input`, input),
-				fmt.Sprintf(`%s:/v2c`, VOLNAME),
-			},
+			Privileged:  p.Privileged,
+			Binds:       binds,
 		},
 		&network.NetworkingConfig{},
-		fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%v/%v", p.Repository, p.Tag)))),
+		containerName(p.Repository, p.Tag),
 	)
 	if err != nil {
 		return ``, err
@@ -194,10 +239,55 @@ func LaunchPackager(ctx context.Context, p api.Packager, input string) (string,
 	return createResult.ID, nil
 }
 
-func LaunchDetective(ctx context.Context, c chan *bytes.Buffer, d api.Detective, tvn string) {
+// DetectiveView is the filesystem detectives read at /v2c/disk. It is either
+// the unpacked disk in Volume or a read-only bind of the host directory Root
+// with the paths in Hidden, relative to Root, covered by empty tmpfs mounts.
+type DetectiveView struct {
+	Volume string
+	Root   string
+	Hidden []string
+}
+
+// TransportView shows detectives the unpacked disk in the transport volume.
+func TransportView() DetectiveView {
+	return DetectiveView{Volume: VOLNAME}
+}
+
+func (v DetectiveView) hostConfig() *container.HostConfig {
+	hc := &container.HostConfig{NetworkMode: `none`}
+	if v.Root == `` {
+		hc.Binds = []string{fmt.Sprintf(`%v:/v2c:ro`, v.Volume)}
+		return hc
+	}
+	hc.Binds = []string{fmt.Sprintf(`%v:/v2c/disk:ro`, v.Root)}
+	hc.Tmpfs = map[string]string{}
+	for _, h := range v.Hidden {
+		hc.Tmpfs[filepath.Join(`/v2c/disk`, h)] = `ro,size=4k`
+	}
+	return hc
+}
+
+// DockerRootDir returns the directory the engine keeps its images, containers
+// and volumes in.
+func DockerRootDir(ctx context.Context) (string, error) {
 	client, err := docker.NewEnvClient()
 	if err != nil {
-		panic(err)
+		return ``, err
+	}
+
+	info, err := client.Info(gcontext.Background())
+	if err != nil {
+		return ``, err
+	}
+	return info.DockerRootDir, nil
+}
+
+// RunDetective runs the detective d against the filesystem in v and returns
+// its exit code and what it wrote to stdout.
+func RunDetective(ctx context.Context, d api.Detective, v DetectiveView) (int64, *bytes.Buffer, error) {
+	client, err := docker.NewEnvClient()
+	if err != nil {
+		return 0, nil, err
 	}
 
 	// Start a container from the image described by d
@@ -208,31 +298,35 @@ func LaunchDetective(ctx context.Context, c chan *bytes.Buffer, d api.Detective,
 		&container.Config{
 			Image: fmt.Sprintf(`%v:%v`, d.Repository, d.Tag),
 		},
-		&container.HostConfig{
-			Binds:       []string{fmt.Sprintf(`%v:/v2c:ro`, tvn)},
-			NetworkMode: `none`,
-		},
+		v.hostConfig(),
 		&network.NetworkingConfig{},
-		fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%v/%v", d.Repository, d.Tag)))),
+		containerName(d.Repository, d.Tag),
 	)
 	if err != nil {
-		panic(err)
+		return 0, nil, err
 	}
+	// Cleanup the detective container
+	defer RemoveContainer(ctx, createResult.ID)
+	return runForOutput(ctx, client, createResult.ID)
+}
 
+// runForOutput starts the container id and returns its exit code and what
+// it wrote to stdout.
+func runForOutput(ctx context.Context, client *docker.Client, id string) (int64, *bytes.Buffer, error) {
 	// attach to the container
-	attachment, err := client.ContainerAttach(gcontext.Background(), createResult.ID, types.ContainerAttachOptions{Stdin: false, Stdout: true, Stream: true})
+	attachment, err := client.ContainerAttach(gcontext.Background(), id, types.ContainerAttachOptions{Stdin: false, Stdout: true, Stream: true})
 	if err != nil {
-		panic(err)
+		return 0, nil, err
 	}
 	defer attachment.Close()
 
 	// Run
 	err = client.ContainerStart(gcontext.Background(),
-		createResult.ID,
+		id,
 		types.ContainerStartOptions{},
 	)
 	if err != nil {
-		panic(err)
+		return 0, nil, err
 	}
 
 	// Copy the buffer
@@ -250,33 +344,18 @@ func LaunchDetective(ctx context.Context, c chan *bytes.Buffer, d api.Detective,
 		}
 	}
 	if err != io.EOF {
-		panic(err)
+		return 0, nil, err
 	}
 
 	// Wait for the container to stop
-	var code int64
-	code, err = client.ContainerWait(ctx, createResult.ID)
+	code, err := client.ContainerWait(ctx, id)
 	if err != nil {
-		panic(err)
+		return 0, nil, err
 	}
-
-	if code != 0 {
-		fmt.Printf("No results for %v:%v code: %v\n", d.Repository, d.Tag, code)
-		stdout = nil
-	}
-
-	// Cleanup the detective container
-	err = RemoveContainer(ctx, createResult.ID)
-	if err != nil {
-		panic(err)
-	}
-
-	// Send the collected output on c
-	// TODO: Do we need a timeout here? I think so...
-	c <- stdout
+	return code, stdout, nil
 }
 
-func LaunchProvisioner(ctx context.Context, in *bytes.Buffer, c chan *bytes.Buffer, p api.Provisioner) {
+func LaunchProvisioner(ctx context.Context, in *bytes.Buffer, c chan *bytes.Buffer, p api.Provisioner, env []string) {
 	client, err := docker.NewEnvClient()
 	if err != nil {
 		panic(err)
@@ -287,13 +366,14 @@ func LaunchProvisioner(ctx context.Context, in *bytes.Buffer, c chan *bytes.Buff
 	createResult, err := client.ContainerCreate(gcontext.Background(),
 		&container.Config{
 			Image:     fmt.Sprintf(`%v:%v`, p.Repository, p.Tag),
+			Env:       env,
 			Tty:       false,
 			OpenStdin: true,
 			StdinOnce: true,
 		},
 		&container.HostConfig{},
 		&network.NetworkingConfig{},
-		fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%v/%v", p.Repository, p.Tag)))),
+		containerName(p.Repository, p.Tag),
 	)
 	if err != nil {
 		panic(err)
@@ -364,6 +444,30 @@ func LaunchProvisioner(ctx context.Context, in *bytes.Buffer, c chan *bytes.Buff
 	c <- stdout
 }
 
+// ReadContainerFile returns the contents of the regular file at fn in the
+// container cid.
+func ReadContainerFile(ctx context.Context, cid string, fn string) ([]byte, error) {
+	client, err := docker.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	rc, _, err := client.CopyFromContainer(gcontext.Background(), cid, fn)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	h, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+		return nil, fmt.Errorf(`%v is not a regular file`, fn)
+	}
+	return ioutil.ReadAll(tr)
+}
+
 func RemoveContainer(ctx context.Context, cid string) error {
 	client, err := docker.NewEnvClient()
 	if err != nil {
@@ -376,19 +480,41 @@ func RemoveContainer(ctx context.Context, cid string) error {
 	})
 }
 
-func CreateTransportVolume(ctx context.Context) error {
+// CreateTransportVolume creates the transport volume, labelled with the
+// digest of the disks it will hold if that is known. The label cannot be
+// changed afterwards, so callers remove the volume if filling it fails.
+func CreateTransportVolume(ctx context.Context, digest string) error {
 	client, err := docker.NewEnvClient()
 	if err != nil {
 		return err
 	}
 
-	_, err = client.VolumeCreate(gcontext.Background(), volume.VolumesCreateBody{
+	body := volume.VolumesCreateBody{
 		Name:   VOLNAME,
 		Driver: `local`,
-	})
+	}
+	if digest != `` {
+		body.Labels = map[string]string{labels[`digest`]: digest}
+	}
+	_, err = client.VolumeCreate(gcontext.Background(), body)
 	return err
 }
 
+// TransportVolumeDigest returns the digest of the disks unpacked in the
+// transport volume, or nothing if it was not recorded.
+func TransportVolumeDigest(ctx context.Context) (string, error) {
+	client, err := docker.NewEnvClient()
+	if err != nil {
+		return ``, err
+	}
+
+	v, err := client.VolumeInspect(gcontext.Background(), VOLNAME)
+	if err != nil {
+		return ``, err
+	}
+	return v.Labels[labels[`digest`]], nil
+}
+
 func RemoveTransportVolume(ctx context.Context) error {
 	client, err := docker.NewEnvClient()
 	if err != nil {
@@ -423,6 +549,7 @@ func detectivesFromImageSummary(i types.ImageSummary) []api.Detective {
 				Category:    i.Labels[labels[`category`]],
 				Description: i.Labels[labels[`description`]],
 				Related:     i.Labels[labels[`related`]],
+				Facts:       factsFromLabels(i.Labels),
 			})
 		}
 	} else {
@@ -432,6 +559,7 @@ func detectivesFromImageSummary(i types.ImageSummary) []api.Detective {
 			Tag:         `<none>`,
 			Category:    i.Labels[labels[`category`]],
 			Description: i.Labels[labels[`description`]],
+			Facts:       factsFromLabels(i.Labels),
 		})
 	}
 	return result
@@ -451,6 +579,9 @@ func provisionersFromImageSummary(i types.ImageSummary) []api.Provisioner {
 				Tag:         p[1],
 				Category:    i.Labels[labels[`category`]],
 				Description: i.Labels[labels[`description`]],
+				Facts:       factsFromLabels(i.Labels),
+				Service:     i.Labels[labels[`service`]],
+				Depends:     listFromLabel(i.Labels[labels[`depends`]]),
 			})
 		}
 	} else {
@@ -460,11 +591,32 @@ func provisionersFromImageSummary(i types.ImageSummary) []api.Provisioner {
 			Tag:         `<none>`,
 			Category:    i.Labels[labels[`category`]],
 			Description: i.Labels[labels[`description`]],
+			Facts:       factsFromLabels(i.Labels),
+			Service:     i.Labels[labels[`service`]],
+			Depends:     listFromLabel(i.Labels[labels[`depends`]]),
 		})
 	}
 	return result
 }
 
+func factsFromLabels(l map[string]string) []string {
+	return listFromLabel(l[labels[`facts`]])
+}
+
+func formatsFromLabels(l map[string]string) []string {
+	return listFromLabel(l[labels[`formats`]])
+}
+
+func listFromLabel(v string) []string {
+	result := []string{}
+	for _, f := range strings.Split(v, `,`) {
+		if f = strings.TrimSpace(f); f != `` {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
 func packagersFromImageSummary(i types.ImageSummary) []api.Packager {
 	result := []api.Packager{}
 	if len(i.RepoTags) > 0 {
@@ -479,6 +631,9 @@ func packagersFromImageSummary(i types.ImageSummary) []api.Packager {
 				Tag:         p[1],
 				Category:    i.Labels[labels[`category`]],
 				Description: i.Labels[labels[`description`]],
+				Formats:     formatsFromLabels(i.Labels),
+				Filesystems: listFromLabel(i.Labels[labels[`filesystems`]]),
+				Privileged:  i.Labels[labels[`privileged`]] == `1`,
 			})
 		}
 	} else {
@@ -488,6 +643,9 @@ func packagersFromImageSummary(i types.ImageSummary) []api.Packager {
 			Tag:         `<none>`,
 			Category:    i.Labels[labels[`category`]],
 			Description: i.Labels[labels[`description`]],
+			Formats:     formatsFromLabels(i.Labels),
+			Filesystems: listFromLabel(i.Labels[labels[`filesystems`]]),
+			Privileged:  i.Labels[labels[`privileged`]] == `1`,
 		})
 	}
 	return result
@@ -0,0 +1,193 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	docker "github.com/docker/docker/client"
+	gcontext "golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ImageRepoDigest returns the registry digest of the local image ref, as in
+// sha256:..., for the repository ref names.
+func ImageRepoDigest(ctx context.Context, ref string) (string, error) {
+	ok, _, rds, err := LocalImage(ctx, ref)
+	if err != nil {
+		return ``, err
+	}
+	if !ok {
+		return ``, fmt.Errorf(`%v is not present in the local engine`, ref)
+	}
+	if d := RepoDigestFor(ref, rds); d != `` {
+		return d, nil
+	}
+	return ``, fmt.Errorf(`%v has no registry digest, it was never pushed or pulled`, ref)
+}
+
+// RepoDigestFor picks the digest in rds that belongs to the repository of ref.
+func RepoDigestFor(ref string, rds []string) string {
+	name := repositoryOf(ref)
+	for _, rd := range rds {
+		p := strings.SplitN(rd, `@`, 2)
+		if len(p) == 2 && p[0] == name {
+			return p[1]
+		}
+	}
+	return ``
+}
+
+// PinnedReference returns ref as REPOSITORY@DIGEST with the digest in rds
+// that belongs to its repository, or an empty string when there is none.
+func PinnedReference(ref string, rds []string) string {
+	if d := RepoDigestFor(ref, rds); d != `` {
+		return repositoryOf(ref) + `@` + d
+	}
+	return ``
+}
+
+// repositoryOf strips the tag and digest from ref.
+func repositoryOf(ref string) string {
+	if i := strings.Index(ref, `@`); i >= 0 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndex(ref, `:`); i > strings.LastIndex(ref, `/`) {
+		ref = ref[:i]
+	}
+	return ref
+}
+
+// LocalImage reports whether ref is present in the local engine and returns
+// its image ID and registry digests.
+func LocalImage(ctx context.Context, ref string) (bool, string, []string, error) {
+	client, err := docker.NewEnvClient()
+	if err != nil {
+		return false, ``, nil, err
+	}
+
+	ii, _, err := client.ImageInspectWithRaw(gcontext.Background(), ref)
+	if err != nil {
+		if docker.IsErrImageNotFound(err) {
+			return false, ``, nil, nil
+		}
+		return false, ``, nil, err
+	}
+	return true, ii.ID, ii.RepoDigests, nil
+}
+
+// LoadImageBundle loads the images in a docker save archive into the engine.
+func LoadImageBundle(ctx context.Context, fn string) error {
+	client, err := docker.NewEnvClient()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	resp, err := client.ImageLoad(gcontext.Background(), f, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
+
+// ExportImage streams the flattened filesystem of the local image ref as a
+// tar archive. The image is not run, a container is only created to export
+// it and removed when the archive is closed. Like any container it holds the
+// empty files the engine mounts over at run time, such as /etc/hosts.
+func ExportImage(ctx context.Context, ref string) (io.ReadCloser, error) {
+	client, err := docker.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+
+	createResult, err := client.ContainerCreate(gcontext.Background(),
+		// The command is never run but an image without one needs it
+		&container.Config{Image: ref, Cmd: []string{`/bin/true`}},
+		&container.HostConfig{NetworkMode: `none`},
+		&network.NetworkingConfig{},
+		``,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := client.ContainerExport(gcontext.Background(), createResult.ID)
+	if err != nil {
+		RemoveContainer(ctx, createResult.ID)
+		return nil, err
+	}
+	return exportReader{ReadCloser: rc, ctx: ctx, id: createResult.ID}, nil
+}
+
+// exportReader removes the container it exports when it is closed.
+type exportReader struct {
+	io.ReadCloser
+	ctx context.Context
+	id  string
+}
+
+func (r exportReader) Close() error {
+	err := r.ReadCloser.Close()
+	if rerr := RemoveContainer(r.ctx, r.id); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// ContainerImage returns the image a container was created from, as named
+// at creation and by ID.
+func ContainerImage(ctx context.Context, id string) (string, string, error) {
+	client, err := docker.NewEnvClient()
+	if err != nil {
+		return ``, ``, err
+	}
+
+	cj, err := client.ContainerInspect(gcontext.Background(), id)
+	if err != nil {
+		return ``, ``, err
+	}
+	return cj.Config.Image, cj.Image, nil
+}
+
+// ExportContainer streams the flattened filesystem of a container as a tar
+// archive.
+func ExportContainer(ctx context.Context, id string) (io.ReadCloser, error) {
+	client, err := docker.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.ContainerExport(gcontext.Background(), id)
+}
+
+// ReadImageFile returns the contents of the regular file at fn in the local
+// image ref. The image is not run, a container is only created to copy from.
+func ReadImageFile(ctx context.Context, ref string, fn string) ([]byte, error) {
+	client, err := docker.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+
+	createResult, err := client.ContainerCreate(gcontext.Background(),
+		// The command is never run but an image without one needs it
+		&container.Config{Image: ref, Cmd: []string{`/bin/true`}},
+		&container.HostConfig{NetworkMode: `none`},
+		&network.NetworkingConfig{},
+		``,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer RemoveContainer(ctx, createResult.ID)
+	return ReadContainerFile(ctx, createResult.ID, fn)
+}
@@ -0,0 +1,26 @@
+package system
+
+import (
+	"testing"
+)
+
+func TestPinnedReference(t *testing.T) {
+	const d = `sha256:0000000000000000000000000000000000000000000000000000000000000001`
+	rds := []string{`registry.example.com:5000/os/ubuntu@sha256:ffff`, `ubuntu@` + d}
+	for _, c := range []struct {
+		ref   string
+		wants string
+	}{
+		{`ubuntu:16.04`, `ubuntu@` + d},
+		{`ubuntu`, `ubuntu@` + d},
+		{`ubuntu:16.04@` + d, `ubuntu@` + d},
+		{`registry.example.com:5000/os/ubuntu:16.04`, `registry.example.com:5000/os/ubuntu@sha256:ffff`},
+		{`registry.example.com:5000/os/ubuntu`, `registry.example.com:5000/os/ubuntu@sha256:ffff`},
+		{`debian:9`, ``},
+		{`example.com/ubuntu:16.04`, ``},
+	} {
+		if got := PinnedReference(c.ref, rds); got != c.wants {
+			t.Errorf("%v: got %v, want %v", c.ref, got, c.wants)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/docker/pkg/term"
+	gcontext "golang.org/x/net/context"
+	"io"
+	"os"
+)
+
+// RunShell runs cmd in a container of image attached to this terminal. The
+// container has no network and a read-only root filesystem, and sees the
+// unpacked disk in the transport volume the way detectives do. It returns
+// the exit code of cmd.
+func RunShell(ctx context.Context, image string, cmd []string) (int64, error) {
+	client, err := docker.NewEnvClient()
+	if err != nil {
+		return 0, err
+	}
+
+	tty := term.IsTerminal(os.Stdin.Fd()) && term.IsTerminal(os.Stdout.Fd())
+	hc := TransportView().hostConfig()
+	hc.ReadonlyRootfs = true
+	createResult, err := client.ContainerCreate(gcontext.Background(),
+		&container.Config{
+			Image:        image,
+			Cmd:          cmd,
+			WorkingDir:   `/v2c/disk`,
+			Tty:          tty,
+			OpenStdin:    true,
+			StdinOnce:    true,
+			AttachStdin:  true,
+			AttachStdout: true,
+			AttachStderr: true,
+		},
+		hc,
+		&network.NetworkingConfig{},
+		``,
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer RemoveContainer(ctx, createResult.ID)
+
+	attachment, err := client.ContainerAttach(gcontext.Background(), createResult.ID, types.ContainerAttachOptions{
+		Stream: true,
+		Stdin:  true,
+		Stdout: true,
+		Stderr: true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer attachment.Close()
+
+	if tty {
+		state, err := term.SetRawTerminal(os.Stdin.Fd())
+		if err != nil {
+			return 0, err
+		}
+		defer term.RestoreTerminal(os.Stdin.Fd(), state)
+	}
+
+	err = client.ContainerStart(gcontext.Background(), createResult.ID, types.ContainerStartOptions{})
+	if err != nil {
+		return 0, err
+	}
+	if tty {
+		if ws, err := term.GetWinsize(os.Stdout.Fd()); err == nil {
+			client.ContainerResize(gcontext.Background(), createResult.ID, types.ResizeOptions{
+				Height: uint(ws.Height),
+				Width:  uint(ws.Width),
+			})
+		}
+	}
+
+	go func() {
+		io.Copy(attachment.Conn, os.Stdin)
+		attachment.CloseWrite()
+	}()
+	if tty {
+		_, err = io.Copy(os.Stdout, attachment.Reader)
+	} else {
+		_, err = stdcopy.StdCopy(os.Stdout, os.Stderr, attachment.Reader)
+	}
+	if err != nil && err != io.EOF {
+		return 0, fmt.Errorf(`Lost the connection to the shell: %v`, err)
+	}
+
+	return client.ContainerWait(ctx, createResult.ID)
+}
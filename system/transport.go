@@ -0,0 +1,322 @@
+package system
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/archive"
+	gcontext "golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// transportHelperImage is an empty image imported on first use. Its
+// containers are never started. They only mount the transport volume so that
+// the engine copies files in and out of it, wherever the engine runs.
+const transportHelperImage = `v2c/transport-helper:latest`
+
+// TransportVolume is the unpacked disk in the transport volume, reached
+// through a container of the helper image. Close removes the container.
+type TransportVolume struct {
+	client *docker.Client
+	id     string
+}
+
+// OpenTransportVolume creates the container that reaches the transport
+// volume. The volume is created if it does not exist yet.
+func OpenTransportVolume(ctx context.Context) (*TransportVolume, error) {
+	client, err := docker.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	if err = importTransportHelper(client); err != nil {
+		return nil, fmt.Errorf(`Unable to import the transport helper image: %v`, err)
+	}
+
+	createResult, err := client.ContainerCreate(gcontext.Background(),
+		// The command is never run but an image without one needs it
+		&container.Config{Image: transportHelperImage, Cmd: []string{`/bin/true`}},
+		&container.HostConfig{
+			NetworkMode: `none`,
+			Binds:       []string{fmt.Sprintf(`%s:/v2c`, VOLNAME)},
+		},
+		&network.NetworkingConfig{},
+		``,
+	)
+	if err != nil {
+		return nil, err
+	}
+	v := &TransportVolume{client: client, id: createResult.ID}
+
+	// The engine does not say why a path cannot be copied. Once the volume
+	// is known to be reachable, a failure below it means the path is missing.
+	if _, err = client.ContainerStatPath(gcontext.Background(), v.id, `/v2c`); err != nil {
+		v.Close()
+		return nil, fmt.Errorf(`Unable to reach the transport volume: %v`, err)
+	}
+	return v, nil
+}
+
+// importTransportHelper imports the helper image from an empty archive
+// unless the engine has it already.
+func importTransportHelper(client *docker.Client) error {
+	_, _, err := client.ImageInspectWithRaw(gcontext.Background(), transportHelperImage)
+	if err == nil || !docker.IsErrImageNotFound(err) {
+		return err
+	}
+	empty := new(bytes.Buffer)
+	if err = tar.NewWriter(empty).Close(); err != nil {
+		return err
+	}
+	rc, err := client.ImageImport(gcontext.Background(),
+		types.ImageImportSource{Source: empty, SourceName: `-`},
+		transportHelperImage,
+		types.ImageImportOptions{},
+	)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(ioutil.Discard, rc)
+	return err
+}
+
+// Close removes the container that reaches the transport volume. The volume
+// is kept.
+func (v *TransportVolume) Close() error {
+	return v.client.ContainerRemove(gcontext.Background(), v.id, types.ContainerRemoveOptions{Force: true})
+}
+
+// Populate unpacks the tar archive in r, which may be compressed, at target
+// below the unpacked disk, keeping ownership, permissions and extended
+// attributes.
+func (v *TransportVolume) Populate(target string, r io.Reader) error {
+	dr, err := archive.DecompressStream(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	// Only /v2c is known to exist in the helper, so the entries are moved
+	// below disk and target and the engine creates what is missing
+	prefix := strings.TrimPrefix(filepath.Join(`/disk`, filepath.Clean(`/`+target)), `/`)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(rebaseTar(tar.NewReader(dr), tar.NewWriter(pw), func(n string) string {
+			return filepath.Join(prefix, n)
+		}))
+	}()
+	err = v.client.CopyToContainer(gcontext.Background(), v.id, `/v2c`, pr, types.CopyToContainerOptions{
+		AllowOverwriteDirWithFile: true,
+	})
+	// Release the writer if the engine stopped reading early
+	pr.CloseWithError(err)
+	return err
+}
+
+// Walk calls fn for name on the unpacked disk and, when it is a directory,
+// for everything below it. Entries are named by their absolute path on the
+// disk. Symbolic links are not followed. Walking stops at the first error fn
+// returns.
+func (v *TransportVolume) Walk(name string, fn func(h *tar.Header, r io.Reader) error) error {
+	name = filepath.Clean(`/` + name)
+	rc, _, err := v.client.CopyFromContainer(gcontext.Background(), v.id, filepath.Join(`/v2c/disk`, name))
+	if err != nil {
+		return &os.PathError{Op: `walk`, Path: name, Err: os.ErrNotExist}
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// The engine names the entries after the last element of the path
+		rebaseHeader(h, func(n string) string {
+			if i := strings.Index(n, `/`); i >= 0 {
+				return filepath.Join(name, n[i+1:])
+			}
+			return name
+		})
+		if err = fn(h, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadFile returns the contents of the regular file name on the unpacked
+// disk.
+func (v *TransportVolume) ReadFile(name string) ([]byte, error) {
+	var b []byte
+	err := v.Walk(name, func(h *tar.Header, r io.Reader) error {
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			return fmt.Errorf(`%v is not a regular file`, name)
+		}
+		var err error
+		b, err = ioutil.ReadAll(r)
+		return err
+	})
+	return b, err
+}
+
+// Lstat returns the mode of name on the unpacked disk.
+func (v *TransportVolume) Lstat(name string) (os.FileMode, error) {
+	st, err := v.client.ContainerStatPath(gcontext.Background(), v.id, filepath.Join(`/v2c/disk`, filepath.Clean(`/`+name)))
+	if err != nil {
+		return 0, &os.PathError{Op: `lstat`, Path: name, Err: os.ErrNotExist}
+	}
+	return st.Mode, nil
+}
+
+// Readlink returns the target of the symbolic link name on the unpacked
+// disk.
+func (v *TransportVolume) Readlink(name string) (string, error) {
+	target := ``
+	err := v.Walk(name, func(h *tar.Header, r io.Reader) error {
+		if h.Typeflag != tar.TypeSymlink {
+			return fmt.Errorf(`%v is not a symbolic link`, name)
+		}
+		target = h.Linkname
+		return nil
+	})
+	return target, err
+}
+
+// listScript prints the entries of the directory $1 of the unpacked disk,
+// only those named after it when there are more arguments. Each entry is
+// its mode in hex, owner, group, size and modification time, its name and
+// the target of a symbolic link, every field ended by a NUL byte so that
+// any name survives.
+const listScript = `cd "/v2c/disk$1" || exit 1
+shift
+[ $# -gt 0 ] || set -- .[!.]* ..?* *
+for f in "$@"; do
+	[ -e "$f" ] || [ -L "$f" ] || continue
+	printf '%s\0%s\0%s\0' "$(stat -c '%f %u %g %s %Y' -- "$f")" "$f" "$(readlink -- "$f")"
+done`
+
+// ListTransportDir lists the directory dir of the unpacked disk, or only
+// the entries of it in names when there are any, by running a container of
+// image, which needs a shell, stat and readlink. Unlike Walk it never
+// copies more than the listing out of the volume. The entries are named by
+// their absolute path on the disk.
+func ListTransportDir(ctx context.Context, image string, dir string, names []string) ([]*tar.Header, error) {
+	client, err := docker.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Clean(`/` + dir)
+	hc := TransportView().hostConfig()
+	hc.ReadonlyRootfs = true
+	createResult, err := client.ContainerCreate(gcontext.Background(),
+		&container.Config{
+			Image: image,
+			Cmd:   append([]string{`/bin/sh`, `-c`, listScript, `ls`, dir}, names...),
+		},
+		hc,
+		&network.NetworkingConfig{},
+		``,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer RemoveContainer(ctx, createResult.ID)
+	code, out, err := runForOutput(ctx, client, createResult.ID)
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return nil, fmt.Errorf(`Unable to list %v on the unpacked disk, the %v container exited with %v`, dir, image, code)
+	}
+	return parseListing(dir, out.Bytes())
+}
+
+// parseListing reads the output of listScript for the directory dir.
+func parseListing(dir string, b []byte) ([]*tar.Header, error) {
+	fields := strings.Split(string(b), "\x00")
+	if len(fields)%3 != 1 || fields[len(fields)-1] != `` {
+		return nil, fmt.Errorf(`Unable to list %v on the unpacked disk, the listing is truncated`, dir)
+	}
+	result := []*tar.Header{}
+	for i := 0; i+3 <= len(fields); i += 3 {
+		var mode uint32
+		var mtime int64
+		h := &tar.Header{Name: filepath.Join(dir, fields[i+1]), Linkname: fields[i+2]}
+		if _, err := fmt.Sscanf(fields[i], `%x %d %d %d %d`, &mode, &h.Uid, &h.Gid, &h.Size, &mtime); err != nil {
+			return nil, fmt.Errorf(`Unable to list %v on the unpacked disk: %v has the status %q`, dir, fields[i+1], fields[i])
+		}
+		h.Mode, h.ModTime = int64(mode), time.Unix(mtime, 0)
+		switch mode & 0170000 {
+		case 0040000:
+			h.Typeflag = tar.TypeDir
+		case 0120000:
+			h.Typeflag = tar.TypeSymlink
+		default:
+			h.Typeflag = tar.TypeReg
+			h.Linkname = ``
+		}
+		result = append(result, h)
+	}
+	return result, nil
+}
+
+// rebaseTar copies the archive in tr to tw, renaming its entries with
+// rebaseHeader.
+func rebaseTar(tr *tar.Reader, tw *tar.Writer, rename func(string) string) error {
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+		rebaseHeader(h, rename)
+		if err = tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err = io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// rebaseHeader renames the entry h and the target of a hard link with
+// rename, which is handed the cleaned name relative to the root of the
+// archive. Directories keep their trailing slash.
+func rebaseHeader(h *tar.Header, rename func(string) string) {
+	rebase := func(n string) string {
+		return rename(strings.TrimPrefix(filepath.Clean(`/`+n), `/`))
+	}
+	h.Name = rebase(h.Name)
+	if h.Typeflag == tar.TypeDir && !strings.HasSuffix(h.Name, `/`) {
+		h.Name += `/`
+	}
+	if h.Typeflag == tar.TypeLink {
+		h.Linkname = rebase(h.Linkname)
+	}
+}
+
+// PopulateTransportVolume unpacks the tar archive in r, which may be
+// compressed, at target below the unpacked disk in the transport volume.
+func PopulateTransportVolume(ctx context.Context, target string, r io.Reader) error {
+	v, err := OpenTransportVolume(ctx)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+	return v.Populate(target, r)
+}
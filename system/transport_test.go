@@ -0,0 +1,49 @@
+package system
+
+import (
+	"archive/tar"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseListing(t *testing.T) {
+	out := "41ed 0 0 4096 1500000000\x00etc\x00\x00" +
+		"a1ff 0 0 7 1500000001\x00lib\x00usr/lib\x00" +
+		"81a4 1000 1000 30 1500000002\x00name with\nnewline\x00\x00" +
+		"21b0 0 6 0 1500000003\x00tty\x00\x00"
+	hs, err := parseListing(`/`, []byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range []struct {
+		name     string
+		typeflag byte
+		mode     os.FileMode
+		uid      int
+		size     int64
+		linkname string
+	}{
+		{`/etc`, tar.TypeDir, os.ModeDir | 0755, 0, 4096, ``},
+		{`/lib`, tar.TypeSymlink, os.ModeSymlink | 0777, 0, 7, `usr/lib`},
+		{"/name with\nnewline", tar.TypeReg, 0644, 1000, 30, ``},
+		{`/tty`, tar.TypeReg, os.ModeDevice | os.ModeCharDevice | 0660, 0, 0, ``},
+	} {
+		if i >= len(hs) {
+			t.Fatalf("got %v entries, want 4", len(hs))
+		}
+		h := hs[i]
+		if h.Name != c.name || h.Typeflag != c.typeflag || h.FileInfo().Mode() != c.mode || h.Uid != c.uid || h.Size != c.size || h.Linkname != c.linkname {
+			t.Errorf("entry %v is %q %c %v %v %v %q", i, h.Name, h.Typeflag, h.FileInfo().Mode(), h.Uid, h.Size, h.Linkname)
+		}
+		if !h.ModTime.Equal(time.Unix(1500000000+int64(i), 0)) {
+			t.Errorf("%v was modified at %v", c.name, h.ModTime)
+		}
+	}
+
+	for _, bad := range []string{"41ed 0 0 4096 1500000000\x00etc\x00", "drwxr-xr-x\x00etc\x00\x00"} {
+		if _, err := parseListing(`/`, []byte(bad)); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
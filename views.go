@@ -2,7 +2,9 @@ package main
 
 import (
 	"github.com/docker/docker/api/types"
+	"github.com/docker/go-units"
 	"io"
+	"strings"
 	"text/tabwriter"
 	"text/template"
 )
@@ -42,6 +44,31 @@ var funcMap = template.FuncMap{
 	"head8":    func(c string) string { return c[:8] },
 	"head12":   func(c string) string { return c[:12] },
 	"stripSha": func(c string) string { return c[7:] },
+	"bytes":    func(n int64) string { return units.HumanSize(float64(n)) },
+	"kind": func(b bool) string {
+		if b {
+			return `built-in`
+		}
+		return `image`
+	},
+	"list": func(s []string) string {
+		if len(s) == 0 {
+			return `-`
+		}
+		return strings.Join(s, `,`)
+	},
+	"listOrAny": func(s []string) string {
+		if len(s) == 0 {
+			return `any`
+		}
+		return strings.Join(s, `,`)
+	},
+	"yesNo": func(b bool) string {
+		if b {
+			return `yes`
+		}
+		return `no`
+	},
 	"orNone": func(c string) string {
 		if len(c) == 0 {
 			return `-`
@@ -54,11 +81,40 @@ var views = map[string]string{
 	`imageList`: `ID	REPOSITORY	TAG	ORIGINAL	CREATED{{ range .Products }}
 {{.ImageID | stripSha | head12}}	{{.Repository}}	{{.Tag}}	{{.Original}}	{{.Created}}{{ end }}
 `,
-	`detectiveList`: `REPOSITORY	TAG	CATEGORY	DESCRIPTION{{ range .Detectives }}
-{{.Repository}}	{{.Tag}}	{{.Category}}	{{.Description}}{{ end }}
+	`detectiveList`: `REPOSITORY	TAG	TYPE	CATEGORY	DESCRIPTION{{ range .Detectives }}
+{{.Repository}}	{{.Tag}}	{{.InProcess | kind}}	{{.Category}}	{{.Description}}{{ end }}
 `,
-	`provisionerList`: `REPOSITORY	TAG	CATEGORY	DESCRIPTION{{ range .Provisioners }}
-{{.Repository}}	{{.Tag}}	{{.Category}}	{{.Description}}{{ end }}
+	`provisionerList`: `REPOSITORY	TAG	TYPE	CATEGORY	DESCRIPTION{{ range .Provisioners }}
+{{.Repository}}	{{.Tag}}	{{.InProcess | kind}}	{{.Category}}	{{.Description}}{{ end }}
+`,
+	`packagerList`: `REPOSITORY	TAG	TYPE	FORMATS	FILESYSTEMS	PRIVILEGED	DESCRIPTION{{ range .Packagers }}
+{{.Repository}}	{{.Tag}}	{{.InProcess | kind}}	{{.Formats | list}}	{{.Filesystems | listOrAny}}	{{.Privileged | yesNo}}	{{.Description}}{{ end }}
+`,
+	`packagerInspect`: `Packager:    {{.Repository}}:{{.Tag}}
+Type:        {{.InProcess | kind}}
+Image ID:    {{.ImageID | orNone}}
+Category:    {{.Category | orNone}}
+Description: {{.Description | orNone}}
+Formats:     {{.Formats | list}}
+Filesystems: {{.Filesystems | listOrAny}}
+Privileged:  {{.Privileged | yesNo}}
+`,
+	`partitionList`: `NUMBER	DEVICE	START	SIZE	TYPE	FILESYSTEM	LABEL	UUID	ROOT{{ range .Partitions }}
+{{.Number}}	{{.Device 0}}	{{.Start}}	{{.Size | bytes}}	{{.Type | orNone}}	{{.Filesystem | orNone}}	{{.Label | orNone}}	{{.UUID | orNone}}	{{if eq .Number $.Root}}*{{end}}{{ end }}
+`,
+	`diskList`: `MODE	UID	GID	SIZE	MODIFIED	PATH{{ range . }}
+{{.Mode}}	{{.Uid}}	{{.Gid}}	{{.Size}}	{{.ModTime.Format "2006-01-02 15:04"}}	{{.Path}}{{if .Target}} -> {{.Target}}{{end}}{{ end }}
+`,
+	`assessment`: `DETECTIVE	CATEGORY	MACHINES{{ range .Components }}
+{{.Detective}}	{{.Category}}	{{.Machines}}{{ end }}
+
+MACHINE	DISTRIBUTION	COVERAGE	CATEGORIES	DETECTED{{ range .Machines }}
+{{.Name}}	{{.OS | orNone}}	{{.Coverage}}	{{.Categories | list}}	{{if .Error}}error: {{.Error}}{{else}}{{.Detected | list}}{{end}}{{ end }}
+`,
+	`batchSummary`: `NAME	STATUS	DURATION	OUTPUT	LOG	REASONS{{ range .Results }}
+{{.Name}}	{{.Status}}	{{.Duration}}	{{.Output}}	{{.Log | orNone}}	{{.Reasons | list}}{{ end }}
+
+{{.Succeeded}} succeeded, {{.Failed}} failed, {{.Review}} need review
 `,
 	`removedImage`: `UNTAGGED	DELETED{{ range .Gone }}
 {{.Untagged | orNone}}	{{.Deleted | orNone }}{{ end }}
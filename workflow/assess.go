@@ -0,0 +1,251 @@
+package workflow
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	path "path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Assessment is the inventory of components detected across machines.
+type Assessment struct {
+	// Components are the detectives that ran, in category order.
+	Components []AssessedComponent
+
+	// Machines are ranked by the number of categories covered.
+	Machines []AssessedMachine
+}
+
+// AssessedComponent is a detective and the number of machines it found its
+// component on.
+type AssessedComponent struct {
+	Detective string
+	Category  string
+	Machines  int
+}
+
+// AssessedMachine is what the detectives found on one machine.
+type AssessedMachine struct {
+	Name       string
+	Inputs     []string
+	OS         string   `json:",omitempty"`
+	Detected   []string `json:",omitempty"`
+	Categories []string `json:",omitempty"`
+	Error      string   `json:",omitempty"`
+}
+
+// Coverage is the number of categories at least one detective found
+// something for.
+func (m AssessedMachine) Coverage() int {
+	return len(m.Categories)
+}
+
+// Has reports whether the detective d found its component on m.
+func (m AssessedMachine) Has(d string) bool {
+	for _, x := range m.Detected {
+		if x == d {
+			return true
+		}
+	}
+	return false
+}
+
+type byCoverage []AssessedMachine
+
+func (s byCoverage) Len() int      { return len(s) }
+func (s byCoverage) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byCoverage) Less(i, j int) bool {
+	if s[i].Coverage() != s[j].Coverage() {
+		return s[i].Coverage() > s[j].Coverage()
+	}
+	return s[i].Name < s[j].Name
+}
+
+type byCategory []AssessedComponent
+
+func (s byCategory) Len() int      { return len(s) }
+func (s byCategory) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byCategory) Less(i, j int) bool {
+	if ci, cj := categoryRank(s[i].Category), categoryRank(s[j].Category); ci != cj {
+		return ci < cj
+	}
+	return s[i].Detective < s[j].Detective
+}
+
+func categoryRank(c string) int {
+	for i, x := range categoryOrder {
+		if x == c {
+			return i
+		}
+	}
+	return len(categoryOrder)
+}
+
+// Assess unpacks each machine, a list of the disks it is made of, and runs
+// the detectives against it without provisioning anything. A machine that
+// cannot be unpacked is recorded with its error.
+func Assess(ctx context.Context, machines [][]string, o Options) (Assessment, error) {
+	a := Assessment{Components: []AssessedComponent{}, Machines: []AssessedMachine{}}
+	components, err := detectComponents()
+	if err != nil {
+		return a, err
+	}
+	components.Detectives = filterDetectives(components.Detectives, o)
+	for _, d := range components.Detectives {
+		a.Components = append(a.Components, AssessedComponent{
+			Detective: fmt.Sprintf(`%v:%v`, d.Repository, d.Tag),
+			Category:  d.Category,
+		})
+	}
+	sort.Sort(byCategory(a.Components))
+
+	// Every machine needs an empty transport volume
+	o.NoCleanup = false
+	for _, targets := range machines {
+		m := AssessedMachine{
+			Name:       path.Base(targets[0]),
+			Inputs:     targets,
+			Detected:   []string{},
+			Categories: []string{},
+		}
+		fmt.Printf("Assessing %v\n", m.Name)
+		detected, _, err := detect(ctx, components, targets, o)
+		if err != nil {
+			fmt.Printf("Unable to assess %v: %v\n", m.Name, err)
+			m.Error = err.Error()
+			a.Machines = append(a.Machines, m)
+			continue
+		}
+
+		covered := map[string]bool{}
+		for _, r := range detected {
+			m.Detected = append(m.Detected, r.Detective)
+			covered[r.Category] = true
+		}
+		sort.Strings(m.Detected)
+		for _, c := range categoryOrder {
+			if covered[c] {
+				m.Categories = append(m.Categories, c)
+			}
+		}
+		if f := osFactsFromDetections(detected); f != nil {
+			m.OS = strings.TrimSpace(f.ID + ` ` + f.VersionID)
+		}
+		a.Machines = append(a.Machines, m)
+
+		for i := range a.Components {
+			if m.Has(a.Components[i].Detective) {
+				a.Components[i].Machines++
+			}
+		}
+	}
+	sort.Stable(byCoverage(a.Machines))
+	return a, nil
+}
+
+// WriteJSON writes the assessment as JSON.
+func (a Assessment) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(a, ``, `  `)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// WriteCSV writes one row per machine with a column per category and per
+// detective.
+func (a Assessment) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	header := []string{`machine`, `distribution`, `coverage`}
+	header = append(header, categoryOrder...)
+	for _, c := range a.Components {
+		header = append(header, c.Detective)
+	}
+	header = append(header, `error`)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, m := range a.Machines {
+		row := []string{m.Name, m.OS, strconv.Itoa(m.Coverage())}
+		for _, c := range categoryOrder {
+			row = append(row, mark(contains(m.Categories, c)))
+		}
+		for _, c := range a.Components {
+			row = append(row, mark(m.Has(c.Detective)))
+		}
+		row = append(row, m.Error)
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteHTML writes the assessment as a standalone HTML page.
+func (a Assessment) WriteHTML(w io.Writer) error {
+	t := template.Must(template.New(`assessment`).Funcs(template.FuncMap{
+		"contains":   contains,
+		"categories": func() []string { return categoryOrder },
+	}).Parse(assessmentHTML))
+	return t.Execute(w, a)
+}
+
+func mark(b bool) string {
+	if b {
+		return `x`
+	}
+	return ``
+}
+
+func contains(s []string, x string) bool {
+	for _, y := range s {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
+
+const assessmentHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>v2c assessment</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.5em; }
+td.x { background: #cfc; text-align: center; }
+td.error { color: #a00; }
+</style>
+</head>
+<body>
+<h1>Components</h1>
+<table>
+<tr><th>Detective</th><th>Category</th><th>Machines</th></tr>
+{{- range .Components }}
+<tr><td>{{.Detective}}</td><td>{{.Category}}</td><td>{{.Machines}}</td></tr>
+{{- end }}
+</table>
+<h1>Machines</h1>
+<table>
+<tr><th>Machine</th><th>Distribution</th><th>Coverage</th>
+{{- range categories }}<th>{{.}}</th>{{ end }}
+{{- range $.Components }}<th>{{.Detective}}</th>{{ end }}<th>Error</th></tr>
+{{- range $m := .Machines }}
+<tr><td>{{$m.Name}}</td><td>{{$m.OS}}</td><td>{{$m.Coverage}}</td>
+{{- range categories }}{{ if contains $m.Categories . }}<td class="x">x</td>{{ else }}<td></td>{{ end }}{{ end }}
+{{- range $.Components }}{{ if $m.Has .Detective }}<td class="x">x</td>{{ else }}<td></td>{{ end }}{{ end }}<td class="error">{{$m.Error}}</td></tr>
+{{- end }}
+</table>
+</body>
+</html>
+`
@@ -0,0 +1,50 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	path "path/filepath"
+	"testing"
+)
+
+func TestAssessAfterFailedUnpack(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `v2c-assess`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	machines := [][]string{}
+	for _, n := range []string{`web.vmdk`, `broken.vmdk`, `db.vmdk`} {
+		fn := path.Join(dir, n)
+		if err = ioutil.WriteFile(fn, []byte(n), 0644); err != nil {
+			t.Fatal(err)
+		}
+		machines = append(machines, []string{fn})
+	}
+
+	v := &fakeVolume{}
+	defer v.install(func(targets []string) error {
+		if path.Base(targets[0]) == `broken.vmdk` {
+			return errors.New(`unable to unpack`)
+		}
+		return nil
+	})()
+	a, err := Assess(context.Background(), machines, Options{NoCleanup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := map[string]string{}
+	for _, m := range a.Machines {
+		errs[m.Name] = m.Error
+	}
+	for n, wants := range map[string]string{`web.vmdk`: ``, `broken.vmdk`: `unable to unpack`, `db.vmdk`: ``} {
+		if got, ok := errs[n]; !ok || got != wants {
+			t.Errorf("%v: got error %q, want %q", n, got, wants)
+		}
+	}
+	if v.exists {
+		t.Errorf("the transport volume of %v was left behind", v.digest)
+	}
+}
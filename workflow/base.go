@@ -0,0 +1,50 @@
+package workflow
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/v2c/system"
+	"strings"
+)
+
+// checkBaseImage makes sure ref can be built from without reaching a
+// registry. Images missing from the engine are loaded from the base image
+// bundle when one is provided. It returns the reference pinned to a digest,
+// or an image ID when the image never came from a registry, or an empty
+// string when the image is not available and the run is not offline.
+func checkBaseImage(ctx context.Context, ref string, o Options) (string, error) {
+	if ref == `scratch` {
+		return ``, nil
+	}
+	ok, id, rds, err := system.LocalImage(ctx, ref)
+	if err != nil {
+		return ``, err
+	}
+	if !ok && o.BaseBundle != `` {
+		fmt.Printf("Loading base image %v from %v\n", ref, o.BaseBundle)
+		if err = system.LoadImageBundle(ctx, o.BaseBundle); err != nil {
+			return ``, fmt.Errorf(`Unable to load the base image bundle %v: %v`, o.BaseBundle, err)
+		}
+		if ok, id, rds, err = system.LocalImage(ctx, ref); err != nil {
+			return ``, err
+		}
+		if !ok {
+			return ``, fmt.Errorf(`The base image bundle %v does not contain %v`, o.BaseBundle, ref)
+		}
+	}
+	if !ok {
+		if o.Offline {
+			return ``, fmt.Errorf(`The base image %v is not available in the local engine. Provide it with --base-bundle.`, ref)
+		}
+		fmt.Printf("The base image %v is not available locally and will be pulled at build time.\n", ref)
+		return ``, nil
+	}
+
+	if strings.Contains(ref, `@`) {
+		return ref, nil
+	}
+	if pinned := system.PinnedReference(ref, rds); pinned != `` {
+		return pinned, nil
+	}
+	return id, nil
+}
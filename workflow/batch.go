@@ -0,0 +1,289 @@
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	path "path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Batch statuses.
+const (
+	BatchSucceeded = `succeeded`
+	BatchFailed    = `failed`
+	BatchReview    = `review`
+)
+
+// BatchManifest lists the machines converted by a batch.
+type BatchManifest struct {
+	// Parallel is the number of builds that run at once.
+	Parallel int `yaml:"parallel"`
+
+	// Runs is the directory that holds the log and volume of each build.
+	Runs string `yaml:"runs"`
+
+	// Args are passed to every build, for example a --policy.
+	Args []string `yaml:"args"`
+
+	Entries []BatchEntry `yaml:"entries"`
+}
+
+// BatchEntry is one machine of a batch.
+type BatchEntry struct {
+	// Name identifies the entry, its run directory and its volume.
+	Name string `yaml:"name"`
+
+	// Inputs are the disks or filesystem tree of the machine.
+	Inputs []string `yaml:"inputs"`
+
+	// Tag is the image the build context is meant for.
+	Tag string `yaml:"tag"`
+
+	// Output is the directory the build context is written to.
+	Output string `yaml:"output"`
+
+	// Detectives and SkipDetectives filter the detectives that run.
+	Detectives     []string `yaml:"detectives"`
+	SkipDetectives []string `yaml:"skip_detectives"`
+
+	// Args are passed to this build after those of the manifest.
+	Args []string `yaml:"args"`
+}
+
+// BatchResult is the outcome of one entry.
+type BatchResult struct {
+	Name     string
+	Inputs   []string
+	Tag      string `json:",omitempty"`
+	Output   string
+	Log      string
+	Volume   string
+	Status   string
+	Reasons  []string `json:",omitempty"`
+	Started  time.Time
+	Duration string
+}
+
+// BatchReport is the outcome of a batch.
+type BatchReport struct {
+	Succeeded int
+	Failed    int
+	Review    int
+	Results   []BatchResult
+}
+
+var batchNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// LoadBatchManifest reads a batch manifest. Relative paths are taken from
+// the directory of the manifest.
+func LoadBatchManifest(fn string) (*BatchManifest, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	m := &BatchManifest{}
+	if err = yaml.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf(`Unable to parse the batch manifest %v: %v`, fn, err)
+	}
+	dir, err := path.Abs(path.Dir(fn))
+	if err != nil {
+		return nil, err
+	}
+	abs := func(p string) string {
+		if p == `` || path.IsAbs(p) {
+			return p
+		}
+		return path.Join(dir, p)
+	}
+
+	if m.Parallel < 1 {
+		m.Parallel = 1
+	}
+	if m.Runs == `` {
+		m.Runs = `v2c-runs`
+	}
+	m.Runs = abs(m.Runs)
+	names := map[string]bool{}
+	outputs := map[string]bool{}
+	for i := range m.Entries {
+		e := &m.Entries[i]
+		if !batchNamePattern.MatchString(e.Name) {
+			return nil, fmt.Errorf(`Entry %v of %v needs a name made of letters, digits, dots, dashes and underscores`, i+1, fn)
+		}
+		if names[e.Name] {
+			return nil, fmt.Errorf(`The name %v is used by more than one entry of %v`, e.Name, fn)
+		}
+		names[e.Name] = true
+		if len(e.Inputs) == 0 {
+			return nil, fmt.Errorf(`Entry %v of %v has no inputs`, e.Name, fn)
+		}
+		for j := range e.Inputs {
+			if !IsSSHTarget(e.Inputs[j]) {
+				e.Inputs[j] = abs(e.Inputs[j])
+			}
+		}
+		if e.Output == `` {
+			e.Output = e.Name
+		}
+		e.Output = abs(e.Output)
+		if outputs[e.Output] {
+			return nil, fmt.Errorf(`The output %v is used by more than one entry of %v`, e.Output, fn)
+		}
+		outputs[e.Output] = true
+	}
+	return m, nil
+}
+
+// RunBatch builds every entry of m with at most m.Parallel builds at once.
+// Each build is a separate run of this program in the output directory of
+// its entry with a transport volume of its own.
+func RunBatch(ctx context.Context, m *BatchManifest) (BatchReport, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return BatchReport{}, err
+	}
+	if err = os.MkdirAll(m.Runs, 0755); err != nil {
+		return BatchReport{}, err
+	}
+
+	results := make([]BatchResult, len(m.Entries))
+	slots := make(chan bool, m.Parallel)
+	wg := sync.WaitGroup{}
+	for i, e := range m.Entries {
+		wg.Add(1)
+		go func(i int, e BatchEntry) {
+			defer wg.Done()
+			select {
+			case slots <- true:
+			case <-ctx.Done():
+				results[i] = BatchResult{Name: e.Name, Inputs: e.Inputs, Tag: e.Tag, Output: e.Output, Status: BatchFailed, Reasons: []string{`cancelled`}}
+				return
+			}
+			results[i] = runBatchEntry(ctx, exe, m, e)
+			<-slots
+		}(i, e)
+	}
+	wg.Wait()
+
+	report := BatchReport{Results: results}
+	for _, r := range results {
+		switch r.Status {
+		case BatchSucceeded:
+			report.Succeeded++
+		case BatchReview:
+			report.Review++
+		default:
+			report.Failed++
+		}
+	}
+	return report, nil
+}
+
+func runBatchEntry(ctx context.Context, exe string, m *BatchManifest, e BatchEntry) (r BatchResult) {
+	dir := path.Join(m.Runs, e.Name)
+	r = BatchResult{
+		Name:    e.Name,
+		Inputs:  e.Inputs,
+		Tag:     e.Tag,
+		Output:  e.Output,
+		Log:     path.Join(dir, `build.log`),
+		Volume:  `v2c-transport-` + e.Name,
+		Status:  BatchFailed,
+		Started: time.Now().UTC(),
+	}
+	defer func() {
+		r.Duration = time.Since(r.Started).String()
+		fmt.Printf("%v: %v\n", e.Name, r.Status)
+	}()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		r.Reasons = []string{err.Error()}
+		return r
+	}
+	if err := os.MkdirAll(e.Output, 0755); err != nil {
+		r.Reasons = []string{err.Error()}
+		return r
+	}
+	log, err := os.Create(r.Log)
+	if err != nil {
+		r.Reasons = []string{err.Error()}
+		return r
+	}
+	defer log.Close()
+
+	args := []string{`build`}
+	if e.Tag != `` {
+		args = append(args, `--tag`, e.Tag)
+	}
+	for _, d := range e.Detectives {
+		args = append(args, `--detective`, d)
+	}
+	for _, d := range e.SkipDetectives {
+		args = append(args, `--skip-detective`, d)
+	}
+	args = append(args, m.Args...)
+	args = append(args, e.Args...)
+	args = append(args, e.Inputs...)
+
+	fmt.Printf("%v: building in %v\n", e.Name, e.Output)
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Dir = e.Output
+	cmd.Env = append(os.Environ(), `V2C_TRANSPORT_VOLUME=`+r.Volume)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	if err = cmd.Run(); err != nil {
+		r.Reasons = []string{fmt.Sprintf(`the build failed with %v`, err)}
+		return r
+	}
+
+	r.Reasons = reviewReasons(e.Output)
+	if len(r.Reasons) > 0 {
+		r.Status = BatchReview
+	} else {
+		r.Status = BatchSucceeded
+	}
+	return r
+}
+
+// reviewReasons explains why the build context in dir needs a person to look
+// at it before it is built.
+func reviewReasons(dir string) []string {
+	reasons := []string{}
+	md := runMetadata{}
+	if b, err := ioutil.ReadFile(path.Join(dir, runMetadataName)); err == nil {
+		json.Unmarshal(b, &md)
+	}
+	if md.Facts == nil {
+		reasons = append(reasons, `the operating system was not identified`)
+	}
+	for _, c := range []string{`application`, `init`} {
+		fns, _ := path.Glob(path.Join(dir, c, `*.manifest`))
+		if len(fns) == 0 {
+			reasons = append(reasons, fmt.Sprintf(`nothing was provisioned in the %v category`, c))
+		}
+	}
+	if b, err := ioutil.ReadFile(path.Join(dir, `Dockerfile`)); err == nil && regexpFromScratch.Match(b) {
+		reasons = append(reasons, `the Dockerfile starts from scratch`)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+var regexpFromScratch = regexp.MustCompile(`(?m)^FROM scratch\s*$`)
+
+// WriteBatchReport writes the report as JSON to fn.
+func WriteBatchReport(report BatchReport, fn string) error {
+	b, err := json.MarshalIndent(report, ``, `  `)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn, b, 0644)
+}
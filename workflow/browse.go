@@ -0,0 +1,236 @@
+package workflow
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/v2c/api"
+	"github.com/docker/v2c/system"
+	"io"
+	"os"
+	path "path/filepath"
+	"time"
+)
+
+// DiskEntry is a file on the unpacked disk.
+type DiskEntry struct {
+	Path    string
+	Mode    os.FileMode
+	Uid     int
+	Gid     int
+	Size    int64
+	ModTime time.Time
+	Target  string
+}
+
+// checkUnpacked fails unless the transport volume holds an unpacked disk.
+func checkUnpacked(ctx context.Context) error {
+	exists, err := system.TransportVolumeExists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New(`There is no unpacked disk. Build with --no-cleanup or use cache load first.`)
+	}
+	return nil
+}
+
+// openUnpacked opens the unpacked disk in the transport volume.
+func openUnpacked(ctx context.Context) (*system.TransportVolume, error) {
+	if err := checkUnpacked(ctx); err != nil {
+		return nil, err
+	}
+	return system.OpenTransportVolume(ctx)
+}
+
+// resolveOnDisk follows the symbolic links in name as if d were the
+// filesystem root, the last element only when follow is set.
+func resolveOnDisk(d api.Disk, name string, follow bool) (string, error) {
+	name = path.Clean(`/` + name)
+	if follow || name == `/` {
+		return api.ResolvePath(d, name)
+	}
+	dir, err := api.ResolvePath(d, path.Dir(name))
+	if err != nil {
+		return ``, err
+	}
+	return path.Join(dir, path.Base(name)), nil
+}
+
+// listImage lists directories of the unpacked disk when it is available
+// locally.
+const listImage = `busybox:latest`
+
+// diskEntry describes the file of the archive entry h.
+func diskEntry(h *tar.Header) DiskEntry {
+	e := DiskEntry{
+		Path:    path.Clean(h.Name),
+		Mode:    h.FileInfo().Mode(),
+		Uid:     h.Uid,
+		Gid:     h.Gid,
+		Size:    h.Size,
+		ModTime: h.ModTime,
+	}
+	if h.Typeflag == tar.TypeSymlink {
+		e.Target = h.Linkname
+		e.Size = int64(len(h.Linkname))
+	}
+	return e
+}
+
+// walkDisk calls fn with the entry of name on the unpacked disk and, when it
+// is a directory, with those of everything below it.
+func walkDisk(v *system.TransportVolume, name string, fn func(DiskEntry) error) error {
+	// A hard link has no size of its own in the archive
+	sizes := map[string]int64{}
+	return v.Walk(name, func(h *tar.Header, r io.Reader) error {
+		e := diskEntry(h)
+		switch h.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			sizes[e.Path] = h.Size
+		case tar.TypeLink:
+			e.Size = sizes[path.Clean(h.Linkname)]
+		}
+		return fn(e)
+	})
+}
+
+// ListDisk lists the directory name on the unpacked disk, or name itself
+// when it is not a directory. A container of listImage lists only the
+// entries asked for. Without that image the engine sends everything below
+// the directory, so listing a large one takes a while.
+func ListDisk(ctx context.Context, name string) ([]DiskEntry, error) {
+	v, err := openUnpacked(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer v.Close()
+	fn, err := resolveOnDisk(v, name, false)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := v.Lstat(fn)
+	if err != nil {
+		return nil, fmt.Errorf(`%v does not exist on the unpacked disk`, name)
+	}
+	if mode&os.ModeSymlink != 0 {
+		// List the directory a link points to, like ls does
+		if target, err := resolveOnDisk(v, name, true); err == nil {
+			if tm, err := v.Lstat(target); err == nil && tm.IsDir() {
+				fn, mode = target, tm
+			}
+		}
+	}
+
+	result := []DiskEntry{}
+	if found, _, _, err := system.LocalImage(ctx, listImage); err == nil && found {
+		dir, names := fn, []string{}
+		if !mode.IsDir() {
+			dir, names = path.Dir(fn), []string{path.Base(fn)}
+		}
+		hs, err := system.ListTransportDir(ctx, listImage, dir, names)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hs {
+			result = append(result, diskEntry(h))
+		}
+		return result, nil
+	}
+	if mode.IsDir() {
+		fmt.Fprintf(os.Stderr, "%v is not available locally, so everything below %v is copied out of the transport volume to list it. Pull %v to list directories quickly.\n", listImage, name, listImage)
+	}
+	err = walkDisk(v, fn, func(e DiskEntry) error {
+		if !mode.IsDir() || (e.Path != fn && path.Dir(e.Path) == fn) {
+			result = append(result, e)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// CatDisk copies the file name on the unpacked disk to w.
+func CatDisk(ctx context.Context, name string, w io.Writer) error {
+	v, err := openUnpacked(ctx)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+	fn, err := resolveOnDisk(v, name, true)
+	if err != nil {
+		return err
+	}
+	err = v.Walk(fn, func(h *tar.Header, r io.Reader) error {
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			return fmt.Errorf(`%v is not a regular file`, name)
+		}
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return fmt.Errorf(`%v does not exist on the unpacked disk`, name)
+	}
+	return err
+}
+
+// FindDisk lists the files below dir on the unpacked disk whose name matches
+// pattern, any name when it is empty, and whose type is kind: f, d or l, any
+// type when it is empty.
+func FindDisk(ctx context.Context, dir string, pattern string, kind string) ([]DiskEntry, error) {
+	if pattern != `` {
+		if _, err := path.Match(pattern, ``); err != nil {
+			return nil, fmt.Errorf(`%v is not a valid pattern: %v`, pattern, err)
+		}
+	}
+	v, err := openUnpacked(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer v.Close()
+	start, err := resolveOnDisk(v, dir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []DiskEntry{}
+	err = walkDisk(v, start, func(e DiskEntry) error {
+		if pattern != `` {
+			if ok, _ := path.Match(pattern, path.Base(e.Path)); !ok {
+				return nil
+			}
+		}
+		switch {
+		case kind == `f` && !e.Mode.IsRegular(),
+			kind == `d` && !e.Mode.IsDir(),
+			kind == `l` && e.Mode&os.ModeSymlink == 0:
+			return nil
+		}
+		result = append(result, e)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf(`%v does not exist on the unpacked disk`, dir)
+	}
+	return result, err
+}
+
+// ShellDisk runs cmd, or a shell, interactively in a container of image that
+// sees the unpacked disk at /v2c/disk the way detectives do. It returns the
+// exit code of cmd.
+func ShellDisk(ctx context.Context, image string, cmd []string) (int64, error) {
+	if err := checkUnpacked(ctx); err != nil {
+		return 0, err
+	}
+	found, _, _, err := system.LocalImage(ctx, image)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf(`Image %v is not available locally. Pull it first.`, image)
+	}
+	if len(cmd) == 0 {
+		cmd = []string{`/bin/sh`}
+	}
+	return system.RunShell(ctx, image, cmd)
+}
@@ -0,0 +1,93 @@
+package workflow
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/v2c/api"
+	"github.com/docker/v2c/system"
+	"io"
+)
+
+// Built-in components honor the same contract as the container launchers in
+// the system package: a nil buffer on the channel means no result.
+
+func runBuiltinDetective(ctx context.Context, c chan *bytes.Buffer, d api.Detective, disk api.Disk) {
+	var stdout *bytes.Buffer
+	defer func() {
+		select {
+		case c <- stdout:
+		case <-ctx.Done():
+		}
+	}()
+
+	fmt.Printf("Running built-in %v:%v\n", d.Repository, d.Tag)
+	bd, ok := api.LookupDetective(d.Tag)
+	if !ok {
+		fmt.Printf("No built-in detective named %v\n", d.Tag)
+		return
+	}
+	if disk == nil {
+		fmt.Printf("No results for %v:%v: the unpacked disk is not reachable\n", d.Repository, d.Tag)
+		return
+	}
+
+	b := new(bytes.Buffer)
+	found, err := bd.Detect(ctx, disk, b)
+	if err != nil {
+		fmt.Printf("No results for %v:%v error: %v\n", d.Repository, d.Tag, err)
+		return
+	}
+	if !found {
+		fmt.Printf("No results for %v:%v\n", d.Repository, d.Tag)
+		return
+	}
+	stdout = b
+}
+
+func runBuiltinProvisioner(ctx context.Context, in *bytes.Buffer, c chan *bytes.Buffer, p api.Provisioner) {
+	var stdout *bytes.Buffer
+	defer func() {
+		select {
+		case c <- stdout:
+		case <-ctx.Done():
+		}
+	}()
+
+	fmt.Printf("Running built-in %v:%v\n", p.Repository, p.Tag)
+	bp, ok := api.LookupProvisioner(p.Tag)
+	if !ok {
+		fmt.Printf("No built-in provisioner named %v\n", p.Tag)
+		return
+	}
+
+	b := new(bytes.Buffer)
+	if err := bp.Provision(ctx, in, b); err != nil {
+		fmt.Printf("The built-in provisioner %v:%v failed: %v\n", p.Repository, p.Tag, err)
+		return
+	}
+	stdout = b
+}
+
+// runBuiltinPackager streams the partition at device from a built-in
+// packager into the transport volume at target.
+func runBuiltinPackager(ctx context.Context, p api.Packager, inputs []string, device string, target string) error {
+	bp, ok := api.LookupPackager(p.Tag)
+	if !ok {
+		return fmt.Errorf(`No built-in packager named %v`, p.Tag)
+	}
+	if device == `` {
+		return errors.New(`Built-in packagers need to know the root partition. Use --root-partition to choose one.`)
+	}
+
+	fmt.Printf("Running built-in %v:%v for %v\n", p.Repository, p.Tag, device)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(bp.Package(ctx, inputs, device, pw))
+	}()
+	err := system.PopulateTransportVolume(ctx, target, pr)
+	// Release the packager if unpacking stopped early
+	pr.CloseWithError(err)
+	return err
+}
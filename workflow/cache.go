@@ -0,0 +1,372 @@
+package workflow
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/v2c/disk"
+	"github.com/docker/v2c/system"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// cacheManifestName is the first entry of a cache archive.
+	cacheManifestName = `v2c-cache.json`
+	// cacheChecksumName is the last entry of a cache archive. It holds the
+	// checksum of every entry in between.
+	cacheChecksumName = `v2c-cache.sha256`
+	// cacheDiskPrefix is where the unpacked disk lives in a cache archive.
+	cacheDiskPrefix = `disk/`
+)
+
+// cacheManifest describes the unpacked disk in a cache archive.
+type cacheManifest struct {
+	Digest  string
+	Created time.Time
+}
+
+// inputDigest identifies the disks in targets by their content so that an
+// unpacked copy can be recognised. It is the digest of the disk itself for a
+// single disk and of the list of their digests otherwise. Directories have no
+// digest.
+func inputDigest(targets []string) (string, error) {
+	ds := []string{}
+	for _, t := range targets {
+		fi, err := os.Stat(t)
+		if err != nil {
+			return ``, err
+		}
+		if !fi.Mode().IsRegular() {
+			return ``, nil
+		}
+		d, err := fileDigest(t)
+		if err != nil {
+			return ``, err
+		}
+		ds = append(ds, d)
+	}
+	switch len(ds) {
+	case 0:
+		return ``, nil
+	case 1:
+		return ds[0], nil
+	}
+	return fmt.Sprintf(`sha256:%x`, sha256.Sum256([]byte(strings.Join(ds, "\n")+"\n"))), nil
+}
+
+func fileDigest(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return ``, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return ``, err
+	}
+	return fmt.Sprintf(`sha256:%x`, h.Sum(nil)), nil
+}
+
+// checkTransportVolume fails when the existing transport volume holds disks
+// other than those with digest.
+func checkTransportVolume(ctx context.Context, digest string) error {
+	held, err := transportVolumeDigest(ctx)
+	if err != nil {
+		return err
+	}
+	if held != `` && digest != `` && held != digest {
+		return fmt.Errorf(`The transport volume holds the disk %v, not %v. Remove the %v volume or save it with cache save first.`, held, digest, system.VOLNAME)
+	}
+	return nil
+}
+
+// SaveCache writes the unpacked disk with digest from the transport volume to
+// fn. The archive is compressed with zstd or xz, using their tools, or with
+// gzip when fn ends in .zst, .xz or .gz.
+func SaveCache(ctx context.Context, digest string, fn string) error {
+	exists, err := system.TransportVolumeExists(ctx)
+	if err != nil {
+		return err
+	}
+	held := ``
+	if exists {
+		if held, err = system.TransportVolumeDigest(ctx); err != nil {
+			return err
+		}
+	}
+	if held != digest {
+		return fmt.Errorf(`No unpacked disk with digest %v. Build it with --no-cleanup first.`, digest)
+	}
+	v, err := system.OpenTransportVolume(ctx)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if err = writeCache(f, v, cacheManifest{Digest: digest, Created: time.Now().UTC()}, fn); err != nil {
+		f.Close()
+		os.Remove(fn)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Saved the unpacked disk %v to %v\n", digest, fn)
+	return nil
+}
+
+func writeCache(w io.Writer, v *system.TransportVolume, m cacheManifest, fn string) error {
+	cw, err := compressor(fn, w)
+	if err != nil {
+		return err
+	}
+	err = writeCacheEntries(tar.NewWriter(cw), v, m)
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeCacheEntries writes the manifest, the unpacked disk read through v and
+// the checksum of its entries to tw.
+func writeCacheEntries(tw *tar.Writer, v *system.TransportVolume, m cacheManifest) error {
+	b, err := json.MarshalIndent(m, ``, `  `)
+	if err != nil {
+		return err
+	}
+	if err = writeCacheEntry(tw, cacheManifestName, b); err != nil {
+		return err
+	}
+
+	sum := sha256.New()
+	err = v.Walk(`/`, func(h *tar.Header, r io.Reader) error {
+		// Entries are relative to the disk, which has none of its own
+		if h.Name == `/` {
+			return nil
+		}
+		h.Name = strings.TrimPrefix(h.Name, `/`)
+		if h.Typeflag == tar.TypeLink {
+			h.Linkname = strings.TrimPrefix(h.Linkname, `/`)
+		}
+		hashHeader(sum, h)
+		h.Name = cacheDiskPrefix + h.Name
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		_, err := io.Copy(io.MultiWriter(tw, sum), r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = writeCacheEntry(tw, cacheChecksumName, []byte(fmt.Sprintf("sha256:%x\n", sum.Sum(nil)))); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeCacheEntry(tw *tar.Writer, name string, b []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(b)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(b)
+	return err
+}
+
+// hashHeader adds the parts of h that unpacking keeps to sum.
+func hashHeader(sum hash.Hash, h *tar.Header) {
+	fmt.Fprintf(sum, "%q %c %o %d %d %d %d %d %d %q\n", h.Name, h.Typeflag, h.Mode, h.Uid, h.Gid,
+		h.Devmajor, h.Devminor, h.ModTime.Unix(), h.Size, h.Linkname)
+	keys := []string{}
+	for k := range h.Xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(sum, "%q=%q\n", k, h.Xattrs[k])
+	}
+}
+
+// LoadCache unpacks a cache archive written by SaveCache into a new
+// transport volume labelled with its digest. The volume is removed again
+// when the archive fails its checksum.
+func LoadCache(ctx context.Context, fn string) error {
+	exists, err := system.TransportVolumeExists(ctx)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf(`The %v volume already exists. Remove it before loading another disk.`, system.VOLNAME)
+	}
+
+	f, err := disk.Sniff(fn)
+	if err != nil {
+		return err
+	}
+	r, err := openDecompressed(f, fn)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	h, err := tr.Next()
+	if err != nil || h.Name != cacheManifestName {
+		r.stop()
+		return fmt.Errorf(`%v is not a v2c cache archive`, fn)
+	}
+	m := cacheManifest{}
+	if err = json.NewDecoder(tr).Decode(&m); err != nil {
+		r.stop()
+		return fmt.Errorf(`%v has an unreadable %v: %v`, fn, cacheManifestName, err)
+	}
+
+	if err = system.CreateTransportVolume(ctx, m.Digest); err != nil {
+		r.stop()
+		return err
+	}
+	fmt.Printf("Loading the unpacked disk %v\n", m.Digest)
+	if err = readCache(ctx, tr); err != nil {
+		r.stop()
+		if rerr := system.RemoveTransportVolume(ctx); rerr != nil {
+			fmt.Printf("Unable to remove the transport volume due to: %v\n", rerr)
+		}
+		return fmt.Errorf(`Unable to load %v: %v`, fn, err)
+	}
+	return r.Close()
+}
+
+// readCache unpacks the disk entries of a cache archive into the transport
+// volume and verifies them against the checksum that follows them.
+func readCache(ctx context.Context, tr *tar.Reader) error {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := system.PopulateTransportVolume(ctx, ``, pr)
+		pr.CloseWithError(err)
+		done <- err
+	}()
+
+	sum := sha256.New()
+	recorded, err := copyCacheEntries(tar.NewWriter(pw), tr, sum)
+	pw.CloseWithError(err)
+	if perr := <-done; err == nil {
+		err = perr
+	}
+	if err != nil {
+		return err
+	}
+	if recorded == `` {
+		return errors.New(`the archive is truncated`)
+	}
+	if actual := fmt.Sprintf(`sha256:%x`, sum.Sum(nil)); recorded != actual {
+		return fmt.Errorf(`the checksum is %v but %v was recorded`, actual, recorded)
+	}
+	return nil
+}
+
+// copyCacheEntries copies the disk entries of tr to tw, adding them to sum,
+// and returns the recorded checksum.
+func copyCacheEntries(tw *tar.Writer, tr *tar.Reader, sum hash.Hash) (string, error) {
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return ``, tw.Close()
+		}
+		if err != nil {
+			return ``, err
+		}
+		if h.Name == cacheChecksumName {
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return ``, err
+			}
+			return string(bytes.TrimSpace(b)), tw.Close()
+		}
+		if !strings.HasPrefix(h.Name, cacheDiskPrefix) {
+			return ``, fmt.Errorf(`unexpected entry %v`, h.Name)
+		}
+		h.Name = strings.TrimPrefix(h.Name, cacheDiskPrefix)
+		hashHeader(sum, h)
+		if err = tw.WriteHeader(h); err != nil {
+			return ``, err
+		}
+		if _, err = io.Copy(io.MultiWriter(tw, sum), tr); err != nil {
+			return ``, err
+		}
+	}
+}
+
+// compressor compresses what is written to w by the extension of fn.
+func compressor(fn string, w io.Writer) (io.WriteCloser, error) {
+	tool := ``
+	switch {
+	case strings.HasSuffix(fn, `.zst`):
+		tool = `zstd`
+	case strings.HasSuffix(fn, `.xz`):
+		tool = `xz`
+	case strings.HasSuffix(fn, `.gz`), strings.HasSuffix(fn, `.tgz`):
+		return gzip.NewWriter(w), nil
+	default:
+		return nopWriteCloser{w}, nil
+	}
+
+	if _, err := exec.LookPath(tool); err != nil {
+		return nil, fmt.Errorf(`%v is needed to write %v`, tool, fn)
+	}
+	cmd := exec.Command(tool, `-cq`)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &toolWriter{WriteCloser: in, cmd: cmd}, nil
+}
+
+// toolWriter feeds a compression tool.
+type toolWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// Close ends the input and waits for the tool to finish writing.
+func (t *toolWriter) Close() error {
+	if err := t.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return t.cmd.Wait()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,295 @@
+package workflow
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"io"
+	"io/ioutil"
+	"os"
+	path "path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// volumesDirName holds the seed archive of each data volume and the
+	// helper that restores them. It is not part of the image.
+	volumesDirName = `volumes`
+	// restoreScriptName restores the seed archives into Docker volumes.
+	restoreScriptName = `restore.sh`
+)
+
+// dataImageTarball names the tarball holding the part of the data category
+// result m that is not below one of its volumes.
+func dataImageTarball(m manifest) string {
+	return strings.TrimSuffix(m.TarballName, `.tar`) + `.image.tar`
+}
+
+// imageTarball names the tarball of the result m of category c whose files
+// go into the image.
+func imageTarball(c string, m manifest) string {
+	if c == `data` && m.TarballName != `` {
+		return dataImageTarball(m)
+	}
+	return m.TarballName
+}
+
+// volumeBaseName turns the volume path v into the part of a volume name
+// that follows its prefix. restore.sh names volumes PREFIX-<base> and the
+// Compose file SERVICE-<base>, which Compose prefixes with the project.
+func volumeBaseName(v string) string {
+	return strings.Trim(volumeNamePattern.ReplaceAllString(v, `-`), `-`)
+}
+
+// seedArchiveName names the seed archive of the volume at v.
+func seedArchiveName(v string) string {
+	return volumeBaseName(v) + `.tar`
+}
+
+// dataVolumes returns the volumes the data category result m declares with
+// the VOLUME instructions of its Dockerfile fragment.
+func dataVolumes(m manifest) ([]string, error) {
+	declared := map[string]bool{}
+	df, err := fetchContributedDockerfile(m)
+	if err != nil || len(df) == 0 {
+		return []string{}, err
+	}
+	d := parser.Directive{}
+	if err = parser.SetEscapeToken(parser.DefaultEscapeToken, &d); err != nil {
+		return nil, err
+	}
+	root, err := parser.Parse(bytes.NewReader(df), &d)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range root.Children {
+		if child.Value != `volume` {
+			continue
+		}
+		for n := child.Next; n != nil; n = n.Next {
+			declared[path.Clean(`/`+n.Value)] = true
+		}
+	}
+	delete(declared, `/`)
+
+	// A volume inside another is part of it
+	result := []string{}
+	for v := range declared {
+		if volumeOf(declared, path.Dir(v)) == `` {
+			result = append(result, v)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// volumeOf returns the volume in volumes that holds p, or an empty string.
+func volumeOf(volumes map[string]bool, p string) string {
+	for ; p != `/` && p != `.`; p = path.Dir(p) {
+		if volumes[p] {
+			return p
+		}
+	}
+	return ``
+}
+
+// volumeInstruction declares volumes in the form Docker prints them.
+func volumeInstruction(volumes []string) string {
+	b, _ := json.Marshal(volumes)
+	return `VOLUME ` + strings.Replace(string(b), `","`, `", "`, -1)
+}
+
+// dataResult is a data category result split into image and volume parts.
+type dataResult struct {
+	m       manifest
+	volumes []string
+	image   int
+}
+
+// prepareData splits each data category result in the build context into a
+// tarball of what goes into the image and the seed archives of its volumes.
+// A volume contributed by more than one result gets one seed archive, later
+// results win.
+func prepareData(ms []manifest) ([]dataResult, error) {
+	dn, perm, err := cwdAndPerms()
+	if err != nil {
+		return nil, err
+	}
+	result := []dataResult{}
+	if len(ms) == 0 {
+		return result, nil
+	}
+	vd := path.Join(dn, volumesDirName)
+	seeds := map[string]*tar.Writer{}
+	files := []*os.File{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, m := range ms {
+		r := dataResult{m: m}
+		if r.volumes, err = dataVolumes(m); err != nil {
+			return nil, err
+		}
+		if len(r.volumes) == 0 {
+			fmt.Printf("The data category provisioner %v:%v declares no VOLUME, its result is added to the image.\n", m.Provisioner.Repository, m.Provisioner.Tag)
+		}
+		if m.TarballName == `` {
+			result = append(result, r)
+			continue
+		}
+		volumes := map[string]bool{}
+		for _, v := range r.volumes {
+			volumes[v] = true
+			if seeds[v] != nil {
+				continue
+			}
+			if err = os.MkdirAll(vd, perm|0700); err != nil {
+				return nil, err
+			}
+			f, err := os.OpenFile(path.Join(vd, seedArchiveName(v)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, f)
+			seeds[v] = tar.NewWriter(f)
+		}
+
+		f, err := os.OpenFile(path.Join(dn, `data`, dataImageTarball(m)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		image := tar.NewWriter(f)
+		err = walkTar(path.Join(dn, `data`, m.TarballName), func(h *tar.Header, rd io.Reader) error {
+			tw := image
+			p := path.Clean(`/` + h.Name)
+			hc := *h
+			// The volume directory itself goes to both so that it has the
+			// same owner and mode in the image and in the volume
+			if v := volumeOf(volumes, p); v != `` {
+				tw = seeds[v]
+				hc.Name = `./` + strings.TrimPrefix(strings.TrimPrefix(p, v), `/`)
+				if hc.Typeflag == tar.TypeDir && !strings.HasSuffix(hc.Name, `/`) {
+					hc.Name += `/`
+				}
+				if hc.Typeflag == tar.TypeLink {
+					target := path.Clean(`/` + hc.Linkname)
+					if volumeOf(map[string]bool{v: true}, target) != v {
+						tw = image
+						hc = *h
+					} else {
+						hc.Linkname = `./` + strings.TrimPrefix(strings.TrimPrefix(target, v), `/`)
+					}
+				}
+				if p == v {
+					r.image++
+					if err := image.WriteHeader(h); err != nil {
+						return err
+					}
+				}
+			}
+			if tw == image {
+				r.image++
+			}
+			if err := tw.WriteHeader(&hc); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, rd)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = image.Close(); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	for _, tw := range seeds {
+		if err = tw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if len(seeds) == 0 {
+		return result, nil
+	}
+	return result, writeRestoreScript(path.Join(vd, restoreScriptName), result)
+}
+
+// applyDataCategory adds the part of each data category result outside its
+// volumes to the image and declares the volumes. What is below them is kept
+// in seed archives outside the build context.
+func applyDataCategory(ms []manifest) error {
+	rs, err := prepareData(ms)
+	if err != nil || len(rs) == 0 {
+		return err
+	}
+	b := new(bytes.Buffer)
+	for _, r := range rs {
+		b.WriteString(fmt.Sprintf("# The following section contributed by data category provisioner: %v:%v\n", r.m.Provisioner.Repository, r.m.Provisioner.Tag))
+		if r.image > 0 {
+			b.WriteString(fmt.Sprintf("ADD ./data/%v /\n", dataImageTarball(r.m)))
+		}
+		instructions, err := contributedInstructions(`data`, r.m)
+		if err != nil {
+			return err
+		}
+		if len(instructions) > 0 {
+			b.WriteString(strings.Join(instructions, "\n") + "\n")
+		}
+		b.WriteString("\n")
+		if len(r.volumes) > 0 {
+			fmt.Printf("The data category provisioner %v:%v seeds the volumes %v\n", r.m.Provisioner.Repository, r.m.Provisioner.Tag, strings.Join(r.volumes, `, `))
+		}
+	}
+	if err = appendDockerfile(b); err != nil {
+		return err
+	}
+	return ignoreData()
+}
+
+// ignoreData keeps the seed archives and the complete data category results
+// out of the build context. Only the image parts of the results remain.
+func ignoreData() error {
+	return addDockerignore(volumesDirName, `data/*.tar`, `!data/*.image.tar`)
+}
+
+// writeRestoreScript writes a helper that creates a Docker volume for each
+// seed archive and unpacks the archive into it.
+func writeRestoreScript(fn string, rs []dataResult) error {
+	volumes := map[string]bool{}
+	for _, r := range rs {
+		for _, v := range r.volumes {
+			volumes[v] = true
+		}
+	}
+	b := new(bytes.Buffer)
+	b.WriteString(`#!/bin/sh
+# Restores the data volumes of this build context into Docker volumes named
+# PREFIX-<volume> and prints the options that mount them. The Compose file of
+# a multi-service build names the volume of a service SERVICE-<volume> and
+# Compose prefixes it with PROJECT_, so ../../restore-volumes.sh runs this
+# script with the prefix PROJECT_SERVICE.
+#
+# Usage: restore.sh [PREFIX]
+set -e
+cd "$(dirname "$0")"
+prefix=${1:-v2c}
+
+restore() {
+  docker volume create "$prefix-$2" > /dev/null
+  docker run --rm -v "$prefix-$2:/seed" -v "$PWD:/archives:ro" busybox tar -xpf "/archives/$2.tar" -C /seed
+  echo "-v $prefix-$2:$1"
+}
+
+`)
+	for _, v := range sortedSet(volumes) {
+		b.WriteString(fmt.Sprintf("restore %v %v\n", shellQuote(v), volumeBaseName(v)))
+	}
+	return ioutil.WriteFile(fn, b.Bytes(), 0755)
+}
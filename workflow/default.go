@@ -3,14 +3,79 @@ package workflow
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/docker/v2c/api"
 	"github.com/docker/v2c/system"
+	"path"
 )
 
 var errNotYetImplemented = errors.New(`not yet implemented`)
 
+// Options control a transformation.
+type Options struct {
+	// NoCleanup keeps the unpacked disk in the transport volume.
+	NoCleanup bool
+
+	// Policy constrains the base image contributed by os provisioners.
+	Policy *Policy
+
+	// Offline fails the transformation when the base image is neither in the
+	// local engine nor in BaseBundle.
+	Offline bool
+
+	// BaseBundle is a docker save archive to load the base image from.
+	BaseBundle string
+
+	// FromImage and FromContainer take the filesystem of a local image or
+	// a container instead of disks.
+	FromImage     string
+	FromContainer string
+	// FromHost captures a live host named as ssh://user@host[:port].
+	FromHost string
+
+	// Excludes are paths left out when capturing a live host or hidden in a
+	// local build.
+	Excludes []string
+
+	// NoCache runs every detective container again rather than reusing
+	// results cached for the same detective image and disk.
+	NoCache bool
+
+	// Detectives limits the detectives that run to those whose
+	// REPOSITORY:TAG matches one of these patterns, SkipDetectives leaves out
+	// those matching any of its patterns.
+	Detectives     []string
+	SkipDetectives []string
+
+	// Since names a previous product to update instead of building the
+	// product from scratch.
+	Since string
+
+	// Tag is the reference the product is meant to be built as.
+	Tag string
+
+	// Emit lists additional outputs, k8s writes Kubernetes manifests for
+	// the product.
+	Emit []string
+
+	// SplitServices writes a build context per service started in the init
+	// category and a Compose file instead of a single build context.
+	SplitServices bool
+
+	// Packager names the packager to use instead of choosing one from the
+	// formats and filesystems packagers declare.
+	Packager string
+
+	// RootPartition overrides the partition number or device that packagers
+	// unpack as the root filesystem.
+	RootPartition string
+
+	// since is the product named by Since, loaded once the build starts.
+	since *sinceProduct
+}
+
 type detectiveResponse struct {
 	Detective string
 	Category  string
@@ -21,9 +86,15 @@ type detectiveResponse struct {
 type provisionerResponse struct {
 	Provisioner api.Provisioner
 	Category    string
+	Detective   string
+	Input       []byte
 	Tarball     *bytes.Buffer
 }
 
+// osFactsDetective is the built-in detective whose material is the OSFacts
+// of the input.
+var osFactsDetective = api.BuiltinRepository + `:os-release`
+
 func buildChecks() error {
 	if empty, err := isCWDEmpty(); !empty || err != nil {
 		if err != nil {
@@ -35,126 +106,110 @@ func buildChecks() error {
 	return nil
 }
 
-func BuildLocal(ctx context.Context, abs string) (string, error) {
+// BuildLocal transforms the host directory abs, usually /, in place. Detectives
+// read a read-only snapshot of it without pseudo filesystems, the engine data
+// root and the excludes in o, built-in detectives included.
+func BuildLocal(ctx context.Context, abs string, o Options) (string, error) {
 	if err := buildChecks(); err != nil {
 		return ``, err
 	}
-
-	components, err := system.DetectComponents()
-	if err != nil {
-		return ``, nil
-	}
-
-	// No packager work, simply create a bind mount from / to
-
-	// Launch Detectives
-	dr := make(chan detectiveResponse)
-	for _, d := range components.Detectives {
-		go launchDetective(ctx, d, dr, abs)
-	}
-
-	// Collect Detective responses
-	detected := []detectiveResponse{}
-	collectDetectiveResponses(ctx, len(components.Detectives), dr, &detected)
-
-	pCount := len(detected)
-	if pCount > 0 {
-		fmt.Printf("Result found for:\n")
-	}
-	for _, dr := range detected {
-		fmt.Printf("\t%v\n", dr.Detective)
-	}
-
-	// Should quit early?
-	if pCount == 0 {
-		return ``, errors.New(`No components were detected.`)
+	if err := checkEmit(o); err != nil {
+		return ``, err
 	}
 
-	// Launch Provisioners
-	prc := make(chan provisionerResponse)
-	err = launchProvisioners(ctx, components, prc, &detected)
+	components, err := system.DetectComponents()
 	if err != nil {
 		return ``, err
 	}
 
-	// Collect provisioned build contexts
-	results := map[string][]provisionerResponse{}
-	collectProvisionerResponses(ctx, pCount, prc, results)
+	components.Detectives = filterDetectives(components.Detectives, o)
 
-	// We can cache at this point and prompt for conflict resolution if required.
-	// At this point we have a fully analyzed image and proposals for provisioning.
-	ms, err := persistProvisionerResults(results)
+	// No packager work, detectives read a read-only bind of abs
+	view, err := snapshotView(ctx, abs, o)
 	if err != nil {
 		return ``, err
 	}
 
-	// Build context assembly pipeline
-	// This could look like a pipeline where the result of one phase is piped to the next.
-	// But we'd end up copying an amazing amount of data in memory and pipelines / nested functions
-	// can be difficult to read. For the PoC we'll use a visitor pattern instead.
-	// Need to process in category ordering - Operating System > Tooling > Platform > Application > Configuration
+	// Launch and collect Detectives
+	detected := runDetectives(ctx, components, view, hiddenDisk{DirDisk: api.DirDisk(abs), hidden: view.Hidden}, nil)
 
-	if err = applyOSCategory(ms["os"]); err != nil {
-		return ``, err
-	}
+	return ``, provisionAndAssemble(ctx, components, detected, nil, o)
+}
 
-	if err = addProductMetadata(); err != nil {
+// Build transforms the virtual disks in targets. The first disk holds the root
+// filesystem, the others are attached in order for filesystems it mounts.
+// A directory or tar archive target, or an image or container named in o,
+// is used as the filesystem instead.
+func Build(ctx context.Context, targets []string, o Options) (string, error) {
+	if err := buildChecks(); err != nil {
 		return ``, err
 	}
-
-	if err = applyCategory(`application`, ms[`application`]); err != nil {
+	if err := checkEmit(o); err != nil {
 		return ``, err
 	}
-
-	if err = applyCategory(`config`, ms[`config`]); err != nil {
-		return ``, err
+	if o.Since != `` {
+		if o.SplitServices {
+			return ``, errors.New(`--since and --split-services cannot be combined`)
+		}
+		since, err := loadSinceProduct(ctx, o.Since)
+		if err != nil {
+			return ``, err
+		}
+		o.since = since
 	}
 
-	if err = applyCategory(`init`, ms[`init`]); err != nil {
+	components, err := detectComponents()
+	if err != nil {
 		return ``, err
 	}
 
-	return ``, err
-}
+	components.Detectives = filterDetectives(components.Detectives, o)
 
-func Build(ctx context.Context, target string, noclean bool) (string, error) {
-	if err := buildChecks(); err != nil {
+	detected, source, err := detect(ctx, components, targets, o)
+	if err != nil {
 		return ``, err
 	}
 
-	components, err := system.DetectComponents()
-	if err != nil {
-		return ``, nil
-	}
+	return ``, provisionAndAssemble(ctx, components, detected, source, o)
+}
 
+//
+// Workflow subroutines
+//
+
+// detect unpacks targets, or the image, container or host named in o, into
+// the transport volume and runs the detectives against it.
+func detect(ctx context.Context, components system.Components, targets []string, o Options) ([]detectiveResponse, *sourceMetadata, error) {
 	// Setup the Packager->Detective transport volume
-	exists, err := system.TransportVolumeExists(ctx)
+	exists, err := transportVolumeExists(ctx)
 	if err != nil {
-		return ``, err
+		return nil, nil, err
 	}
-	var pc string
-	if exists {
-		fmt.Println(`Using existing unpacked image.`)
-	} else {
-		err = system.CreateTransportVolume(ctx)
-		if err != nil {
-			return ``, err
+	digest := ``
+	if o.FromImage == `` && o.FromContainer == `` && o.FromHost == `` {
+		if digest, err = inputDigest(targets); err != nil {
+			return nil, nil, err
 		}
-
-		if len(components.Packagers) == 0 {
-			return ``, errors.New(`no installed packagers`)
+		if digest != `` {
+			fmt.Printf("Input digest %v\n", digest)
 		}
-		packager := choosePackager(components)
-
-		pc, err = system.LaunchPackager(ctx, packager, target)
-		if err != nil {
-			return ``, err
-		}
-		defer system.RemoveContainer(ctx, pc)
 	}
+	if exists {
+		if err = checkTransportVolume(ctx, digest); err != nil {
+			return nil, nil, err
+		}
+		fmt.Println(`Using existing unpacked image.`)
+		// How it was unpacked is not known, so no result can be trusted
+		fmt.Println(`Detective results are not cached for an existing unpacked image.`)
+		digest = ``
+	} else if err = createTransportVolume(ctx, digest); err != nil {
+		return nil, nil, err
+	}
+	// The volume is ours from here on, so it goes whatever happens next
+	keep := o.NoCleanup
 	defer func() {
-		if !noclean {
-			if err = system.RemoveTransportVolume(ctx); err != nil {
+		if !keep {
+			if err := removeTransportVolume(ctx); err != nil {
 				fmt.Printf("Unable to remove the transport volume due to: %v\n", err)
 			}
 		} else {
@@ -162,43 +217,120 @@ func Build(ctx context.Context, target string, noclean bool) (string, error) {
 		}
 	}()
 
+	var pc, layout string
+	var source *sourceMetadata
+	if !exists {
+		pc, layout, source, err = populateTransportVolume(ctx, components, targets, o)
+		if len(pc) > 0 {
+			defer system.RemoveContainer(ctx, pc)
+		}
+		if err != nil {
+			// It is labelled with the digest already and would be taken for
+			// a complete unpacking, so it goes even with --no-cleanup
+			keep = false
+			return nil, nil, err
+		}
+	}
+
+	// Built-in detectives read the unpacked disk through the engine
+	var disk api.Disk
+	if d, c, err := openTransportDisk(ctx); err != nil {
+		fmt.Printf("Built-in detectives cannot reach the transport volume: %v\n", err)
+	} else {
+		defer c.Close()
+		disk = d
+	}
+
+	// Images do not change, so their digest identifies the disk as well
+	if source != nil && source.Kind == `image` {
+		digest = source.Digest
+	}
+
+	// Launch and collect Detectives
+	detected := runDetectives(ctx, components, system.TransportView(), disk, newResultCache(unpackDigest(digest, layout, o), o))
+
+	// Shutdown the Packager
+	if len(pc) > 0 {
+		err = system.RemoveContainer(ctx, pc)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return detected, source, nil
+}
+
+// populate fills the transport volume from an image, a container, a
+// filesystem tree or disks. It returns the ID of the packager container if
+// it still has to be removed, how disks were laid out when unpacking them and
+// the source if it is worth recording.
+func populate(ctx context.Context, components system.Components, targets []string, o Options) (string, string, *sourceMetadata, error) {
+	switch {
+	case o.FromImage != ``:
+		source, err := populateFromImage(ctx, o.FromImage)
+		return ``, ``, source, err
+	case o.FromContainer != ``:
+		source, err := populateFromContainer(ctx, o.FromContainer)
+		return ``, ``, source, err
+	case o.FromHost != ``:
+		source, err := populateFromHost(ctx, o.FromHost, o)
+		return ``, ``, source, err
+	}
+
+	inputs, err := prepareInputs(targets)
+	if err != nil {
+		return ``, ``, nil, err
+	}
+	defer inputs.Cleanup()
+	if inputs.Tree != `` {
+		return ``, ``, nil, populateFromTree(ctx, inputs.Tree)
+	}
+
+	if len(components.Packagers) == 0 {
+		return ``, ``, nil, errors.New(`no installed packagers`)
+	}
+	parts := discoverPartitions(inputs.Disks)
+	packager, err := choosePackager(components.Packagers, inputs.Formats, linuxFilesystems(parts), o)
+	if err != nil {
+		return ``, ``, nil, err
+	}
+	pc, layout, err := unpack(ctx, packager, inputs.Disks, parts, o)
+	return pc, layout, nil, err
+}
+
+func runDetectives(ctx context.Context, components system.Components, v system.DetectiveView, disk api.Disk, cache *resultCache) []detectiveResponse {
 	// Launch Detectives
 	dr := make(chan detectiveResponse)
 	for _, d := range components.Detectives {
-		go launchDetective(ctx, d, dr, system.VOLNAME)
+		go launchDetective(ctx, d, dr, v, disk, cache)
 	}
 
 	// Collect Detective responses
 	detected := []detectiveResponse{}
 	collectDetectiveResponses(ctx, len(components.Detectives), dr, &detected)
 
-	pCount := len(detected)
-	if pCount > 0 {
+	if len(detected) > 0 {
 		fmt.Printf("Result found for:\n")
 	}
 	for _, dr := range detected {
 		fmt.Printf("\t%v\n", dr.Detective)
 	}
+	return detected
+}
 
-	// Shutdown the Packager
-	if len(pc) > 0 {
-		err = system.RemoveContainer(ctx, pc)
-		if err != nil {
-			return ``, err
-		}
-	}
-
+func provisionAndAssemble(ctx context.Context, components system.Components, detected []detectiveResponse, source *sourceMetadata, o Options) error {
 	// Should quit early?
-	if pCount == 0 {
-		return ``, errors.New(`No components were detected.`)
+	if len(detected) == 0 {
+		return errors.New(`No components were detected.`)
 	}
 
+	// Provisioners that consume OS facts receive those found by the built-in
+	// os detective
+	facts := osFactsFromDetections(detected)
+
 	// Launch Provisioners
 	prc := make(chan provisionerResponse)
-	err = launchProvisioners(ctx, components, prc, &detected)
-	if err != nil {
-		return ``, err
-	}
+	pCount := launchProvisioners(ctx, components, prc, &detected, facts)
 
 	// Collect provisioned build contexts
 	results := map[string][]provisionerResponse{}
@@ -208,52 +340,135 @@ func Build(ctx context.Context, target string, noclean bool) (string, error) {
 	// At this point we have a fully analyzed image and proposals for provisioning.
 	ms, err := persistProvisionerResults(results)
 	if err != nil {
-		return ``, err
+		return err
+	}
+	md := runMetadata{Facts: facts, Source: source}
+	if err = persistRunMetadata(md); err != nil {
+		return err
+	}
+
+	if o.Since != `` {
+		return assembleDelta(ctx, ms, md, o)
+	}
+	if o.SplitServices {
+		return assembleServices(ctx, ms, md, o)
 	}
+	return assemble(ctx, ms, md, o)
+}
 
+func assemble(ctx context.Context, ms map[string][]manifest, md runMetadata, o Options) error {
 	// Build context assembly pipeline
 	// This could look like a pipeline where the result of one phase is piped to the next.
 	// But we'd end up copying an amazing amount of data in memory and pipelines / nested functions
 	// can be difficult to read. For the PoC we'll use a visitor pattern instead.
 	// Need to process in category ordering - Operating System > Tooling > Platform > Application > Configuration
 
-	if err = applyOSCategory(ms["os"]); err != nil {
-		return ``, err
+	base, resolved, err := applyOSCategory(ctx, ms["os"], md.Facts, o)
+	if err != nil {
+		return err
 	}
 
-	if err = addProductMetadata(); err != nil {
-		return ``, err
+	labels := md.Source.labels()
+	labels[`com.docker.v2c.product.base`] = base
+	labels[`com.docker.v2c.product.base.digest`] = resolved
+	if err = addProductMetadata(labels); err != nil {
+		return err
 	}
 
 	if err = applyCategory(`application`, ms[`application`]); err != nil {
-		return ``, err
+		return err
 	}
 
 	if err = applyCategory(`config`, ms[`config`]); err != nil {
-		return ``, err
+		return err
+	}
+
+	if err = applyDataCategory(ms[`data`]); err != nil {
+		return err
 	}
 
 	if err = applyCategory(`init`, ms[`init`]); err != nil {
-		return ``, err
+		return err
 	}
 
-	return ``, err
+	if err = recordProvenance(ms); err != nil {
+		return err
+	}
+	// The provisioner inputs kept for retarget are no part of the image
+	if err = addDockerignore(`*/*.input`); err != nil {
+		return err
+	}
+	return emit(ms, o)
 }
 
-//
-// Workflow subroutines
-//
-
-func launchProvisioners(ctx context.Context, components system.Components, c chan provisionerResponse, rs *[]detectiveResponse) error {
+// launchProvisioners starts the provisioner related to each detection and
+// returns the number launched.
+func launchProvisioners(ctx context.Context, components system.Components, c chan provisionerResponse, rs *[]detectiveResponse, facts *api.OSFacts) int {
+	launched := 0
 	for _, r := range *rs {
-		var p api.Provisioner
-		for _, p = range components.Provisioners {
-			if s := fmt.Sprintf("%v:%v", p.Repository, p.Tag); s == r.Next {
-				break
-			}
+		p, ok := findProvisioner(components, r.Next)
+		if !ok {
+			fmt.Printf("No provisioner %v is installed for %v\n", r.Next, r.Detective)
+			continue
+		}
+
+		go launchProvisioner(ctx, p, r.Detective, r.Tarball.Bytes(), c, facts)
+		launched++
+	}
+	return launched
+}
+
+// filterDetectives applies the detective patterns in o.
+func filterDetectives(ds []api.Detective, o Options) []api.Detective {
+	if len(o.Detectives) == 0 && len(o.SkipDetectives) == 0 {
+		return ds
+	}
+	result := []api.Detective{}
+	for _, d := range ds {
+		ref := fmt.Sprintf(`%v:%v`, d.Repository, d.Tag)
+		if len(o.Detectives) > 0 && !matchesAny(o.Detectives, ref) {
+			continue
+		}
+		if matchesAny(o.SkipDetectives, ref) {
+			continue
+		}
+		result = append(result, d)
+	}
+	return result
+}
+
+// matchesAny reports whether s matches one of the glob patterns.
+func matchesAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
 		}
+	}
+	return false
+}
 
-		go launchProvisioner(ctx, p, r.Tarball, c)
+func findProvisioner(components system.Components, ref string) (api.Provisioner, bool) {
+	for _, p := range components.Provisioners {
+		if s := fmt.Sprintf("%v:%v", p.Repository, p.Tag); s == ref {
+			return p, true
+		}
+	}
+	return api.Provisioner{}, false
+}
+
+// osFactsFromDetections returns the facts reported by the built-in os
+// detective, or nil when it found none.
+func osFactsFromDetections(rs []detectiveResponse) *api.OSFacts {
+	for _, r := range rs {
+		if r.Detective != osFactsDetective {
+			continue
+		}
+		f := &api.OSFacts{}
+		if err := json.Unmarshal(r.Tarball.Bytes(), f); err != nil {
+			fmt.Printf("Unable to read the facts reported by %v: %v\n", r.Detective, err)
+			return nil
+		}
+		return f
 	}
 	return nil
 }
@@ -285,28 +500,31 @@ func collectProvisionerResponses(ctx context.Context, c int, rc chan provisioner
 		case <-ctx.Done():
 			return errors.New(`Task cancelled or late.`)
 		case pr := <-rc:
+			if pr.Tarball == nil {
+				continue
+			}
 			rs[pr.Category] = append(rs[pr.Category], pr)
 		}
 	}
 	return nil
 }
 
-func choosePackager(c system.Components) api.Packager {
-	return c.Packagers[0]
-}
-
 //
 // launch control
 //
 
-func launchDetective(ctx context.Context, d api.Detective, drc chan detectiveResponse, tvn string) {
+func launchDetective(ctx context.Context, d api.Detective, drc chan detectiveResponse, v system.DetectiveView, disk api.Disk, cache *resultCache) {
 	r := detectiveResponse{
 		Detective: fmt.Sprintf(`%v:%v`, d.Repository, d.Tag),
 		Category:  d.Category,
 		Next:      d.Related,
 	}
 	tbc := make(chan *bytes.Buffer)
-	go system.LaunchDetective(ctx, tbc, d, tvn)
+	if d.InProcess {
+		go runBuiltinDetective(ctx, tbc, d, disk)
+	} else {
+		go runContainerDetective(ctx, tbc, d, v, cache)
+	}
 
 	select {
 	case r.Tarball = <-tbc:
@@ -320,13 +538,25 @@ func launchDetective(ctx context.Context, d api.Detective, drc chan detectiveRes
 	}
 }
 
-func launchProvisioner(ctx context.Context, p api.Provisioner, in *bytes.Buffer, prc chan provisionerResponse) {
+func launchProvisioner(ctx context.Context, p api.Provisioner, d string, in []byte, prc chan provisionerResponse, facts *api.OSFacts) {
 	r := provisionerResponse{
 		Provisioner: p,
 		Category:    p.Category,
+		Detective:   d,
+		Input:       in,
+	}
+	var env []string
+	pctx := ctx
+	if facts != nil && api.Consumes(p.Facts, api.FactOS) {
+		env = facts.Environment()
+		pctx = api.WithOSFacts(ctx, *facts)
 	}
 	tbc := make(chan *bytes.Buffer)
-	go system.LaunchProvisioner(ctx, in, tbc, p)
+	if p.InProcess {
+		go runBuiltinProvisioner(pctx, bytes.NewBuffer(in), tbc, p)
+	} else {
+		go system.LaunchProvisioner(ctx, bytes.NewBuffer(in), tbc, p, env)
+	}
 
 	select {
 	case r.Tarball = <-tbc:
@@ -0,0 +1,200 @@
+package workflow
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/go-units"
+	"github.com/docker/v2c/api"
+	"github.com/docker/v2c/disk"
+	"github.com/docker/v2c/system"
+	path "path/filepath"
+	"strconv"
+	"strings"
+)
+
+// inputPartition is a partition on the input disk at index Disk.
+type inputPartition struct {
+	disk.Partition
+	Disk int
+}
+
+func (p inputPartition) Device() string {
+	return p.Partition.Device(p.Disk)
+}
+
+// unpack runs the packager for the root filesystem and then once more for
+// every filesystem the root's /etc/fstab mounts from the input disks. It
+// returns the ID of the packager container if it still has to be removed.
+func unpack(ctx context.Context, p api.Packager, targets []string, parts []inputPartition, o Options) (string, string, error) {
+	root, err := chooseRootPartition(parts, targets, o)
+	if err != nil {
+		return ``, ``, err
+	}
+
+	// The layout describes how the disks were unpacked, the same disks
+	// unpacked differently give detectives a different filesystem
+	layout := []string{fmt.Sprintf(`packager=%v:%v@%v`, p.Repository, p.Tag, p.ImageID), `root=` + root}
+	pc, err := launchPackager(ctx, p, targets, root, ``)
+	if err != nil {
+		return ``, ``, err
+	}
+
+	// A packager that chose the root itself mounts what /etc/fstab names
+	// as well, logical volumes included
+	if root == `` {
+		return pc, strings.Join(layout, "\n"), nil
+	}
+	fstab, err := readUnpackedFile(ctx, pc, `/etc/fstab`)
+	if err != nil {
+		fmt.Printf("Only the root filesystem was unpacked, /etc/fstab could not be read: %v\n", err)
+		return pc, strings.Join(layout, "\n"), nil
+	}
+	mounts, unresolved := resolveFstab(parseFstab(fstab), parts, root)
+	for _, u := range unresolved {
+		fmt.Printf("Unable to unpack %v from %v: %v\n", u.Entry.File, u.Entry.Spec, u.Reason)
+	}
+	if len(mounts) == 0 {
+		return pc, strings.Join(layout, "\n"), nil
+	}
+
+	if len(pc) > 0 {
+		if err = system.RemoveContainer(ctx, pc); err != nil {
+			return ``, ``, err
+		}
+	}
+	for _, m := range mounts {
+		fmt.Printf("Unpacking %v (%v) at %v\n", m.Partition.Device(), m.Partition.Filesystem, m.Entry.File)
+		layout = append(layout, fmt.Sprintf(`mount=%v@%v`, m.Partition.Device(), m.Entry.File))
+		mc, err := launchPackager(ctx, p, targets, m.Partition.Device(), m.Entry.File)
+		if err != nil {
+			return ``, ``, err
+		}
+		if len(mc) > 0 {
+			if err = system.RemoveContainer(ctx, mc); err != nil {
+				return ``, ``, err
+			}
+		}
+	}
+	return ``, strings.Join(layout, "\n"), nil
+}
+
+// launchPackager unpacks device at target below /v2c/disk. An empty target
+// is the root filesystem and an empty device leaves the choice to the
+// packager. It returns the ID of the packager container, if there is one.
+func launchPackager(ctx context.Context, p api.Packager, targets []string, device string, target string) (string, error) {
+	if p.InProcess {
+		return ``, runBuiltinPackager(ctx, p, targets, device, target)
+	}
+	env := []string{`V2C_INPUTS=` + strings.Join(system.PackagerInputs(len(targets)), ` `)}
+	if device != `` {
+		env = append(env, `V2C_ROOT_PARTITION=`+device)
+	}
+	if target != `` {
+		env = append(env, `V2C_TARGET=`+target)
+	}
+	return system.LaunchPackager(ctx, p, targets, env)
+}
+
+// readUnpackedFile reads a regular file from the unpacked disk, through the
+// packager container if there is one.
+func readUnpackedFile(ctx context.Context, pc string, name string) ([]byte, error) {
+	if len(pc) > 0 {
+		return system.ReadContainerFile(ctx, pc, path.Join(`/v2c/disk`, name))
+	}
+	v, err := system.OpenTransportVolume(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer v.Close()
+	return v.ReadFile(name)
+}
+
+// discoverPartitions lists the partitions on every input that can be read
+// natively. Inputs that cannot be read are reported and skipped.
+func discoverPartitions(targets []string) []inputPartition {
+	result := []inputPartition{}
+	for i, t := range targets {
+		img, err := disk.Open(t)
+		if err != nil {
+			fmt.Printf("Unable to read the partition table of %v: %v\n", t, err)
+			continue
+		}
+		parts, err := disk.Partitions(img, img.Size())
+		img.Close()
+		if err != nil {
+			fmt.Printf("Unable to read the partition table of %v: %v\n", t, err)
+			continue
+		}
+		for _, p := range parts {
+			result = append(result, inputPartition{Partition: p, Disk: i})
+		}
+	}
+	return result
+}
+
+// chooseRootPartition returns the device packagers should unpack as the root
+// filesystem. Without an override it is discovered from the partition
+// tables. An empty result leaves the choice to the packager.
+func chooseRootPartition(parts []inputPartition, targets []string, o Options) (string, error) {
+	if o.RootPartition != `` {
+		dev, err := partitionDevice(o.RootPartition)
+		if err != nil {
+			return ``, err
+		}
+		fmt.Printf("Using %v as the root filesystem.\n", dev)
+		return dev, nil
+	}
+	if len(parts) == 0 {
+		fmt.Println(`No partitions were discovered, the packager will choose the root filesystem.`)
+		return ``, nil
+	}
+
+	dps := []disk.Partition{}
+	for _, p := range parts {
+		dps = append(dps, p.Partition)
+	}
+	probe := func(dp disk.Partition) bool {
+		for _, p := range parts {
+			if p.Partition != dp || p.Disk >= len(targets) {
+				continue
+			}
+			img, err := disk.Open(targets[p.Disk])
+			if err != nil {
+				return false
+			}
+			defer img.Close()
+			return disk.HasFstab(img, dp)
+		}
+		return false
+	}
+	rp, why, ok := disk.ChooseRoot(dps, probe)
+	if !ok && why == disk.RootOnLVM {
+		fmt.Printf("No partition is marked as the Linux root or holds /etc/fstab and %v, so the packager will choose the root filesystem. Use --root-partition to choose one.\n", why)
+		return ``, nil
+	}
+	if !ok {
+		return ``, fmt.Errorf(`No partition with a Linux filesystem was found. Use --root-partition to choose one.`)
+	}
+	for _, p := range parts {
+		if p.Partition == rp {
+			if why == disk.RootBySize {
+				fmt.Printf("Warning: no partition is marked as the Linux root or holds /etc/fstab, %v is used because %v. Use --root-partition to choose another.\n", p.Device(), why)
+			}
+			fmt.Printf("Using %v (%v, %v) as the root filesystem: %v.\n", p.Device(), p.Filesystem, units.HumanSize(float64(p.Size)), why)
+			return p.Device(), nil
+		}
+	}
+	return ``, nil
+}
+
+// partitionDevice accepts a partition number on the first disk or a device.
+func partitionDevice(s string) (string, error) {
+	if strings.HasPrefix(s, `/dev/`) {
+		return s, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return ``, fmt.Errorf(`%v is neither a partition number nor a device`, s)
+	}
+	return disk.Partition{Number: n}.Device(0), nil
+}
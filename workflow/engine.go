@@ -0,0 +1,26 @@
+package workflow
+
+import (
+	"context"
+	"github.com/docker/v2c/api"
+	"github.com/docker/v2c/system"
+	"io"
+)
+
+// The engine operations detect and Assess rely on. Tests replace them to
+// follow the transport volume without an engine.
+var (
+	detectComponents      = system.DetectComponents
+	transportVolumeExists = system.TransportVolumeExists
+	createTransportVolume = system.CreateTransportVolume
+	removeTransportVolume = system.RemoveTransportVolume
+	transportVolumeDigest = system.TransportVolumeDigest
+	openTransportDisk     = func(ctx context.Context) (api.Disk, io.Closer, error) {
+		v, err := system.OpenTransportVolume(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return v, v, nil
+	}
+	populateTransportVolume = populate
+)
@@ -0,0 +1,78 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"github.com/docker/v2c/api"
+	"github.com/docker/v2c/system"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// fakeVolume stands in for the transport volume in the engine.
+type fakeVolume struct {
+	exists bool
+	digest string
+}
+
+// install replaces the engine operations until the returned function
+// restores them.
+func (v *fakeVolume) install(populate func(targets []string) error) func() {
+	d, e, c, r, g, o, p := detectComponents, transportVolumeExists, createTransportVolume,
+		removeTransportVolume, transportVolumeDigest, openTransportDisk, populateTransportVolume
+	restore := func() {
+		detectComponents, transportVolumeExists, createTransportVolume = d, e, c
+		removeTransportVolume, transportVolumeDigest, openTransportDisk, populateTransportVolume = r, g, o, p
+	}
+
+	detectComponents = func() (system.Components, error) { return system.Components{}, nil }
+	transportVolumeExists = func(context.Context) (bool, error) { return v.exists, nil }
+	createTransportVolume = func(_ context.Context, digest string) error {
+		if v.exists {
+			return errors.New(`the transport volume exists`)
+		}
+		v.exists, v.digest = true, digest
+		return nil
+	}
+	removeTransportVolume = func(context.Context) error {
+		v.exists, v.digest = false, ``
+		return nil
+	}
+	transportVolumeDigest = func(context.Context) (string, error) { return v.digest, nil }
+	openTransportDisk = func(context.Context) (api.Disk, io.Closer, error) {
+		return nil, nil, errors.New(`no engine`)
+	}
+	populateTransportVolume = func(_ context.Context, _ system.Components, targets []string, _ Options) (string, string, *sourceMetadata, error) {
+		return ``, ``, nil, populate(targets)
+	}
+	return restore
+}
+
+func TestDetectRemovesUnfilledVolume(t *testing.T) {
+	f, err := ioutil.TempFile(``, `v2c-detect`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	v := &fakeVolume{}
+	defer v.install(func([]string) error { return errors.New(`unable to unpack`) })()
+	if _, _, err = detect(context.Background(), system.Components{}, []string{f.Name()}, Options{NoCleanup: true}); err == nil {
+		t.Fatal(`unpacking succeeded`)
+	}
+	if v.exists {
+		t.Errorf("the volume labelled %v was kept although it was not filled", v.digest)
+	}
+
+	// A filled volume is kept as asked
+	defer v.install(func([]string) error { return nil })()
+	if _, _, err = detect(context.Background(), system.Components{}, []string{f.Name()}, Options{NoCleanup: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !v.exists || v.digest == `` {
+		t.Errorf("the filled volume was not kept with its digest")
+	}
+}
@@ -0,0 +1,400 @@
+package workflow
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"io"
+	"io/ioutil"
+	"os"
+	path "path/filepath"
+	"strings"
+)
+
+const (
+	// fleetTarballName holds the files the machines of a fleet share.
+	fleetTarballName = `fleet.tar`
+	// fleetManifestName describes a fleet base build context.
+	fleetManifestName = `fleet.json`
+	// standaloneDockerfileName keeps the Dockerfile of a rewritten run.
+	standaloneDockerfileName = `Dockerfile.standalone`
+)
+
+// fleetRun is a build context that takes part in a fleet base.
+type fleetRun struct {
+	dir  string
+	base string
+	md   runMetadata
+	ms   map[string][]manifest
+	p    provenance
+}
+
+// fleetManifest records what went into a fleet base.
+type fleetManifest struct {
+	Tag          string
+	Base         string
+	Runs         []string
+	Files        int
+	Instructions []string
+}
+
+// FleetBase writes a build context for a base image holding what the os and
+// application contributions of the build contexts in runs have in common,
+// and rewrites each of them to build FROM tag with only what remains. The
+// base build context is written to the current working directory.
+func FleetBase(ctx context.Context, runs []string, tag string) error {
+	if len(runs) < 2 {
+		return errors.New(`A fleet base needs at least two build contexts.`)
+	}
+	if err := buildChecks(); err != nil {
+		return err
+	}
+	dn, perm, err := cwdAndPerms()
+	if err != nil {
+		return err
+	}
+
+	frs := []fleetRun{}
+	for _, dir := range runs {
+		if dir, err = path.Abs(dir); err != nil {
+			return err
+		}
+		fr, err := loadFleetRun(dir)
+		if err != nil {
+			return err
+		}
+		if len(frs) > 0 && fr.base != frs[0].base {
+			return fmt.Errorf(`%v builds FROM %v but %v builds FROM %v, a fleet base needs the same base image.`, dir, fr.base, frs[0].dir, frs[0].base)
+		}
+		frs = append(frs, fr)
+	}
+
+	common := commonFiles(frs)
+	instructions := commonInstructions(frs)
+	written, err := writeFleetTarball(path.Join(dn, fleetTarballName), frs[0], common)
+	if err != nil {
+		return err
+	}
+
+	b := new(bytes.Buffer)
+	b.WriteString(fmt.Sprintf("FROM %v\n\n", frs[0].base))
+	b.WriteString(fmt.Sprintf("LABEL com.docker.v2c.fleet.base=%q\n\n", fmt.Sprintf(`%v machines`, len(frs))))
+	if written > 0 {
+		b.WriteString(fmt.Sprintf("ADD ./%v /\n", fleetTarballName))
+	}
+	if len(instructions) > 0 {
+		b.WriteString("# The following application category instructions start the contributions of every machine\n")
+		b.WriteString(strings.Join(instructions, "\n") + "\n")
+	}
+	if err = appendDockerfile(b); err != nil {
+		return err
+	}
+	fm := fleetManifest{
+		Tag:          tag,
+		Base:         frs[0].base,
+		Runs:         []string{},
+		Files:        written,
+		Instructions: instructions,
+	}
+	for _, fr := range frs {
+		fm.Runs = append(fm.Runs, fr.dir)
+	}
+	mb, err := json.MarshalIndent(fm, ``, `  `)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path.Join(dn, fleetManifestName), mb, perm); err != nil {
+		return err
+	}
+	fmt.Printf("The fleet base shares %v files and %v instructions.\n", written, len(instructions))
+
+	for _, fr := range frs {
+		fr := fr
+		if err = inDir(fr.dir, func() error { return rewriteForFleet(fr, tag, common, len(instructions)) }); err != nil {
+			return fmt.Errorf(`Unable to rewrite %v: %v`, fr.dir, err)
+		}
+		fmt.Printf("Rewrote %v to build FROM %v\n", fr.dir, tag)
+	}
+	return nil
+}
+
+// inDir runs f with dir as the working directory.
+func inDir(dir string, f func() error) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err = os.Chdir(dir); err != nil {
+		return err
+	}
+	defer os.Chdir(wd)
+	return f()
+}
+
+// loadFleetRun reads the build context in dir.
+func loadFleetRun(dir string) (fleetRun, error) {
+	fr := fleetRun{dir: dir}
+	err := inDir(dir, func() error {
+		var err error
+		if fr.md, err = loadRunMetadata(); err != nil {
+			return err
+		}
+		for _, fn := range []string{standaloneDockerfileName, deltaTarballName} {
+			if _, err = os.Stat(fn); err == nil {
+				return fmt.Errorf(`%v contains %v, only a complete build context can join a fleet base.`, dir, fn)
+			}
+		}
+		if fr.base, err = dockerfileBase(`Dockerfile`); err != nil {
+			return err
+		}
+		if fr.ms, err = loadManifests(); err != nil {
+			return err
+		}
+		fr.p, err = buildProvenance(fr.ms)
+		return err
+	})
+	return fr, err
+}
+
+// dockerfileBase returns the image the Dockerfile fn builds FROM.
+func dockerfileBase(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return ``, err
+	}
+	defer f.Close()
+	s := parser.Directive{}
+	if err = parser.SetEscapeToken(parser.DefaultEscapeToken, &s); err != nil {
+		return ``, err
+	}
+	root, err := parser.Parse(f, &s)
+	if err != nil {
+		return ``, err
+	}
+	for _, child := range root.Children {
+		if child.Value == `from` && child.Next != nil {
+			return child.Next.Value, nil
+		}
+	}
+	return ``, fmt.Errorf(`%v has no FROM instruction`, fn)
+}
+
+// baseFiles maps the paths contributed in the os and application categories
+// to their digest, when no later category changes them.
+func (fr fleetRun) baseFiles() map[string]string {
+	final := fr.p.files()
+	result := map[string]string{}
+	for _, c := range fr.p.Contributions {
+		if c.Category != `os` && c.Category != `application` {
+			continue
+		}
+		for f, d := range c.Files {
+			result[f] = d
+		}
+	}
+	for f, d := range result {
+		if final[f] != d {
+			delete(result, f)
+		}
+	}
+	return result
+}
+
+// commonFiles returns the base files every run has with the same digest.
+func commonFiles(frs []fleetRun) map[string]string {
+	common := frs[0].baseFiles()
+	for _, fr := range frs[1:] {
+		files := fr.baseFiles()
+		for f, d := range common {
+			if files[f] != d {
+				delete(common, f)
+			}
+		}
+	}
+	return common
+}
+
+// commonInstructions returns the application category instructions that
+// every run starts with. Only such a common prefix moves to the fleet base,
+// since the instructions a run keeps follow those of the base and must not
+// end up ahead of instructions that came before them.
+func commonInstructions(frs []fleetRun) []string {
+	result := frs[0].applicationInstructions()
+	for _, fr := range frs[1:] {
+		ins := fr.applicationInstructions()
+		n := 0
+		for n < len(result) && n < len(ins) && result[n] == ins[n] {
+			n++
+		}
+		result = result[:n]
+	}
+	return result
+}
+
+// applicationInstructions returns the application category instructions of
+// fr in the order they are assembled.
+func (fr fleetRun) applicationInstructions() []string {
+	result := []string{}
+	for _, c := range fr.p.Contributions {
+		if c.Category == `application` {
+			result = append(result, c.Instructions...)
+		}
+	}
+	return result
+}
+
+// writeFleetTarball collects the common files from the results of fr into fn
+// and returns how many there are.
+func writeFleetTarball(fn string, fr fleetRun, common map[string]string) (int, error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+
+	written := map[string]bool{}
+	err = fr.walkContributions(func(c string, m manifest, r contribution) error {
+		if m.TarballName == `` {
+			return nil
+		}
+		return walkTar(path.Join(fr.dir, c, imageTarball(c, m)), func(h *tar.Header, rd io.Reader) error {
+			p := path.Clean(`/` + h.Name)
+			d, ok := common[p]
+			if !ok || written[p] || r.Files[p] != d {
+				return nil
+			}
+			written[p] = true
+			if err := tw.WriteHeader(h); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, rd)
+			return err
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err = tw.Close(); err != nil {
+		return 0, err
+	}
+	return len(written), nil
+}
+
+// walkContributions visits each manifest of fr with its contribution, in
+// the order the provenance records them.
+func (fr fleetRun) walkContributions(visit func(string, manifest, contribution) error) error {
+	i := 0
+	for _, c := range categoryOrder {
+		for _, m := range fr.ms[c] {
+			r := fr.p.Contributions[i]
+			i++
+			if err := visit(c, m, r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rewriteForFleet keeps the Dockerfile of the build context in the working
+// directory as Dockerfile.standalone and writes one that builds FROM tag
+// with the files and instructions the fleet base does not provide. The base
+// provides the first shared application category instructions.
+func rewriteForFleet(fr fleetRun, tag string, common map[string]string, shared int) error {
+	dn, perm, err := cwdAndPerms()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(path.Join(dn, `Dockerfile`), path.Join(dn, standaloneDockerfileName)); err != nil {
+		return err
+	}
+	if err = appendDockerfile(bytes.NewBufferString(fmt.Sprintf("FROM %v\n\n", tag))); err != nil {
+		return err
+	}
+	labels := fr.md.Source.labels()
+	labels[`com.docker.v2c.product.base`] = fr.base
+	labels[`com.docker.v2c.product.fleet.base`] = tag
+	if err = addProductMetadata(labels); err != nil {
+		return err
+	}
+
+	b := new(bytes.Buffer)
+	err = fr.walkContributions(func(c string, m manifest, r contribution) error {
+		if c == `os` {
+			return nil
+		}
+		add := ``
+		if m.TarballName != `` {
+			fn := strings.TrimSuffix(m.TarballName, `.tar`) + `.fleet.tar`
+			if c == `data` {
+				// The .dockerignore of a data category result only lets
+				// image tarballs into the build context
+				fn = strings.TrimSuffix(m.TarballName, `.tar`) + `.fleet.image.tar`
+			}
+			n, err := writeRemainingTarball(path.Join(dn, c, imageTarball(c, m)), path.Join(dn, c, fn), perm, common)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				add = fmt.Sprintf("ADD ./%v/%v /\n", c, fn)
+			}
+		}
+		rest := []string{}
+		for _, in := range r.Instructions {
+			if c == `application` && shared > 0 {
+				shared--
+				continue
+			}
+			rest = append(rest, in)
+		}
+		if add == `` && len(rest) == 0 {
+			return nil
+		}
+		b.WriteString(fmt.Sprintf("# The following section contributed by %v category provisioner: %v\n", c, r.Provisioner))
+		b.WriteString(add)
+		if len(rest) > 0 {
+			b.WriteString(strings.Join(rest, "\n") + "\n")
+		}
+		b.WriteString("\n")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = appendDockerfile(b); err != nil {
+		return err
+	}
+	return addProvenance(fr.p)
+}
+
+// writeRemainingTarball copies the entries of the tarball from that the
+// fleet base does not provide to to and returns how many there are.
+func writeRemainingTarball(from string, to string, perm os.FileMode, common map[string]string) (int, error) {
+	f, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	n := 0
+	err = walkTar(from, func(h *tar.Header, rd io.Reader) error {
+		if _, ok := common[path.Clean(`/`+h.Name)]; ok {
+			return nil
+		}
+		n++
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, rd)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, tw.Close()
+}
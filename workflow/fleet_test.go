@@ -0,0 +1,50 @@
+package workflow
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCommonInstructions(t *testing.T) {
+	run := func(cs ...contribution) fleetRun {
+		return fleetRun{p: provenance{Contributions: cs}}
+	}
+	app := func(ins ...string) contribution {
+		return contribution{Category: `application`, Instructions: ins}
+	}
+	for _, c := range []struct {
+		name  string
+		frs   []fleetRun
+		wants []string
+	}{
+		{`identical`, []fleetRun{
+			run(contribution{Category: `os`, Instructions: []string{`RUN apt-get update`}}, app(`ENV A=1`, `RUN a`)),
+			run(app(`ENV A=1`, `RUN a`)),
+		}, []string{`ENV A=1`, `RUN a`}},
+		{`common prefix across contributions`, []fleetRun{
+			run(app(`ENV A=1`), app(`RUN a`, `RUN b`)),
+			run(app(`ENV A=1`, `RUN a`), app(`RUN c`)),
+		}, []string{`ENV A=1`, `RUN a`}},
+		{`shared after a difference`, []fleetRun{
+			run(app(`ENV A=1`, `RUN a`)),
+			run(app(`ENV A=2`, `RUN a`)),
+		}, []string{}},
+		{`reordered`, []fleetRun{
+			run(app(`RUN a`, `RUN b`)),
+			run(app(`RUN b`, `RUN a`)),
+			run(app(`RUN a`, `RUN b`)),
+		}, []string{}},
+		{`repeated`, []fleetRun{
+			run(app(`RUN a`, `RUN a`, `RUN b`)),
+			run(app(`RUN a`, `RUN a`)),
+		}, []string{`RUN a`, `RUN a`}},
+		{`config is not shared`, []fleetRun{
+			run(contribution{Category: `config`, Instructions: []string{`RUN a`}}),
+			run(contribution{Category: `config`, Instructions: []string{`RUN a`}}),
+		}, []string{}},
+	} {
+		if got := commonInstructions(c.frs); !reflect.DeepEqual(got, c.wants) {
+			t.Errorf("%v: got %q, want %q", c.name, got, c.wants)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package workflow
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type fstabEntry struct {
+	Spec    string
+	File    string
+	VFSType string
+	Options []string
+}
+
+type fstabMount struct {
+	Entry     fstabEntry
+	Partition inputPartition
+}
+
+type fstabUnresolved struct {
+	Entry  fstabEntry
+	Reason string
+}
+
+// pseudoFilesystems never live on an input disk.
+var pseudoFilesystems = map[string]bool{
+	`proc`: true, `sysfs`: true, `devpts`: true, `devtmpfs`: true, `tmpfs`: true,
+	`cgroup`: true, `cgroup2`: true, `securityfs`: true, `debugfs`: true,
+	`hugetlbfs`: true, `mqueue`: true, `pstore`: true, `configfs`: true,
+	`binfmt_misc`: true, `fusectl`: true, `rpc_pipefs`: true, `autofs`: true,
+	`swap`: true, `none`: true,
+}
+
+var networkFilesystems = map[string]bool{
+	`nfs`: true, `nfs4`: true, `cifs`: true, `smbfs`: true, `glusterfs`: true,
+	`ceph`: true, `sshfs`: true, `fuse.sshfs`: true, `davfs`: true,
+}
+
+func parseFstab(b []byte) []fstabEntry {
+	result := []fstabEntry{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if len(l) == 0 || l[0] == '#' {
+			continue
+		}
+		f := strings.Fields(l)
+		if len(f) < 3 {
+			continue
+		}
+		e := fstabEntry{
+			Spec:    unescapeFstab(f[0]),
+			File:    unescapeFstab(f[1]),
+			VFSType: f[2],
+		}
+		if len(f) > 3 {
+			e.Options = strings.Split(f[3], `,`)
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// unescapeFstab decodes the octal escapes fstab uses for spaces and tabs.
+func unescapeFstab(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	b := new(bytes.Buffer)
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// resolveFstab matches the filesystems mounted by fstab with the partitions
+// on the input disks. The root filesystem, pseudo filesystems and swap are
+// left out. Mounts are ordered so that parents are unpacked before children.
+func resolveFstab(es []fstabEntry, parts []inputPartition, root string) ([]fstabMount, []fstabUnresolved) {
+	mounts := []fstabMount{}
+	unresolved := []fstabUnresolved{}
+	for _, e := range es {
+		if e.File == `/` || pseudoFilesystems[e.VFSType] || !strings.HasPrefix(e.File, `/`) {
+			continue
+		}
+		if networkFilesystems[e.VFSType] || strings.Contains(e.Spec, `:/`) || strings.HasPrefix(e.Spec, `//`) {
+			unresolved = append(unresolved, fstabUnresolved{e, `network filesystems are not on the input disks`})
+			continue
+		}
+		if hasOption(e.Options, `bind`) {
+			unresolved = append(unresolved, fstabUnresolved{e, `bind mounts are not supported`})
+			continue
+		}
+		p, reason := resolveFstabSpec(e.Spec, parts)
+		if reason != `` {
+			unresolved = append(unresolved, fstabUnresolved{e, reason})
+			continue
+		}
+		if p.Device() == root {
+			continue
+		}
+		mounts = append(mounts, fstabMount{Entry: e, Partition: p})
+	}
+	sort.Sort(mountsByDepth(mounts))
+	return mounts, unresolved
+}
+
+func resolveFstabSpec(spec string, parts []inputPartition) (inputPartition, string) {
+	match := func(f func(inputPartition) bool, what string) (inputPartition, string) {
+		for _, p := range parts {
+			if f(p) {
+				return p, ``
+			}
+		}
+		return inputPartition{}, `no partition with that ` + what + ` was found`
+	}
+	switch {
+	case strings.HasPrefix(spec, `UUID=`):
+		u := strings.ToLower(strings.Trim(spec[5:], `"`))
+		return match(func(p inputPartition) bool { return strings.ToLower(p.UUID) == u }, `UUID`)
+	case strings.HasPrefix(spec, `LABEL=`):
+		l := strings.Trim(spec[6:], `"`)
+		return match(func(p inputPartition) bool { return p.Label == l }, `label`)
+	case strings.HasPrefix(spec, `/dev/disk/by-uuid/`):
+		u := strings.ToLower(path.Base(spec))
+		return match(func(p inputPartition) bool { return strings.ToLower(p.UUID) == u }, `UUID`)
+	case strings.HasPrefix(spec, `/dev/disk/by-label/`):
+		l := path.Base(spec)
+		return match(func(p inputPartition) bool { return p.Label == l }, `label`)
+	case strings.HasPrefix(spec, `/dev/mapper/`), strings.HasPrefix(spec, `/dev/md`):
+		return inputPartition{}, `logical volumes and software RAID are not supported`
+	case strings.HasPrefix(spec, `/dev/`):
+		d, n, ok := parseBlockDevice(path.Base(spec))
+		if !ok {
+			return inputPartition{}, `the device name is not recognized`
+		}
+		return match(func(p inputPartition) bool { return p.Disk == d && p.Number == n }, `device name`)
+	}
+	return inputPartition{}, `the device specification is not supported`
+}
+
+// parseBlockDevice maps names such as sdb2, vda1 or xvda3 to a disk index and
+// partition number. Disks are attached to the packager in argument order.
+func parseBlockDevice(name string) (int, int, bool) {
+	for _, prefix := range []string{`xvd`, `sd`, `vd`, `hd`} {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := name[len(prefix):]
+		if len(rest) == 0 || rest[0] < 'a' || rest[0] > 'z' {
+			return 0, 0, false
+		}
+		d := int(rest[0] - 'a')
+		if len(rest) == 1 {
+			return d, 0, true
+		}
+		n, err := strconv.Atoi(rest[1:])
+		if err != nil {
+			return 0, 0, false
+		}
+		return d, n, true
+	}
+	return 0, 0, false
+}
+
+func hasOption(os []string, o string) bool {
+	for _, c := range os {
+		if c == o {
+			return true
+		}
+	}
+	return false
+}
+
+type mountsByDepth []fstabMount
+
+func (s mountsByDepth) Len() int      { return len(s) }
+func (s mountsByDepth) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s mountsByDepth) Less(i, j int) bool {
+	return strings.Count(path.Clean(s[i].Entry.File), `/`) < strings.Count(path.Clean(s[j].Entry.File), `/`)
+}
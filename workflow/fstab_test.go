@@ -0,0 +1,98 @@
+package workflow
+
+import (
+	"github.com/docker/v2c/disk"
+	"reflect"
+	"testing"
+)
+
+func TestParseFstab(t *testing.T) {
+	got := parseFstab([]byte(`# /etc/fstab: static file system information.
+UUID=0b6d1e7a-0f7a-4c4b-8a3e-5f1d2c3b4a59 /               ext4    errors=remount-ro 0       1
+  LABEL=data	/srv/my\040data  xfs defaults,noatime 0 2
+
+proc /proc proc
+/dev/sdb1 /opt
+# /dev/sdc1 /var ext4 defaults 0 2
+`))
+	wants := []fstabEntry{
+		{Spec: `UUID=0b6d1e7a-0f7a-4c4b-8a3e-5f1d2c3b4a59`, File: `/`, VFSType: `ext4`, Options: []string{`errors=remount-ro`}},
+		{Spec: `LABEL=data`, File: `/srv/my data`, VFSType: `xfs`, Options: []string{`defaults`, `noatime`}},
+		{Spec: `proc`, File: `/proc`, VFSType: `proc`},
+	}
+	if !reflect.DeepEqual(got, wants) {
+		t.Errorf("got %+v, want %+v", got, wants)
+	}
+}
+
+func TestResolveFstabSpec(t *testing.T) {
+	parts := []inputPartition{
+		{Partition: disk.Partition{Number: 1, UUID: `0B6D1E7A-0F7A-4C4B-8A3E-5F1D2C3B4A59`, Label: `root`}, Disk: 0},
+		{Partition: disk.Partition{Number: 2, UUID: `1c2d`, Label: `data`}, Disk: 0},
+		{Partition: disk.Partition{Number: 1, UUID: `3e4f`, Label: `logs`}, Disk: 1},
+		{Partition: disk.Partition{Number: 0, UUID: `5a6b`}, Disk: 2},
+	}
+	for _, c := range []struct {
+		spec   string
+		disk   int
+		number int
+		fails  bool
+	}{
+		{`UUID=0b6d1e7a-0f7a-4c4b-8a3e-5f1d2c3b4a59`, 0, 1, false},
+		{`UUID="1C2D"`, 0, 2, false},
+		{`UUID=9999`, 0, 0, true},
+		{`LABEL=logs`, 1, 1, false},
+		{`LABEL="data"`, 0, 2, false},
+		{`LABEL=Data`, 0, 0, true},
+		{`/dev/disk/by-uuid/3e4f`, 1, 1, false},
+		{`/dev/disk/by-label/root`, 0, 1, false},
+		{`/dev/disk/by-label/none`, 0, 0, true},
+		{`/dev/sda2`, 0, 2, false},
+		{`/dev/vdb1`, 1, 1, false},
+		{`/dev/xvdb1`, 1, 1, false},
+		{`/dev/hdc`, 2, 0, false},
+		{`/dev/sdb2`, 0, 0, true},
+		{`/dev/nvme0n1p1`, 0, 0, true},
+		{`/dev/mapper/vg-root`, 0, 0, true},
+		{`/dev/md0`, 0, 0, true},
+		{`PARTUUID=1234`, 0, 0, true},
+	} {
+		p, reason := resolveFstabSpec(c.spec, parts)
+		if c.fails {
+			if reason == `` {
+				t.Errorf("%v resolved to disk %v partition %v", c.spec, p.Disk, p.Number)
+			}
+			continue
+		}
+		if reason != `` || p.Disk != c.disk || p.Number != c.number {
+			t.Errorf("%v: got disk %v partition %v %q, want disk %v partition %v", c.spec, p.Disk, p.Number, reason, c.disk, c.number)
+		}
+	}
+}
+
+func TestParseBlockDevice(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		disk   int
+		number int
+		ok     bool
+	}{
+		{`sda`, 0, 0, true},
+		{`sda1`, 0, 1, true},
+		{`sdc12`, 2, 12, true},
+		{`vdb3`, 1, 3, true},
+		{`xvda1`, 0, 1, true},
+		{`xvdd`, 3, 0, true},
+		{`hdb2`, 1, 2, true},
+		{`sd`, 0, 0, false},
+		{`sd1`, 0, 0, false},
+		{`sdap`, 0, 0, false},
+		{`nvme0n1p1`, 0, 0, false},
+		{`loop0`, 0, 0, false},
+	} {
+		d, n, ok := parseBlockDevice(c.name)
+		if d != c.disk || n != c.number || ok != c.ok {
+			t.Errorf("%v: got %v %v %v, want %v %v %v", c.name, d, n, ok, c.disk, c.number, c.ok)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package workflow
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/v2c/disk"
+	"github.com/docker/v2c/system"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	path "path/filepath"
+	"strings"
+)
+
+// preparedInputs are the disks handed to the packager once compressed files
+// have been decompressed and appliances unwrapped. Tree is set instead when
+// the input is a directory or a tar archive of a root filesystem.
+type preparedInputs struct {
+	Disks   []string
+	Formats []string
+	Tree    string
+	work    string
+}
+
+// Cleanup removes any files made while preparing the inputs.
+func (p *preparedInputs) Cleanup() {
+	if p.work != `` {
+		os.RemoveAll(p.work)
+	}
+}
+
+// prepareInputs identifies the format of every target. Compressed inputs are
+// decompressed and OVA appliances are unpacked into a work directory, an OVA
+// contributes its disks in the order its descriptor lists them.
+func prepareInputs(targets []string) (*preparedInputs, error) {
+	p := &preparedInputs{}
+	for _, t := range targets {
+		tree, err := isTree(t)
+		if err != nil {
+			p.Cleanup()
+			return nil, err
+		}
+		if tree {
+			p.Tree = t
+			continue
+		}
+		if err := p.add(t, 0); err != nil {
+			p.Cleanup()
+			return nil, err
+		}
+	}
+	if p.Tree != `` && len(targets) > 1 {
+		p.Cleanup()
+		return nil, fmt.Errorf(`%v is a filesystem tree and cannot be combined with other inputs`, p.Tree)
+	}
+	return p, nil
+}
+
+// isTree reports whether fn is a directory or a tar archive, possibly
+// compressed, rather than a disk.
+func isTree(fn string) (bool, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return false, err
+	}
+	if fi.IsDir() {
+		return true, nil
+	}
+	f, err := disk.Sniff(fn)
+	if err != nil {
+		return false, err
+	}
+	switch f {
+	case disk.FormatTar:
+		return true, nil
+	case disk.FormatGzip, disk.FormatXz, disk.FormatZstd:
+		b, err := peekDecompressed(f, fn, 512)
+		if err != nil {
+			return false, fmt.Errorf(`Unable to decompress %v: %v`, fn, err)
+		}
+		return disk.IsTar(b), nil
+	}
+	return false, nil
+}
+
+// peekDecompressed returns the first n bytes of the decompressed contents of
+// fn.
+func peekDecompressed(f disk.Format, fn string, n int) ([]byte, error) {
+	r, err := openDecompressed(f, fn)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	n, _ = io.ReadFull(r, b)
+	// Only the start is needed, stop the tool rather than wait for the rest
+	r.stop()
+	return b[:n], nil
+}
+
+// decompressedReader reads the decompressed contents of a file.
+type decompressedReader struct {
+	io.Reader
+	f   *os.File
+	cmd *exec.Cmd
+}
+
+// openDecompressed opens fn, decompressing it if f is a compressed format.
+// gzip is handled natively, xz and zstd need their tools.
+func openDecompressed(f disk.Format, fn string) (*decompressedReader, error) {
+	if f == disk.FormatXz || f == disk.FormatZstd {
+		tool := string(f)
+		if _, err := exec.LookPath(tool); err != nil {
+			return nil, fmt.Errorf(`%v is needed to decompress %v input`, tool, f)
+		}
+		cmd := exec.Command(tool, `-dcq`, fn)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &decompressedReader{Reader: out, cmd: cmd}, nil
+	}
+
+	r, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	if f != disk.FormatGzip {
+		return &decompressedReader{Reader: r, f: r}, nil
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &decompressedReader{Reader: zr, f: r}, nil
+}
+
+// Close releases the file and reports whether the tool decompressing it
+// failed. It must only be called once everything has been read.
+func (r *decompressedReader) Close() error {
+	if r.cmd != nil {
+		return r.cmd.Wait()
+	}
+	if zr, ok := r.Reader.(*gzip.Reader); ok {
+		zr.Close()
+	}
+	return r.f.Close()
+}
+
+// stop abandons reading.
+func (r *decompressedReader) stop() {
+	if r.cmd != nil {
+		r.cmd.Process.Kill()
+	}
+	r.Close()
+}
+
+// populateFromTree copies a directory or tar archive into the transport
+// volume in place of a packager. Ownership, permissions and extended
+// attributes are kept.
+func populateFromTree(ctx context.Context, fn string) error {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+	var r io.ReadCloser
+	if fi.IsDir() {
+		fmt.Printf("Copying the filesystem tree at %v\n", fn)
+		r, err = archive.TarWithOptions(fn, &archive.TarOptions{})
+	} else {
+		fmt.Printf("Unpacking the filesystem archive %v\n", fn)
+		var f disk.Format
+		if f, err = disk.Sniff(fn); err == nil {
+			r, err = openDecompressed(f, fn)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return system.PopulateTransportVolume(ctx, ``, r)
+}
+
+func (p *preparedInputs) add(fn string, depth int) error {
+	if depth > 3 {
+		return fmt.Errorf(`%v is nested too deeply`, fn)
+	}
+	f, err := disk.Sniff(fn)
+	if err != nil {
+		return err
+	}
+	switch f {
+	case disk.FormatGzip, disk.FormatXz, disk.FormatZstd:
+		fmt.Printf("Decompressing %v input %v\n", f, fn)
+		out, err := p.workFile(strings.TrimSuffix(path.Base(fn), path.Ext(fn)))
+		if err != nil {
+			return err
+		}
+		if err = decompress(f, fn, out); err != nil {
+			return fmt.Errorf(`Unable to decompress %v: %v`, fn, err)
+		}
+		return p.add(out, depth+1)
+	case disk.FormatOVA:
+		fmt.Printf("Unpacking the disks of appliance %v\n", fn)
+		dir, err := p.workFile(path.Base(fn) + `.d`)
+		if err != nil {
+			return err
+		}
+		disks, err := unpackOVA(fn, dir)
+		if err != nil {
+			return fmt.Errorf(`Unable to unpack %v: %v`, fn, err)
+		}
+		for _, d := range disks {
+			if err = p.add(d, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	fmt.Printf("Input %v is a %v disk\n", fn, f)
+	p.Disks = append(p.Disks, fn)
+	p.Formats = appendUnique(p.Formats, string(f))
+	return nil
+}
+
+// workFile returns a fresh path in the work directory.
+func (p *preparedInputs) workFile(name string) (string, error) {
+	if p.work == `` {
+		w, err := ioutil.TempDir(``, `v2c-input`)
+		if err != nil {
+			return ``, err
+		}
+		p.work = w
+	}
+	fn := path.Join(p.work, name)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(fn); os.IsNotExist(err) {
+			return fn, nil
+		}
+		fn = path.Join(p.work, fmt.Sprintf(`%v.%v`, i, name))
+	}
+}
+
+// decompress writes the decompressed contents of fn to out.
+func decompress(f disk.Format, fn string, out string) error {
+	w, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	r, err := openDecompressed(f, fn)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		r.stop()
+		return err
+	}
+	return r.Close()
+}
+
+// ovfEnvelope holds the parts of an OVF descriptor that name disk files.
+type ovfEnvelope struct {
+	Files []struct {
+		ID   string `xml:"id,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"References>File"`
+	Disks []struct {
+		FileRef string `xml:"fileRef,attr"`
+	} `xml:"DiskSection>Disk"`
+}
+
+// unpackOVA extracts the disks an OVA's descriptor lists into dir.
+func unpackOVA(fn string, dir string) ([]string, error) {
+	var env ovfEnvelope
+	found := false
+	err := walkTar(fn, func(h *tar.Header, r io.Reader) error {
+		if found || !strings.HasSuffix(strings.ToLower(h.Name), `.ovf`) {
+			return nil
+		}
+		found = true
+		return xml.NewDecoder(r).Decode(&env)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf(`no OVF descriptor found`)
+	}
+
+	hrefs := map[string]string{}
+	for _, f := range env.Files {
+		hrefs[f.ID] = f.Href
+	}
+	wanted := map[string]string{}
+	order := []string{}
+	for _, d := range env.Disks {
+		h, ok := hrefs[d.FileRef]
+		if !ok {
+			return nil, fmt.Errorf(`disk file %v is not in the OVF references`, d.FileRef)
+		}
+		if path.Base(h) != h {
+			return nil, fmt.Errorf(`disk file %v is not in the appliance`, h)
+		}
+		wanted[h] = path.Join(dir, h)
+		order = append(order, h)
+	}
+	if len(order) == 0 {
+		return nil, fmt.Errorf(`the OVF descriptor lists no disks`)
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	err = walkTar(fn, func(h *tar.Header, r io.Reader) error {
+		out, ok := wanted[h.Name]
+		if !ok {
+			return nil
+		}
+		w, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		_, err = io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, h := range order {
+		if _, err := os.Stat(wanted[h]); err != nil {
+			return nil, fmt.Errorf(`disk file %v is missing from the appliance`, h)
+		}
+		result = append(result, wanted[h])
+	}
+	return result, nil
+}
+
+func walkTar(fn string, visit func(*tar.Header, io.Reader) error) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = visit(h, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func appendUnique(s []string, v string) []string {
+	for _, c := range s {
+		if c == v {
+			return s
+		}
+	}
+	return append(s, v)
+}
@@ -11,13 +11,25 @@ import (
 	"io/ioutil"
 	"os"
 	path "path/filepath"
+	"strings"
 )
 
 type manifest struct {
 	Provisioner api.Provisioner
 	TarballName string
+	Detective   string `json:",omitempty"`
+	InputName   string `json:",omitempty"`
 }
 
+// runMetadata is persisted beside the Dockerfile and describes the run that
+// produced the build context.
+type runMetadata struct {
+	Facts  *api.OSFacts    `json:",omitempty"`
+	Source *sourceMetadata `json:",omitempty"`
+}
+
+const runMetadataName = `v2c.json`
+
 type readableResults struct {
 	Provisioner api.Provisioner
 	Tarball     io.ReadCloser
@@ -91,6 +103,35 @@ func appendDockerfile(b *bytes.Buffer) error {
 	return nil
 }
 
+// addDockerignore appends the patterns the .dockerignore of the build
+// context does not list yet, in order.
+func addDockerignore(patterns ...string) error {
+	dn, p, err := cwdAndPerms()
+	if err != nil {
+		return err
+	}
+	fn := path.Join(dn, `.dockerignore`)
+	b, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listed := map[string]bool{}
+	lines := []string{}
+	for _, l := range strings.Split(string(b), "\n") {
+		if l = strings.TrimSpace(l); l != `` {
+			listed[l] = true
+			lines = append(lines, l)
+		}
+	}
+	for _, pattern := range patterns {
+		if !listed[pattern] {
+			listed[pattern] = true
+			lines = append(lines, pattern)
+		}
+	}
+	return ioutil.WriteFile(fn, []byte(strings.Join(lines, "\n")+"\n"), p)
+}
+
 func cwdAndPerms() (string, os.FileMode, error) {
 	d, err := os.Getwd()
 	if err != nil {
@@ -129,9 +170,17 @@ func persistProvisionerResults(r map[string][]provisionerResponse) (map[string][
 			tbn := fmt.Sprintf("%x.tar", h)
 			mn := fmt.Sprintf("%x.manifest", h)
 
+			// The detective material is kept so that the provisioner can be rerun
 			m := manifest{
 				Provisioner: pr.Provisioner,
 				TarballName: tbn,
+				Detective:   pr.Detective,
+			}
+			if pr.Input != nil {
+				m.InputName = fmt.Sprintf("%x.input", h)
+				if err = ioutil.WriteFile(path.Join(p, m.InputName), pr.Input, cwdPerm); err != nil {
+					return nil, err
+				}
 			}
 			mb, err := json.Marshal(m)
 			if err != nil {
@@ -148,3 +197,68 @@ func persistProvisionerResults(r map[string][]provisionerResponse) (map[string][
 	}
 	return manifests, nil
 }
+
+// loadManifests reads the manifests persisted in each category directory of
+// the build context.
+func loadManifests() (map[string][]manifest, error) {
+	d, _, err := cwdAndPerms()
+	if err != nil {
+		return nil, err
+	}
+	fns, err := path.Glob(path.Join(d, `*`, `*.manifest`))
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := map[string][]manifest{}
+	for _, fn := range fns {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		m := manifest{}
+		if err = json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf(`Malformed manifest %v: %v`, fn, err)
+		}
+		c := path.Base(path.Dir(fn))
+		manifests[c] = append(manifests[c], m)
+	}
+	return manifests, nil
+}
+
+// fetchInput returns the detective material persisted for m.
+func fetchInput(m manifest) ([]byte, error) {
+	dn, _, err := cwdAndPerms()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path.Join(dn, m.Provisioner.Category, m.InputName))
+}
+
+func persistRunMetadata(md runMetadata) error {
+	d, p, err := cwdAndPerms()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(md, ``, `  `)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(d, runMetadataName), b, p)
+}
+
+func loadRunMetadata() (runMetadata, error) {
+	md := runMetadata{}
+	d, _, err := cwdAndPerms()
+	if err != nil {
+		return md, err
+	}
+	b, err := ioutil.ReadFile(path.Join(d, runMetadataName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return md, fmt.Errorf(`The current working directory does not contain a v2c build context.`)
+		}
+		return md, err
+	}
+	return md, json.Unmarshal(b, &md)
+}
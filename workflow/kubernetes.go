@@ -0,0 +1,441 @@
+package workflow
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	path "path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// kubernetesDirName holds the manifests written with --emit k8s.
+	kubernetesDirName = `k8s`
+	// maxConfigMapFile and maxConfigMap keep captured configuration within
+	// what a ConfigMap holds comfortably.
+	maxConfigMapFile = 64 << 10
+	maxConfigMap     = 512 << 10
+	// defaultClaimSize is requested for each data volume.
+	defaultClaimSize = `1Gi`
+)
+
+var dnsLabelPattern = regexp.MustCompile(`[^a-z0-9-]+`)
+var configKeyPattern = regexp.MustCompile(`[^-._a-zA-Z0-9]+`)
+
+// keyMaterialDirs hold private keys, which are kept out of the ConfigMap.
+var keyMaterialDirs = []string{`/etc/ssl/private/`, `/etc/pki/tls/private/`, `/etc/pki/private/`}
+
+type k8sMeta struct {
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+type k8sObject struct {
+	APIVersion string            `yaml:"apiVersion,omitempty"`
+	Kind       string            `yaml:"kind,omitempty"`
+	Metadata   k8sMeta           `yaml:"metadata"`
+	Type       string            `yaml:"type,omitempty"`
+	Spec       interface{}       `yaml:"spec,omitempty"`
+	Data       map[string]string `yaml:"data,omitempty"`
+}
+
+type k8sWorkloadSpec struct {
+	Replicas             int            `yaml:"replicas"`
+	ServiceName          string         `yaml:"serviceName,omitempty"`
+	Selector             k8sSelector    `yaml:"selector"`
+	Template             k8sPodTemplate `yaml:"template"`
+	VolumeClaimTemplates []k8sObject    `yaml:"volumeClaimTemplates,omitempty"`
+}
+
+type k8sSelector struct {
+	MatchLabels map[string]string `yaml:"matchLabels"`
+}
+
+type k8sPodTemplate struct {
+	Metadata k8sMeta    `yaml:"metadata"`
+	Spec     k8sPodSpec `yaml:"spec"`
+}
+
+type k8sPodSpec struct {
+	Containers []k8sContainer `yaml:"containers"`
+	Volumes    []k8sVolume    `yaml:"volumes,omitempty"`
+}
+
+type k8sContainer struct {
+	Name         string           `yaml:"name"`
+	Image        string           `yaml:"image"`
+	Ports        []k8sPort        `yaml:"ports,omitempty"`
+	Env          []k8sEnv         `yaml:"env,omitempty"`
+	VolumeMounts []k8sVolumeMount `yaml:"volumeMounts,omitempty"`
+}
+
+type k8sPort struct {
+	Name          string `yaml:"name,omitempty"`
+	ContainerPort int    `yaml:"containerPort,omitempty"`
+	Port          int    `yaml:"port,omitempty"`
+	TargetPort    int    `yaml:"targetPort,omitempty"`
+	Protocol      string `yaml:"protocol"`
+}
+
+type k8sEnv struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+type k8sVolumeMount struct {
+	Name      string `yaml:"name"`
+	MountPath string `yaml:"mountPath"`
+	SubPath   string `yaml:"subPath,omitempty"`
+	ReadOnly  bool   `yaml:"readOnly,omitempty"`
+}
+
+type k8sVolume struct {
+	Name      string        `yaml:"name"`
+	ConfigMap *k8sConfigRef `yaml:"configMap,omitempty"`
+	Secret    *k8sSecretRef `yaml:"secret,omitempty"`
+}
+
+type k8sConfigRef struct {
+	Name string `yaml:"name"`
+}
+
+type k8sSecretRef struct {
+	SecretName  string `yaml:"secretName"`
+	DefaultMode int    `yaml:"defaultMode,omitempty"`
+}
+
+type k8sServiceSpec struct {
+	Selector map[string]string `yaml:"selector"`
+	Ports    []k8sPort         `yaml:"ports"`
+}
+
+type k8sClaimSpec struct {
+	AccessModes []string     `yaml:"accessModes"`
+	Resources   k8sResources `yaml:"resources"`
+}
+
+type k8sResources struct {
+	Requests map[string]string `yaml:"requests"`
+}
+
+// workloadShape is what the contributed Dockerfile fragments declare about
+// the running product.
+type workloadShape struct {
+	Ports   []string
+	Volumes []string
+	Env     [][2]string
+}
+
+// checkEmit rejects unknown outputs and outputs that need a tag when o has
+// none.
+func checkEmit(o Options) error {
+	for _, e := range o.Emit {
+		switch e {
+		case `k8s`:
+			if o.Tag == `` {
+				return errors.New(`--emit k8s needs the image --tag the manifests refer to`)
+			}
+		default:
+			return fmt.Errorf(`%v is not a known output, only k8s is supported`, e)
+		}
+	}
+	return nil
+}
+
+// emit writes the additional outputs o asks for.
+func emit(ms map[string][]manifest, o Options) error {
+	for _, e := range o.Emit {
+		if e == `k8s` {
+			if err := emitKubernetes(ms, o); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// inspectWorkload collects the EXPOSE, VOLUME and ENV instructions of the
+// results in ms, in category order. Since few provisioners expose ports, the
+// ports that captured service configuration listens on are added.
+func inspectWorkload(ms map[string][]manifest) (workloadShape, error) {
+	w := workloadShape{}
+	ports, volumes, env := map[string]bool{}, map[string]bool{}, map[string]int{}
+	for _, c := range categoryOrder {
+		for _, m := range ms[c] {
+			if c != `os` && c != `init` {
+				if err := inferPorts(m, ports); err != nil {
+					return w, err
+				}
+			}
+			if c == `data` {
+				vs, err := dataVolumes(m)
+				if err != nil {
+					return w, err
+				}
+				for _, v := range vs {
+					volumes[v] = true
+				}
+			}
+			df, err := fetchContributedDockerfile(m)
+			if err != nil {
+				return w, err
+			}
+			if len(df) == 0 {
+				continue
+			}
+			d := parser.Directive{}
+			if err = parser.SetEscapeToken(parser.DefaultEscapeToken, &d); err != nil {
+				return w, err
+			}
+			root, err := parser.Parse(bytes.NewReader(df), &d)
+			if err != nil {
+				return w, err
+			}
+			for _, child := range root.Children {
+				switch child.Value {
+				case `expose`:
+					for n := child.Next; n != nil; n = n.Next {
+						ports[normalPort(n.Value)] = true
+					}
+				case `volume`:
+					for n := child.Next; n != nil; n = n.Next {
+						volumes[path.Clean(`/`+n.Value)] = true
+					}
+				case `env`:
+					for n := child.Next; n != nil && n.Next != nil; n = n.Next.Next {
+						if i, ok := env[n.Value]; ok {
+							w.Env[i][1] = n.Next.Value
+							continue
+						}
+						env[n.Value] = len(w.Env)
+						w.Env = append(w.Env, [2]string{n.Value, n.Next.Value})
+					}
+				}
+			}
+		}
+	}
+	w.Ports, w.Volumes = sortedSet(ports), sortedSet(volumes)
+	return w, nil
+}
+
+// emitKubernetes writes manifests that run the product tagged o.Tag to the
+// k8s directory of the build context. A product with volumes runs as a
+// StatefulSet that claims them, others as a Deployment. Small text files of
+// the config category are offered as a ConfigMap mounted over the captured
+// files, private keys and password files as a Secret.
+func emitKubernetes(ms map[string][]manifest, o Options) error {
+	dn, perm, err := cwdAndPerms()
+	if err != nil {
+		return err
+	}
+	w, err := inspectWorkload(ms)
+	if err != nil {
+		return err
+	}
+	name := kubernetesName(imageName(o.Tag))
+	labels := map[string]string{`app`: name}
+
+	container := k8sContainer{Name: name, Image: o.Tag}
+	service := k8sServiceSpec{Selector: labels}
+	for _, p := range w.Ports {
+		number, proto := p, `TCP`
+		if i := strings.Index(p, `/`); i >= 0 {
+			number, proto = p[:i], strings.ToUpper(p[i+1:])
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			fmt.Printf("Skipping the exposed port %v, only single ports are supported.\n", p)
+			continue
+		}
+		pn := fmt.Sprintf(`%v-%v`, strings.ToLower(proto), n)
+		container.Ports = append(container.Ports, k8sPort{Name: pn, ContainerPort: n, Protocol: proto})
+		service.Ports = append(service.Ports, k8sPort{Name: pn, Port: n, TargetPort: n, Protocol: proto})
+	}
+	if len(service.Ports) == 0 {
+		fmt.Printf("No Service is written for %v: its results expose no ports and no captured Apache, Tomcat or MySQL configuration names one.\n", o.Tag)
+	}
+	for _, e := range w.Env {
+		container.Env = append(container.Env, k8sEnv{Name: e[0], Value: e[1]})
+	}
+
+	pod := k8sPodSpec{}
+	claims := []k8sObject{}
+	for _, v := range w.Volumes {
+		vn := kubernetesName(`data-` + strings.Trim(v, `/`))
+		container.VolumeMounts = append(container.VolumeMounts, k8sVolumeMount{Name: vn, MountPath: v})
+		claims = append(claims, k8sObject{
+			Metadata: k8sMeta{Name: vn},
+			Spec: k8sClaimSpec{
+				AccessModes: []string{`ReadWriteOnce`},
+				Resources:   k8sResources{Requests: map[string]string{`storage`: defaultClaimSize}},
+			},
+		})
+	}
+
+	objects := map[string]k8sObject{}
+	config, secrets, err := capturedConfig(ms[`config`])
+	if err != nil {
+		return err
+	}
+	if len(config) > 0 {
+		cm := name + `-config`
+		objects[`configmap.yaml`] = k8sObject{APIVersion: `v1`, Kind: `ConfigMap`, Metadata: k8sMeta{Name: cm, Labels: labels}, Data: map[string]string{}}
+		pod.Volumes = append(pod.Volumes, k8sVolume{Name: `config`, ConfigMap: &k8sConfigRef{Name: cm}})
+		used := map[string]bool{}
+		for _, p := range sortedKeys(config) {
+			key := configKey(p, used)
+			objects[`configmap.yaml`].Data[key] = config[p]
+			container.VolumeMounts = append(container.VolumeMounts, k8sVolumeMount{Name: `config`, MountPath: p, SubPath: key, ReadOnly: true})
+		}
+	}
+	if len(secrets) > 0 {
+		sn := name + `-secrets`
+		objects[`secret.yaml`] = k8sObject{APIVersion: `v1`, Kind: `Secret`, Metadata: k8sMeta{Name: sn, Labels: labels}, Type: `Opaque`, Data: map[string]string{}}
+		pod.Volumes = append(pod.Volumes, k8sVolume{Name: `secrets`, Secret: &k8sSecretRef{SecretName: sn, DefaultMode: 0400}})
+		used := map[string]bool{}
+		for _, p := range sortedKeys(secrets) {
+			key := configKey(p, used)
+			objects[`secret.yaml`].Data[key] = secrets[p]
+			container.VolumeMounts = append(container.VolumeMounts, k8sVolumeMount{Name: `secrets`, MountPath: p, SubPath: key, ReadOnly: true})
+		}
+		fmt.Printf("The keys and passwords captured in %v are in %v, keep it out of version control.\n", strings.Join(sortedKeys(secrets), `, `), path.Join(dn, kubernetesDirName, `secret.yaml`))
+	}
+	pod.Containers = []k8sContainer{container}
+
+	workload := k8sWorkloadSpec{
+		Replicas: 1,
+		Selector: k8sSelector{MatchLabels: labels},
+		Template: k8sPodTemplate{Metadata: k8sMeta{Name: name, Labels: labels}, Spec: pod},
+	}
+	if len(claims) > 0 {
+		workload.ServiceName = name
+		workload.VolumeClaimTemplates = claims
+		objects[`statefulset.yaml`] = k8sObject{APIVersion: `apps/v1`, Kind: `StatefulSet`, Metadata: k8sMeta{Name: name, Labels: labels}, Spec: workload}
+	} else {
+		objects[`deployment.yaml`] = k8sObject{APIVersion: `apps/v1`, Kind: `Deployment`, Metadata: k8sMeta{Name: name, Labels: labels}, Spec: workload}
+	}
+	if len(service.Ports) > 0 {
+		objects[`service.yaml`] = k8sObject{APIVersion: `v1`, Kind: `Service`, Metadata: k8sMeta{Name: name, Labels: labels}, Spec: service}
+	}
+
+	kd := path.Join(dn, kubernetesDirName)
+	if err = os.MkdirAll(kd, perm); err != nil {
+		return err
+	}
+	for fn, obj := range objects {
+		b, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(path.Join(kd, fn), b, perm); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Wrote Kubernetes manifests for %v to %v\n", o.Tag, kd)
+	return nil
+}
+
+// imageName returns the last path element of the repository of ref.
+func imageName(ref string) string {
+	if i := strings.LastIndex(ref, `:`); i > strings.LastIndex(ref, `/`) {
+		ref = ref[:i]
+	}
+	return path.Base(ref)
+}
+
+// kubernetesName turns s into a name Kubernetes accepts for any object.
+func kubernetesName(s string) string {
+	n := strings.Trim(dnsLabelPattern.ReplaceAllString(strings.ToLower(s), `-`), `-`)
+	if len(n) > 63 {
+		n = strings.Trim(n[:63], `-`)
+	}
+	if n == `` {
+		n = `v2c`
+	}
+	return n
+}
+
+// configKey turns the path p into a ConfigMap key that is not in used yet
+// and marks it used. Paths that only differ in characters a key cannot hold
+// are told apart by a digest of the path.
+func configKey(p string, used map[string]bool) string {
+	key := strings.Trim(configKeyPattern.ReplaceAllString(p, `-`), `-`)
+	if used[key] {
+		key = fmt.Sprintf(`%v-%x`, key, sha256.Sum256([]byte(p)))[:len(key)+9]
+	}
+	used[key] = true
+	return key
+}
+
+// capturedConfig maps the path of each small text file contributed in the
+// config category to its contents. Key material goes to the second map,
+// base64 encoded as a Secret holds it.
+func capturedConfig(ms []manifest) (map[string]string, map[string]string, error) {
+	dn, _, err := cwdAndPerms()
+	if err != nil {
+		return nil, nil, err
+	}
+	result, secrets := map[string]string{}, map[string]string{}
+	total := 0
+	for _, m := range ms {
+		err = walkTar(path.Join(dn, `config`, m.TarballName), func(h *tar.Header, rd io.Reader) error {
+			p := path.Clean(`/` + h.Name)
+			if p == `/Dockerfile` || h.Typeflag != tar.TypeReg || h.Size > maxConfigMapFile {
+				return nil
+			}
+			b, err := ioutil.ReadAll(rd)
+			if err != nil {
+				return err
+			}
+			if isKeyMaterial(p, b) {
+				delete(result, p)
+				secrets[p] = base64.StdEncoding.EncodeToString(b)
+				return nil
+			}
+			if !utf8.Valid(b) {
+				return nil
+			}
+			if total+len(b)-len(result[p]) > maxConfigMap {
+				fmt.Printf("Leaving %v out of the ConfigMap, it is full.\n", p)
+				return nil
+			}
+			total += len(b) - len(result[p])
+			result[p] = string(b)
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return result, secrets, nil
+}
+
+// isKeyMaterial reports whether the captured file p with contents b holds
+// private keys or password hashes.
+func isKeyMaterial(p string, b []byte) bool {
+	for _, d := range keyMaterialDirs {
+		if strings.HasPrefix(p, d) {
+			return true
+		}
+	}
+	switch path.Ext(p) {
+	case `.key`, `.p12`, `.pfx`, `.jks`, `.keystore`:
+		return true
+	}
+	switch path.Base(p) {
+	case `shadow`, `gshadow`, `.htpasswd`, `htpasswd`, `debian.cnf`:
+		return true
+	}
+	return bytes.Contains(b, []byte(`PRIVATE KEY-----`))
+}
@@ -0,0 +1,102 @@
+package workflow
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/v2c/api"
+	"github.com/docker/v2c/system"
+	"io/ioutil"
+	"os"
+	path "path/filepath"
+	"strings"
+)
+
+// snapshotView shows detectives the host directory abs read-only. The default
+// excludes, pseudo and network filesystems mounted below abs, the engine data
+// root and the excludes in o are hidden under empty tmpfs mounts.
+func snapshotView(ctx context.Context, abs string, o Options) (system.DetectiveView, error) {
+	mounts, err := ioutil.ReadFile(`/proc/mounts`)
+	if err != nil {
+		return system.DetectiveView{}, fmt.Errorf(`Unable to read the mounts of this host: %v`, err)
+	}
+	user := append([]string{}, o.Excludes...)
+	dataRoot, err := system.DockerRootDir(ctx)
+	if err != nil {
+		return system.DetectiveView{}, err
+	}
+	if p, ok := rebase(dataRoot, abs); ok {
+		if p == `/` {
+			return system.DetectiveView{}, fmt.Errorf(`%v is the Docker data root`, abs)
+		}
+		user = append(user, p)
+	}
+
+	asked := map[string]bool{}
+	for _, e := range o.Excludes {
+		asked[path.Clean(`/`+e)] = true
+	}
+
+	v := system.DetectiveView{Root: abs}
+	for _, e := range hostExcludes(mounts, abs, user) {
+		fi, err := os.Lstat(path.Join(abs, e))
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return system.DetectiveView{}, err
+		case !fi.IsDir() && asked[e]:
+			// Detectives would read what the user meant to keep from them
+			return system.DetectiveView{}, fmt.Errorf(`Unable to exclude %v, only directories can be excluded from a local build.`, e)
+		case fi.Mode()&os.ModeSymlink != 0:
+			// The target is hidden or visible on its own
+		case !fi.IsDir():
+			fmt.Printf("Unable to hide %v, only directories can be excluded.\n", e)
+		default:
+			v.Hidden = append(v.Hidden, e)
+		}
+	}
+	fmt.Printf("Snapshotting %v read-only without %v\n", abs, strings.Join(v.Hidden, `, `))
+	return v, nil
+}
+
+// hiddenDisk is the host directory built-in detectives read in a local build.
+// Like the tmpfs mounts that cover them for detective containers, hidden
+// directories read as empty.
+type hiddenDisk struct {
+	api.DirDisk
+	hidden []string
+}
+
+// below reports whether name lies inside one of the hidden directories.
+func (d hiddenDisk) below(name string) bool {
+	name = path.Clean(`/` + name)
+	for _, h := range d.hidden {
+		if strings.HasPrefix(name, strings.TrimSuffix(h, `/`)+`/`) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lstat returns the mode of name unless it is hidden.
+func (d hiddenDisk) Lstat(name string) (os.FileMode, error) {
+	if d.below(name) {
+		return 0, &os.PathError{Op: `lstat`, Path: name, Err: os.ErrNotExist}
+	}
+	return d.DirDisk.Lstat(name)
+}
+
+// Readlink returns the target of the symbolic link name unless it is hidden.
+func (d hiddenDisk) Readlink(name string) (string, error) {
+	if d.below(name) {
+		return ``, &os.PathError{Op: `readlink`, Path: name, Err: os.ErrNotExist}
+	}
+	return d.DirDisk.Readlink(name)
+}
+
+// ReadFile returns the contents of the file name unless it is hidden.
+func (d hiddenDisk) ReadFile(name string) ([]byte, error) {
+	if d.below(name) {
+		return nil, &os.PathError{Op: `open`, Path: name, Err: os.ErrNotExist}
+	}
+	return d.DirDisk.ReadFile(name)
+}
@@ -0,0 +1,58 @@
+package workflow
+
+import (
+	"github.com/docker/v2c/api"
+	"io/ioutil"
+	"os"
+	path "path/filepath"
+	"testing"
+)
+
+func TestHiddenDisk(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `v2c-local`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{`etc/secret`, `etc/secrets`} {
+		if err = os.MkdirAll(path.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{`etc/secret/shadow`, `etc/secrets/visible`, `etc/hostname`} {
+		if err = ioutil.WriteFile(path.Join(dir, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Symlink(`secret/shadow`, path.Join(dir, `etc/shadow`)); err != nil {
+		t.Fatal(err)
+	}
+
+	d := hiddenDisk{DirDisk: api.DirDisk(dir), hidden: []string{`/etc/secret`}}
+	for _, c := range []struct {
+		name   string
+		hidden bool
+	}{
+		{`/etc/hostname`, false},
+		{`/etc/secrets/visible`, false},
+		{`/etc/secret/shadow`, true},
+		{`etc/secret/../secret/shadow`, true},
+		{`/etc/shadow`, true},
+	} {
+		resolved, err := api.ResolvePath(d, c.name)
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		_, err = d.ReadFile(resolved)
+		if c.hidden && !os.IsNotExist(err) {
+			t.Errorf("%v: read although it is hidden: %v", c.name, err)
+		}
+		if !c.hidden && err != nil {
+			t.Errorf("%v: %v", c.name, err)
+		}
+	}
+	if m, err := d.Lstat(`/etc/secret`); err != nil || !m.IsDir() {
+		t.Errorf("the hidden directory itself is %v, %v", m, err)
+	}
+}
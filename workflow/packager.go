@@ -0,0 +1,132 @@
+package workflow
+
+import (
+	"fmt"
+	"github.com/docker/v2c/api"
+	"strings"
+)
+
+// LookupPackager finds a packager by REPOSITORY:TAG, builtin:NAME or image ID.
+func LookupPackager(ps []api.Packager, ref string) (api.Packager, bool) {
+	for _, p := range ps {
+		if ref == p.Repository+`:`+p.Tag || (p.ImageID != `` && strings.HasPrefix(strings.TrimPrefix(p.ImageID, `sha256:`), strings.TrimPrefix(ref, `sha256:`))) {
+			return p, true
+		}
+	}
+	return api.Packager{}, false
+}
+
+// choosePackager picks the packager for inputs in the given formats holding
+// the given filesystems. Packagers that read all of them are ranked by
+// preferred and otherwise taken in the order they were listed. Packagers
+// that declare no formats are only tried when no packager qualifies. The
+// choice and the packagers passed over are explained in the output.
+func choosePackager(ps []api.Packager, formats []string, filesystems []string, o Options) (api.Packager, error) {
+	if o.Packager != `` {
+		p, ok := LookupPackager(ps, o.Packager)
+		if !ok {
+			return p, fmt.Errorf(`No installed packager named %v`, o.Packager)
+		}
+		if why := unsuitable(p, formats, filesystems); why != `` {
+			fmt.Printf("Warning: packager %v:%v %v\n", p.Repository, p.Tag, why)
+		}
+		fmt.Printf("Using packager %v:%v as requested.\n", p.Repository, p.Tag)
+		return p, nil
+	}
+
+	var best, undeclared *api.Packager
+	for i, p := range ps {
+		if len(p.Formats) == 0 {
+			fmt.Printf("Passing over packager %v:%v: it does not declare the formats it reads\n", p.Repository, p.Tag)
+			if undeclared == nil {
+				undeclared = &ps[i]
+			}
+			continue
+		}
+		if why := unsuitable(p, formats, filesystems); why != `` {
+			fmt.Printf("Passing over packager %v:%v: it %v\n", p.Repository, p.Tag, why)
+			continue
+		}
+		if best == nil || preferred(p, *best) {
+			best = &ps[i]
+		}
+	}
+
+	switch {
+	case best != nil:
+		fmt.Printf("Using packager %v:%v: it reads %v disks", best.Repository, best.Tag, strings.Join(formats, ` and `))
+		if len(filesystems) > 0 {
+			fmt.Printf(" with %v filesystems", strings.Join(filesystems, ` and `))
+		}
+		if best.Privileged {
+			fmt.Println(` and runs privileged because no unprivileged packager qualifies.`)
+		} else {
+			fmt.Println(` without privileges.`)
+		}
+		return *best, nil
+	case undeclared != nil:
+		fmt.Printf("Using packager %v:%v: no packager declares support for %v disks, so it is tried anyway.\n", undeclared.Repository, undeclared.Tag, strings.Join(formats, ` and `))
+		return *undeclared, nil
+	}
+	return api.Packager{}, fmt.Errorf(`No installed packager reads %v disks. Use --packager to choose one.`, strings.Join(formats, ` and `))
+}
+
+// preferred reports whether the qualifying packager p ranks above q.
+// Unprivileged packagers come first, then those declaring the fewest
+// filesystems, since they are built for the disks at hand. A packager that
+// declares no filesystems ranks last among equals.
+func preferred(p api.Packager, q api.Packager) bool {
+	if p.Privileged != q.Privileged {
+		return !p.Privileged
+	}
+	pn, qn := len(p.Filesystems), len(q.Filesystems)
+	if pn == 0 || qn == 0 {
+		return pn != 0 && qn == 0
+	}
+	return pn < qn
+}
+
+// unsuitable explains why p cannot unpack the inputs, or returns nothing.
+// Packagers that declare no filesystems are assumed to read them all.
+func unsuitable(p api.Packager, formats []string, filesystems []string) string {
+	if missing := missingFrom(p.Formats, formats); len(missing) > 0 {
+		return fmt.Sprintf(`does not read %v disks`, strings.Join(missing, ` and `))
+	}
+	if len(p.Filesystems) == 0 {
+		return ``
+	}
+	if missing := missingFrom(p.Filesystems, filesystems); len(missing) > 0 {
+		return fmt.Sprintf(`does not read %v filesystems`, strings.Join(missing, ` and `))
+	}
+	return ``
+}
+
+func missingFrom(have []string, want []string) []string {
+	result := []string{}
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, w)
+		}
+	}
+	return result
+}
+
+// linuxFilesystems lists the filesystems of the partitions a packager may be
+// asked to unpack. LVM physical volumes count, since the root or the
+// filesystems it mounts may be logical volumes on them.
+func linuxFilesystems(parts []inputPartition) []string {
+	result := []string{}
+	for _, p := range parts {
+		if p.Linux() || p.Filesystem == `LVM2_member` {
+			result = appendUnique(result, p.Filesystem)
+		}
+	}
+	return result
+}
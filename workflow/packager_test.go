@@ -0,0 +1,87 @@
+package workflow
+
+import (
+	"github.com/docker/v2c/api"
+	"testing"
+)
+
+func TestChoosePackager(t *testing.T) {
+	raw := api.Packager{Repository: `raw`, Tag: `1`, Formats: []string{`raw`}}
+	vmdk := api.Packager{Repository: `vmdk`, Tag: `1`, Formats: []string{`raw`, `vmdk`}, Filesystems: []string{`ext4`}}
+	privileged := api.Packager{Repository: `privileged`, Tag: `1`, Formats: []string{`raw`, `vmdk`}, Filesystems: []string{`ext4`, `xfs`}, Privileged: true}
+	xfs := api.Packager{Repository: `xfs`, Tag: `1`, Formats: []string{`raw`, `vmdk`}, Filesystems: []string{`ext4`, `xfs`}}
+	legacy := api.Packager{Repository: `legacy`, Tag: `1`}
+	for _, c := range []struct {
+		name        string
+		ps          []api.Packager
+		formats     []string
+		filesystems []string
+		o           Options
+		wants       string
+		fails       bool
+	}{
+		{`only one reads the format`, []api.Packager{raw, vmdk}, []string{`vmdk`}, nil, Options{}, `vmdk`, false},
+		{`no filesystems declared ranks last`, []api.Packager{raw, vmdk}, []string{`raw`}, []string{`ext4`}, Options{}, `vmdk`, false},
+		{`unprivileged first`, []api.Packager{privileged, xfs}, []string{`vmdk`}, []string{`xfs`}, Options{}, `xfs`, false},
+		{`privileged when nothing else qualifies`, []api.Packager{vmdk, privileged}, []string{`vmdk`}, []string{`xfs`}, Options{}, `privileged`, false},
+		{`fewest filesystems`, []api.Packager{xfs, vmdk}, []string{`vmdk`}, []string{`ext4`}, Options{}, `vmdk`, false},
+		{`listed order among equals`, []api.Packager{vmdk, {Repository: `other`, Tag: `1`, Formats: []string{`vmdk`}, Filesystems: []string{`ext4`}}}, []string{`vmdk`}, nil, Options{}, `vmdk`, false},
+		{`undeclared formats as a fallback`, []api.Packager{legacy, raw}, []string{`qcow2`}, nil, Options{}, `legacy`, false},
+		{`undeclared formats passed over`, []api.Packager{legacy, raw}, []string{`raw`}, nil, Options{}, `raw`, false},
+		{`nothing qualifies`, []api.Packager{raw, vmdk}, []string{`qcow2`}, nil, Options{}, ``, true},
+		{`requested`, []api.Packager{raw, vmdk}, []string{`vmdk`}, nil, Options{Packager: `raw:1`}, `raw`, false},
+		{`requested but missing`, []api.Packager{raw}, []string{`raw`}, nil, Options{Packager: `vmdk:1`}, ``, true},
+	} {
+		p, err := choosePackager(c.ps, c.formats, c.filesystems, c.o)
+		if (err != nil) != c.fails {
+			t.Errorf("%v: got error %v", c.name, err)
+			continue
+		}
+		if p.Repository != c.wants {
+			t.Errorf("%v: got %v, want %v", c.name, p.Repository, c.wants)
+		}
+	}
+}
+
+func TestPreferred(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		p, q  api.Packager
+		wants bool
+	}{
+		{`unprivileged over privileged`, api.Packager{Filesystems: []string{`ext4`, `xfs`}}, api.Packager{Filesystems: []string{`ext4`}, Privileged: true}, true},
+		{`privileged under unprivileged`, api.Packager{Privileged: true}, api.Packager{}, false},
+		{`fewer filesystems`, api.Packager{Filesystems: []string{`ext4`}}, api.Packager{Filesystems: []string{`ext4`, `xfs`}}, true},
+		{`more filesystems`, api.Packager{Filesystems: []string{`ext4`, `xfs`}}, api.Packager{Filesystems: []string{`ext4`}}, false},
+		{`equal`, api.Packager{Filesystems: []string{`ext4`}}, api.Packager{Filesystems: []string{`xfs`}}, false},
+		{`declared over undeclared`, api.Packager{Filesystems: []string{`ext4`, `xfs`}}, api.Packager{}, true},
+		{`undeclared under declared`, api.Packager{}, api.Packager{Filesystems: []string{`ext4`}}, false},
+		{`both undeclared`, api.Packager{}, api.Packager{}, false},
+	} {
+		if got := preferred(c.p, c.q); got != c.wants {
+			t.Errorf("%v: got %v, want %v", c.name, got, c.wants)
+		}
+	}
+}
+
+func TestUnsuitable(t *testing.T) {
+	p := api.Packager{Formats: []string{`raw`, `vmdk`}, Filesystems: []string{`ext4`, `LVM2_member`}}
+	for _, c := range []struct {
+		name        string
+		p           api.Packager
+		formats     []string
+		filesystems []string
+		wants       string
+	}{
+		{`suitable`, p, []string{`vmdk`}, []string{`ext4`, `LVM2_member`}, ``},
+		{`no filesystems detected`, p, []string{`raw`}, nil, ``},
+		{`missing formats`, p, []string{`qcow2`, `vmdk`, `vhdx`}, nil, `does not read qcow2 and vhdx disks`},
+		{`missing filesystems`, p, []string{`raw`}, []string{`xfs`, `ext4`, `btrfs`}, `does not read xfs and btrfs filesystems`},
+		{`formats before filesystems`, p, []string{`qcow2`}, []string{`xfs`}, `does not read qcow2 disks`},
+		{`filesystems undeclared`, api.Packager{Formats: []string{`raw`}}, []string{`raw`}, []string{`xfs`}, ``},
+	} {
+		if got := unsuitable(c.p, c.formats, c.filesystems); got != c.wants {
+			t.Errorf("%v: got %q, want %q", c.name, got, c.wants)
+		}
+	}
+}
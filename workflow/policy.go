@@ -0,0 +1,131 @@
+package workflow
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/v2c/system"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// Policy constrains the base images that os provisioners may contribute.
+// References are first rewritten, then moved under Registry and checked
+// against Approved. Once the image is available they are pinned to a digest.
+type Policy struct {
+	// Rewrite replaces a contributed reference such as ubuntu:16.04 outright.
+	Rewrite map[string]string `yaml:"rewrite"`
+
+	// Registry is the prefix every base image must live under. References
+	// without a registry hostname are moved under it. References naming any
+	// other registry are rejected.
+	Registry string `yaml:"registry"`
+
+	// PinDigest requires a digest. Tagged references are pinned using the
+	// digest of the image in the local engine.
+	PinDigest bool `yaml:"pin_digest"`
+
+	// Approved lists the references that may be used, after rewriting. Entries
+	// are glob patterns matched against the reference without its digest.
+	Approved []string `yaml:"approved"`
+}
+
+func LoadPolicy(fn string) (*Policy, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err = yaml.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf(`Unable to parse the base image policy in %v: %v`, fn, err)
+	}
+	p.Registry = strings.TrimSuffix(p.Registry, `/`)
+	for _, a := range p.Approved {
+		if _, err = path.Match(a, ``); err != nil {
+			return nil, fmt.Errorf(`Malformed approved base image pattern %v in %v`, a, fn)
+		}
+	}
+	return p, nil
+}
+
+// Apply returns the reference that should be used in place of ref, before
+// it is pinned. A nil policy accepts every reference.
+func (p *Policy) Apply(ref string) (string, error) {
+	if p == nil {
+		return ref, nil
+	}
+	if r, ok := p.Rewrite[ref]; ok {
+		ref = r
+	}
+
+	parsed, err := reference.Parse(ref)
+	if err != nil {
+		return ``, fmt.Errorf(`%v is not a valid image reference`, ref)
+	}
+	named, ok := parsed.(reference.Named)
+	if !ok {
+		return ``, fmt.Errorf(`%v does not name a repository`, ref)
+	}
+	name := named.Name()
+	tag, digest := ``, ``
+	if t, ok := parsed.(reference.Tagged); ok {
+		tag = t.Tag()
+	}
+	if d, ok := parsed.(reference.Digested); ok {
+		digest = d.Digest().String()
+	}
+	if tag == `` && digest == `` {
+		tag = `latest`
+	}
+
+	if p.Registry != `` && !strings.HasPrefix(name, p.Registry+`/`) {
+		if host, _ := reference.SplitHostname(named); host != `` {
+			return ``, fmt.Errorf(`%v is not in the approved registry %v`, ref, p.Registry)
+		}
+		name = p.Registry + `/` + name
+	}
+
+	ref = name
+	if tag != `` {
+		ref = ref + `:` + tag
+	}
+	if len(p.Approved) > 0 && !p.approved(ref) {
+		return ``, fmt.Errorf(`%v is not an approved base image`, ref)
+	}
+	if digest != `` {
+		ref = name + `@` + digest
+	}
+	return ref, nil
+}
+
+// Pin returns ref pinned to the digest of the image in the local engine when
+// the policy requires a digest. Images that were loaded rather than pulled
+// have no registry digest and are pinned to their image ID instead.
+func (p *Policy) Pin(ctx context.Context, ref string) (string, error) {
+	if p == nil || !p.PinDigest || strings.Contains(ref, `@`) {
+		return ref, nil
+	}
+	ok, id, rds, err := system.LocalImage(ctx, ref)
+	if err != nil {
+		return ``, err
+	}
+	if !ok {
+		return ``, fmt.Errorf(`%v cannot be pinned to a digest: it is not present in the local engine`, ref)
+	}
+	if pinned := system.PinnedReference(ref, rds); pinned != `` {
+		return pinned, nil
+	}
+	fmt.Printf("The base image %v has no registry digest, it is pinned to its image ID %v\n", ref, id)
+	return id, nil
+}
+
+func (p *Policy) approved(ref string) bool {
+	for _, a := range p.Approved {
+		if ok, _ := path.Match(a, ref); ok {
+			return true
+		}
+	}
+	return false
+}
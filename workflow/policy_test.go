@@ -0,0 +1,38 @@
+package workflow
+
+import (
+	"testing"
+)
+
+func TestPolicyApply(t *testing.T) {
+	const digest = `sha256:0000000000000000000000000000000000000000000000000000000000000001`
+	for _, c := range []struct {
+		name   string
+		p      *Policy
+		ref    string
+		wants  string
+		errors bool
+	}{
+		{`no policy`, nil, `ubuntu:16.04`, `ubuntu:16.04`, false},
+		{`empty policy`, &Policy{}, `ubuntu`, `ubuntu:latest`, false},
+		{`rewrite`, &Policy{Rewrite: map[string]string{`ubuntu:16.04`: `example.com/os/ubuntu:16.04`}}, `ubuntu:16.04`, `example.com/os/ubuntu:16.04`, false},
+		{`moved under the registry`, &Policy{Registry: `registry.example.com/mirror`}, `centos:7`, `registry.example.com/mirror/centos:7`, false},
+		{`already in the registry`, &Policy{Registry: `registry.example.com`}, `registry.example.com/centos:7`, `registry.example.com/centos:7`, false},
+		{`another registry`, &Policy{Registry: `registry.example.com`}, `quay.io/centos/centos:7`, ``, true},
+		{`approved`, &Policy{Approved: []string{`ubuntu:*`}}, `ubuntu:16.04`, `ubuntu:16.04`, false},
+		{`not approved`, &Policy{Approved: []string{`ubuntu:*`}}, `debian:9`, ``, true},
+		{`approved after rewriting`, &Policy{Rewrite: map[string]string{`debian:9`: `ubuntu:16.04`}, Approved: []string{`ubuntu:16.04`}}, `debian:9`, `ubuntu:16.04`, false},
+		{`digest kept`, &Policy{Approved: []string{`ubuntu:16.04`}}, `ubuntu:16.04@` + digest, `ubuntu@` + digest, false},
+		{`digest approved by name`, &Policy{Approved: []string{`ubuntu`}}, `ubuntu@` + digest, `ubuntu@` + digest, false},
+		{`invalid`, &Policy{}, `Ubuntu:16.04`, ``, true},
+	} {
+		got, err := c.p.Apply(c.ref)
+		if (err != nil) != c.errors {
+			t.Errorf("%v: got error %v", c.name, err)
+			continue
+		}
+		if got != c.wants {
+			t.Errorf("%v: got %v, want %v", c.name, got, c.wants)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package workflow
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	path "path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultMySQLPort is where a MySQL server listens when its configuration
+// names no port.
+const defaultMySQLPort = `3306`
+
+var (
+	apacheListenPattern    = regexp.MustCompile(`(?mi)^[ \t]*Listen[ \t]+(?:\S*:)?([0-9]+)\b`)
+	xmlCommentPattern      = regexp.MustCompile(`(?s)<!--.*?-->`)
+	tomcatConnectorPattern = regexp.MustCompile(`(?s)<Connector\b[^>]*?\bport\s*=\s*"([0-9]+)"`)
+)
+
+// normalPort writes the EXPOSE value p the way ports are compared, without
+// the default tcp protocol.
+func normalPort(p string) string {
+	p = strings.ToLower(p)
+	return strings.TrimSuffix(p, `/tcp`)
+}
+
+// configuredPorts finds the ports that the service configuration captured in
+// the tarball fn listens on, each mapped to the file that declares it. Apache
+// httpd Listen directives, Tomcat connectors and the port of a MySQL server
+// are understood.
+func configuredPorts(fn string) (map[string]string, error) {
+	result := map[string]string{}
+	mysql, mysqlPort := ``, ``
+	err := walkTar(fn, func(h *tar.Header, rd io.Reader) error {
+		p := path.Clean(`/` + h.Name)
+		if h.Typeflag != tar.TypeReg || h.Size > maxConfigMapFile || !listenerConfig(p) {
+			return nil
+		}
+		b, err := ioutil.ReadAll(rd)
+		if err != nil {
+			return err
+		}
+		if isMySQLConfig(p) {
+			port, server := mysqlServerPort(b)
+			if server && mysql == `` {
+				mysql = p
+			}
+			if port != `` {
+				mysql, mysqlPort = p, port
+			}
+			return nil
+		}
+		for _, port := range listenPorts(p, b) {
+			if _, ok := result[port]; !ok {
+				result[port] = p
+			}
+		}
+		return nil
+	})
+	if mysql != `` {
+		if mysqlPort == `` {
+			mysqlPort = defaultMySQLPort
+		}
+		if _, ok := result[mysqlPort]; !ok {
+			result[mysqlPort] = mysql
+		}
+	}
+	return result, err
+}
+
+// listenerConfig reports whether p is a configuration file configuredPorts
+// reads.
+func listenerConfig(p string) bool {
+	switch {
+	case isMySQLConfig(p):
+		return true
+	case path.Base(p) == `server.xml`:
+		return true
+	case strings.HasSuffix(p, `.conf`):
+		return strings.Contains(p, `/apache2/`) || strings.Contains(p, `/httpd/`)
+	}
+	return false
+}
+
+func isMySQLConfig(p string) bool {
+	return path.Base(p) == `my.cnf` || (strings.HasSuffix(p, `.cnf`) && strings.Contains(p, `/mysql/`))
+}
+
+// listenPorts returns the ports declared by the Apache httpd configuration
+// file or Tomcat server.xml p with contents b.
+func listenPorts(p string, b []byte) []string {
+	pattern := apacheListenPattern
+	if path.Base(p) == `server.xml` {
+		pattern = tomcatConnectorPattern
+		b = xmlCommentPattern.ReplaceAll(b, nil)
+	}
+	result := []string{}
+	for _, m := range pattern.FindAllSubmatch(b, -1) {
+		if n, err := strconv.Atoi(string(m[1])); err == nil && n > 0 && n < 65536 {
+			result = appendUnique(result, strconv.Itoa(n))
+		}
+	}
+	return result
+}
+
+// mysqlServerPort returns the port set in the server sections of the MySQL
+// option file b and whether it has any server section.
+func mysqlServerPort(b []byte) (string, bool) {
+	port, server, inServer := ``, false, false
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, `[`) && strings.HasSuffix(line, `]`) {
+			section := strings.ToLower(strings.Trim(line, `[] `))
+			inServer = section == `mysqld` || section == `server` || section == `mariadb` || strings.HasPrefix(section, `mysqld-`)
+			server = server || inServer
+			continue
+		}
+		if !inServer {
+			continue
+		}
+		i := strings.Index(line, `=`)
+		if i < 0 || strings.TrimSpace(line[:i]) != `port` {
+			continue
+		}
+		v := strings.Trim(strings.TrimSpace(line[i+1:]), `"'`)
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n < 65536 {
+			port = strconv.Itoa(n)
+		}
+	}
+	return port, server
+}
+
+// inferPorts adds the ports that the configuration captured by m listens on
+// to ports and tells where they were found.
+func inferPorts(m manifest, ports map[string]bool) error {
+	if m.TarballName == `` {
+		return nil
+	}
+	dn, _, err := cwdAndPerms()
+	if err != nil {
+		return err
+	}
+	found, err := configuredPorts(path.Join(dn, m.Provisioner.Category, m.TarballName))
+	if err != nil {
+		return err
+	}
+	for _, port := range sortedKeys(found) {
+		if !ports[port] {
+			fmt.Printf("Exposing port %v, it is configured in %v\n", port, found[port])
+			ports[port] = true
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	set := map[string]bool{}
+	for k := range m {
+		set[k] = true
+	}
+	return sortedSet(set)
+}
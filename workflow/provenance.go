@@ -0,0 +1,414 @@
+package workflow
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/v2c/system"
+	"io"
+	"io/ioutil"
+	"os"
+	path "path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// provenanceName is the provenance file in the build context.
+	provenanceName = `provenance.json`
+	// provenanceImagePath is where products carry their provenance.
+	provenanceImagePath = `/.v2c/provenance.json`
+	// deltaTarballName holds the files that changed since a previous product.
+	deltaTarballName = `delta.tar`
+)
+
+// categoryOrder is the order categories are assembled in.
+var categoryOrder = []string{`os`, `application`, `config`, `data`, `init`}
+
+// provenance records what each provisioner contributed to a product, so
+// that a later run can build only what changed.
+type provenance struct {
+	Contributions []contribution
+}
+
+// contribution is the record of one provisioner result.
+type contribution struct {
+	Category     string
+	Provisioner  string
+	ImageID      string `json:",omitempty"`
+	Detective    string `json:",omitempty"`
+	Input        string `json:",omitempty"`
+	Files        map[string]string
+	Instructions []string
+}
+
+func (c contribution) same(o contribution) bool {
+	return c.Category == o.Category && c.Provisioner == o.Provisioner
+}
+
+// files maps every path contributed to the digest of its final version.
+func (p provenance) files() map[string]string {
+	result := map[string]string{}
+	for _, c := range p.Contributions {
+		for f, d := range c.Files {
+			result[f] = d
+		}
+	}
+	return result
+}
+
+// instructions returns the contributed instructions outside the os category.
+func (p provenance) instructions() map[string]bool {
+	result := map[string]bool{}
+	for _, c := range p.Contributions {
+		if c.Category == `os` {
+			continue
+		}
+		for _, i := range c.Instructions {
+			result[i] = true
+		}
+	}
+	return result
+}
+
+// base returns the instructions of the os category.
+func (p provenance) base() string {
+	result := []string{}
+	for _, c := range p.Contributions {
+		if c.Category == `os` {
+			result = append(result, c.Instructions...)
+		}
+	}
+	return strings.Join(result, `; `)
+}
+
+// buildProvenance records the results persisted in the build context.
+func buildProvenance(ms map[string][]manifest) (provenance, error) {
+	dn, _, err := cwdAndPerms()
+	if err != nil {
+		return provenance{}, err
+	}
+	p := provenance{Contributions: []contribution{}}
+	for _, c := range categoryOrder {
+		for _, m := range ms[c] {
+			r := contribution{
+				Category:    c,
+				Provisioner: fmt.Sprintf(`%v:%v`, m.Provisioner.Repository, m.Provisioner.Tag),
+				ImageID:     m.Provisioner.ImageID,
+				Detective:   m.Detective,
+				Files:       map[string]string{},
+			}
+			if m.InputName != `` {
+				in, err := fetchInput(m)
+				if err != nil {
+					return provenance{}, err
+				}
+				r.Input = fmt.Sprintf(`sha256:%x`, sha256.Sum256(in))
+			}
+			if m.TarballName != `` {
+				err = walkTar(path.Join(dn, c, imageTarball(c, m)), func(h *tar.Header, rd io.Reader) error {
+					sum := sha256.New()
+					hashHeader(sum, h)
+					if _, err := io.Copy(sum, rd); err != nil {
+						return err
+					}
+					r.Files[path.Clean(`/`+h.Name)] = fmt.Sprintf(`sha256:%x`, sum.Sum(nil))
+					return nil
+				})
+				if err != nil {
+					return provenance{}, err
+				}
+			}
+			if r.Instructions, err = contributedInstructions(c, m); err != nil {
+				return provenance{}, err
+			}
+			p.Contributions = append(p.Contributions, r)
+		}
+	}
+	return p, nil
+}
+
+// contributedInstructions returns the instructions of the Dockerfile fragment
+// contributed with m, after checking they are allowed in category c.
+func contributedInstructions(c string, m manifest) ([]string, error) {
+	df, err := fetchContributedDockerfile(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(df) == 0 {
+		return dataInstructions(c, m, []string{})
+	}
+	s := parser.Directive{}
+	if err = parser.SetEscapeToken(parser.DefaultEscapeToken, &s); err != nil {
+		return nil, err
+	}
+	root, err := parser.Parse(bytes.NewReader(df), &s)
+	if err != nil {
+		return nil, err
+	}
+	if bad := verifyContributedInstructionsForCategory(c, root); bad != `` {
+		return nil, fmt.Errorf("Illegal instruction in %v category Dockerfile fragment: %v contributed by %v:%v", c, bad, m.Provisioner.Repository, m.Provisioner.Tag)
+	}
+	result := []string{}
+	for _, child := range root.Children {
+		// The volumes of a data category result are declared as one
+		if c == `data` && child.Value == `volume` {
+			continue
+		}
+		result = append(result, child.Original)
+	}
+	return dataInstructions(c, m, result)
+}
+
+// dataInstructions adds the declaration of its volumes to the instructions
+// of a data category result.
+func dataInstructions(c string, m manifest, instructions []string) ([]string, error) {
+	if c != `data` {
+		return instructions, nil
+	}
+	volumes, err := dataVolumes(m)
+	if err != nil || len(volumes) == 0 {
+		return instructions, err
+	}
+	return append(instructions, volumeInstruction(volumes)), nil
+}
+
+// recordProvenance writes the provenance of the build context and adds it
+// to the product.
+func recordProvenance(ms map[string][]manifest) error {
+	p, err := buildProvenance(ms)
+	if err != nil {
+		return err
+	}
+	return addProvenance(p)
+}
+
+// addProvenance writes p to the build context and adds it to the product.
+func addProvenance(p provenance) error {
+	d, perm, err := cwdAndPerms()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(p, ``, `  `)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path.Join(d, provenanceName), b, perm); err != nil {
+		return err
+	}
+	return appendDockerfile(bytes.NewBufferString(fmt.Sprintf("ADD ./%v %v\n", provenanceName, provenanceImagePath)))
+}
+
+// sinceProduct is the previous product a --since build updates.
+type sinceProduct struct {
+	id         string
+	provenance provenance
+}
+
+// loadSinceProduct reads the image ID and the provenance of the previous
+// product ref.
+func loadSinceProduct(ctx context.Context, ref string) (*sinceProduct, error) {
+	found, id, _, err := system.LocalImage(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf(`Image %v is not available locally. Pull it first.`, ref)
+	}
+	b, err := system.ReadImageFile(ctx, ref, provenanceImagePath)
+	if err != nil {
+		return nil, fmt.Errorf(`%v does not record its provenance, it cannot be updated with --since: %v`, ref, err)
+	}
+	sp := &sinceProduct{id: id}
+	if err = json.Unmarshal(b, &sp.provenance); err != nil {
+		return nil, fmt.Errorf(`%v has a malformed provenance: %v`, ref, err)
+	}
+	return sp, nil
+}
+
+// assembleDelta writes a Dockerfile that updates the product o.Since to the
+// results in the build context. Only changed files, removed paths and new
+// instructions are applied.
+func assembleDelta(ctx context.Context, ms map[string][]manifest, md runMetadata, o Options) error {
+	since := o.since
+	if since == nil {
+		var err error
+		if since, err = loadSinceProduct(ctx, o.Since); err != nil {
+			return err
+		}
+	}
+	prev := since.provenance
+	if _, err := prepareData(ms[`data`]); err != nil {
+		return err
+	}
+	next, err := buildProvenance(ms)
+	if err != nil {
+		return err
+	}
+	if pb, nb := prev.base(), next.base(); pb != nb {
+		return fmt.Errorf(`The base image changed from %q to %q. Build without --since.`, pb, nb)
+	}
+
+	// A provisioner image that received the same detective material
+	// contributed the same as before
+	reused := map[int]bool{}
+	for i, c := range next.Contributions {
+		for _, pc := range prev.Contributions {
+			if c.same(pc) && c.Input != `` && c.Input == pc.Input && c.ImageID == pc.ImageID {
+				fmt.Printf("The %v category contribution from %v is unchanged.\n", c.Category, c.Provisioner)
+				next.Contributions[i].Files, next.Contributions[i].Instructions = pc.Files, pc.Instructions
+				reused[i] = true
+			}
+		}
+	}
+
+	dn, _, err := cwdAndPerms()
+	if err != nil {
+		return err
+	}
+	prevFiles, nextFiles := prev.files(), next.files()
+	changed, err := writeDeltaTarball(path.Join(dn, deltaTarballName), ms, next, reused, prevFiles, nextFiles)
+	if err != nil {
+		return err
+	}
+	removed := removedPaths(prevFiles, nextFiles)
+
+	if err = appendDockerfile(bytes.NewBufferString(fmt.Sprintf("FROM %v\n\n", o.Since))); err != nil {
+		return err
+	}
+	labels := md.Source.labels()
+	labels[`com.docker.v2c.product.since`] = o.Since
+	labels[`com.docker.v2c.product.since.id`] = since.id
+	if err = addProductMetadata(labels); err != nil {
+		return err
+	}
+
+	b := new(bytes.Buffer)
+	if changed > 0 {
+		b.WriteString(fmt.Sprintf("ADD ./%v /\n", deltaTarballName))
+	}
+	if len(removed) > 0 {
+		b.WriteString(`RUN rm -rf --`)
+		for _, r := range removed {
+			b.WriteString(" \\\n      " + shellQuote(r))
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+	seen := prev.instructions()
+	added := 0
+	for i, c := range next.Contributions {
+		if c.Category == `os` || reused[i] {
+			continue
+		}
+		fresh := []string{}
+		for _, in := range c.Instructions {
+			if !seen[in] {
+				fresh = append(fresh, in)
+				seen[in] = true
+			}
+		}
+		if len(fresh) == 0 {
+			continue
+		}
+		b.WriteString(fmt.Sprintf("# The following changes contributed by %v category provisioner: %v\n", c.Category, c.Provisioner))
+		b.WriteString(strings.Join(fresh, "\n") + "\n\n")
+		added += len(fresh)
+	}
+	if err = appendDockerfile(b); err != nil {
+		return err
+	}
+
+	fmt.Printf("Since %v: %v changed files, %v removed paths, %v new instructions\n", o.Since, changed, len(removed), added)
+	if err = ignoreCategories(); err != nil {
+		return err
+	}
+	if err = addProvenance(next); err != nil {
+		return err
+	}
+	return emit(ms, o)
+}
+
+// writeDeltaTarball collects the final version of every contributed path
+// that differs from the previous product into fn and returns how many there
+// are.
+func writeDeltaTarball(fn string, ms map[string][]manifest, next provenance, reused map[int]bool, prevFiles map[string]string, nextFiles map[string]string) (int, error) {
+	dn, _, err := cwdAndPerms()
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+
+	written := map[string]bool{}
+	i := 0
+	for _, c := range categoryOrder {
+		for _, m := range ms[c] {
+			r := next.Contributions[i]
+			i++
+			if reused[i-1] || m.TarballName == `` {
+				continue
+			}
+			err = walkTar(path.Join(dn, c, imageTarball(c, m)), func(h *tar.Header, rd io.Reader) error {
+				p := path.Clean(`/` + h.Name)
+				d := r.Files[p]
+				if written[p] || d != nextFiles[p] || d == prevFiles[p] {
+					return nil
+				}
+				written[p] = true
+				if err := tw.WriteHeader(h); err != nil {
+					return err
+				}
+				_, err := io.Copy(tw, rd)
+				return err
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return 0, err
+	}
+	return len(written), nil
+}
+
+// removedPaths lists the previously contributed paths that are no longer
+// contributed. Paths below a removed directory are left to it.
+func removedPaths(prevFiles map[string]string, nextFiles map[string]string) []string {
+	gone := map[string]bool{}
+	for p := range prevFiles {
+		if _, ok := nextFiles[p]; !ok && p != `/` {
+			gone[p] = true
+		}
+	}
+	result := []string{}
+	for p := range gone {
+		covered := false
+		for d := path.Dir(p); d != `/`; d = path.Dir(d) {
+			if gone[d] {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			result = append(result, p)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// ignoreCategories keeps the full provisioner results and the seed archives
+// of data volumes out of the context of a delta build.
+func ignoreCategories() error {
+	return addDockerignore(append(append([]string{}, categoryOrder...), volumesDirName)...)
+}
@@ -0,0 +1,100 @@
+package workflow
+
+import (
+	"archive/tar"
+	"github.com/docker/v2c/api"
+	"io"
+	"io/ioutil"
+	"os"
+	path "path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRemovedPaths(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		prev  map[string]string
+		next  map[string]string
+		wants []string
+	}{
+		{`unchanged`, map[string]string{`/etc/a`: `1`}, map[string]string{`/etc/a`: `2`}, []string{}},
+		{`removed file`, map[string]string{`/etc/a`: `1`, `/etc/b`: `1`}, map[string]string{`/etc/a`: `1`}, []string{`/etc/b`}},
+		{`removed directory`, map[string]string{`/opt/app`: `d`, `/opt/app/bin`: `d`, `/opt/app/bin/run`: `1`, `/opt/keep`: `1`},
+			map[string]string{`/opt/keep`: `1`}, []string{`/opt/app`}},
+		{`directory kept`, map[string]string{`/opt/app`: `d`, `/opt/app/a`: `1`, `/opt/app/b`: `1`},
+			map[string]string{`/opt/app`: `d`, `/opt/app/a`: `1`}, []string{`/opt/app/b`}},
+		{`root`, map[string]string{`/`: `d`, `/a`: `1`}, map[string]string{}, []string{`/a`}},
+		{`sorted`, map[string]string{`/c`: `1`, `/a`: `1`, `/b`: `1`}, map[string]string{}, []string{`/a`, `/b`, `/c`}},
+	} {
+		if got := removedPaths(c.prev, c.next); !reflect.DeepEqual(got, c.wants) {
+			t.Errorf("%v: got %v, want %v", c.name, got, c.wants)
+		}
+	}
+}
+
+func TestWriteDeltaTarball(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `v2c-delta`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestTar(t, path.Join(dir, `application`, `app.tar`), map[string]string{
+		`opt/app/run`:  `v2`,
+		`opt/app/lib`:  `same`,
+		`etc/app.conf`: `overwritten`,
+	})
+	writeTestTar(t, path.Join(dir, `config`, `conf.tar`), map[string]string{
+		`etc/app.conf`: `configured`,
+		`etc/motd`:     `reused`,
+	})
+	ms := map[string][]manifest{
+		`application`: {{Provisioner: api.Provisioner{Category: `application`}, TarballName: `app.tar`}},
+		`config`:      {{Provisioner: api.Provisioner{Category: `config`}, TarballName: `conf.tar`}},
+	}
+	next := provenance{Contributions: []contribution{
+		{Category: `application`, Files: map[string]string{`/opt/app/run`: `run2`, `/opt/app/lib`: `lib`, `/etc/app.conf`: `conf1`}},
+		{Category: `config`, Files: map[string]string{`/etc/app.conf`: `conf2`, `/etc/motd`: `motd`}},
+	}}
+	nextFiles := next.files()
+
+	for _, c := range []struct {
+		name      string
+		prevFiles map[string]string
+		reused    map[int]bool
+		wants     map[string]string
+	}{
+		{`from scratch`, map[string]string{}, map[int]bool{},
+			map[string]string{`opt/app/run`: `v2`, `opt/app/lib`: `same`, `etc/app.conf`: `configured`, `etc/motd`: `reused`}},
+		{`changed files only`, map[string]string{`/opt/app/run`: `run1`, `/opt/app/lib`: `lib`, `/etc/app.conf`: `conf2`, `/etc/motd`: `old`}, map[int]bool{},
+			map[string]string{`opt/app/run`: `v2`, `etc/motd`: `reused`}},
+		{`final version wins`, map[string]string{`/etc/app.conf`: `conf1`}, map[int]bool{},
+			map[string]string{`opt/app/run`: `v2`, `opt/app/lib`: `same`, `etc/app.conf`: `configured`, `etc/motd`: `reused`}},
+		{`reused contribution`, map[string]string{`/opt/app/run`: `run1`, `/opt/app/lib`: `lib`, `/etc/app.conf`: `conf2`}, map[int]bool{1: true},
+			map[string]string{`opt/app/run`: `v2`}},
+		{`nothing changed`, nextFiles, map[int]bool{}, map[string]string{}},
+	} {
+		fn := path.Join(dir, deltaTarballName)
+		var n int
+		err = inDir(dir, func() error {
+			var err error
+			n, err = writeDeltaTarball(fn, ms, next, c.reused, c.prevFiles, nextFiles)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		got := map[string]string{}
+		err = walkTar(fn, func(h *tar.Header, rd io.Reader) error {
+			b, err := ioutil.ReadAll(rd)
+			got[h.Name] = string(b)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if n != len(got) || !reflect.DeepEqual(got, c.wants) {
+			t.Errorf("%v: wrote %v entries %v, want %v", c.name, n, got, c.wants)
+		}
+	}
+}
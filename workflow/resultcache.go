@@ -0,0 +1,162 @@
+package workflow
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/pkg/homedir"
+	"github.com/docker/v2c/api"
+	"github.com/docker/v2c/system"
+	"io/ioutil"
+	"os"
+	path "path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// resultCache keeps the results of detective containers in ~/.v2c so that
+// unchanged detectives are not run again against an unchanged disk.
+type resultCache struct {
+	dir    string
+	digest string
+	read   bool
+}
+
+// cachedResult is a detective result as stored in the cache.
+type cachedResult struct {
+	Detective string
+	ImageID   string
+	Digest    string
+	Facts     []string `json:",omitempty"`
+	Code      int64
+	Payload   []byte
+	Created   time.Time
+}
+
+// newResultCache returns the result cache for the disk with digest, or nil
+// when the disk has no digest. Results are stored but not reused when
+// o.NoCache is set.
+func newResultCache(digest string, o Options) *resultCache {
+	if digest == `` {
+		return nil
+	}
+	home := homedir.Get()
+	if home == `` {
+		return nil
+	}
+	return &resultCache{
+		dir:    path.Join(home, `.v2c`, `detectives`),
+		digest: digest,
+		read:   !o.NoCache,
+	}
+}
+
+// unpackDigest identifies the filesystem detectives see by the digest of the
+// input and the way it was unpacked. An input without a digest has none.
+func unpackDigest(digest string, layout string, o Options) string {
+	if digest == `` {
+		return ``
+	}
+	k := fmt.Sprintf("%v\n%v\n%v\n%v\n", digest, o.RootPartition, layout, strings.Join(o.Excludes, `,`))
+	return fmt.Sprintf(`sha256:%x`, sha256.Sum256([]byte(k)))
+}
+
+// key identifies the result of d against the disk. The facts a detective
+// consumes are derived from the disk, so their names complete the key.
+func (c *resultCache) key(d api.Detective) string {
+	facts := append([]string{}, d.Facts...)
+	sort.Strings(facts)
+	k := fmt.Sprintf("%v\n%v\n%v\n", d.ImageID, c.digest, strings.Join(facts, `,`))
+	return fmt.Sprintf(`%x`, sha256.Sum256([]byte(k)))
+}
+
+// get returns the stored result of d if there is one.
+func (c *resultCache) get(d api.Detective) (*cachedResult, bool) {
+	if c == nil || !c.read || d.ImageID == `` {
+		return nil, false
+	}
+	b, err := ioutil.ReadFile(path.Join(c.dir, c.key(d)+`.json`))
+	if err != nil {
+		return nil, false
+	}
+	r := &cachedResult{}
+	if err = json.Unmarshal(b, r); err != nil || r.ImageID != d.ImageID || r.Digest != c.digest {
+		return nil, false
+	}
+	return r, true
+}
+
+// put stores the result of d. Failures only cost a later rerun.
+func (c *resultCache) put(d api.Detective, code int64, payload *bytes.Buffer) {
+	if c == nil || d.ImageID == `` {
+		return
+	}
+	r := cachedResult{
+		Detective: fmt.Sprintf(`%v:%v`, d.Repository, d.Tag),
+		ImageID:   d.ImageID,
+		Digest:    c.digest,
+		Facts:     d.Facts,
+		Code:      code,
+		Created:   time.Now().UTC(),
+	}
+	if payload != nil {
+		r.Payload = payload.Bytes()
+	}
+	b, err := json.Marshal(r)
+	if err == nil {
+		err = os.MkdirAll(c.dir, 0700)
+	}
+	if err == nil {
+		// Write and rename so that concurrent runs never read half a result
+		var f *os.File
+		if f, err = ioutil.TempFile(c.dir, `result`); err == nil {
+			_, err = f.Write(b)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				err = os.Rename(f.Name(), path.Join(c.dir, c.key(d)+`.json`))
+			}
+			if err != nil {
+				os.Remove(f.Name())
+			}
+		}
+	}
+	if err != nil {
+		fmt.Printf("Unable to cache the result of %v: %v\n", r.Detective, err)
+	}
+}
+
+// runContainerDetective runs the detective container d, or reuses its cached
+// result, and sends the output on c, or nil when there is no result.
+func runContainerDetective(ctx context.Context, c chan *bytes.Buffer, d api.Detective, v system.DetectiveView, cache *resultCache) {
+	var stdout *bytes.Buffer
+	defer func() {
+		select {
+		case c <- stdout:
+		case <-ctx.Done():
+		}
+	}()
+
+	var code int64
+	if r, ok := cache.get(d); ok {
+		fmt.Printf("Using the cached result of %v:%v\n", d.Repository, d.Tag)
+		code, stdout = r.Code, bytes.NewBuffer(r.Payload)
+	} else {
+		var err error
+		if code, stdout, err = system.RunDetective(ctx, d, v); err != nil {
+			fmt.Printf("No results for %v:%v error: %v\n", d.Repository, d.Tag, err)
+			stdout = nil
+			return
+		}
+		cache.put(d, code, stdout)
+	}
+
+	if code != 0 {
+		fmt.Printf("No results for %v:%v code: %v\n", d.Repository, d.Tag, code)
+		stdout = nil
+	}
+}
@@ -0,0 +1,189 @@
+package workflow
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/v2c/api"
+	"github.com/docker/v2c/builtin"
+	"os"
+	path "path/filepath"
+	"strings"
+)
+
+// Retarget moves the build context in the current working directory onto a
+// different base image. Only the os category and the provisioners that
+// consume OS facts are rerun, everything else captured from the original
+// disk is kept as is.
+func Retarget(ctx context.Context, target string, o Options) error {
+	md, err := loadRunMetadata()
+	if err != nil {
+		return err
+	}
+	ms, err := loadManifests()
+	if err != nil {
+		return err
+	}
+
+	image, facts := retargetImage(target)
+	fmt.Printf("Retargeting onto %v\n", image)
+
+	// Re-run the os category
+	results := map[string][]provisionerResponse{}
+	osr, err := retargetOSResult(ctx, image, facts)
+	if err != nil {
+		return err
+	}
+	results[`os`] = []provisionerResponse{osr}
+
+	// Re-run the provisioners that consume OS facts
+	prc := make(chan provisionerResponse)
+	launched := 0
+	rerun := map[string]bool{}
+	for c, cms := range ms {
+		if c == `os` {
+			continue
+		}
+		for _, m := range cms {
+			if !api.Consumes(m.Provisioner.Facts, api.FactOS) {
+				continue
+			}
+			if m.InputName == `` {
+				fmt.Printf("The %v category provisioner %v:%v consumes OS facts but its input was not kept, it will not be rerun.\n", c, m.Provisioner.Repository, m.Provisioner.Tag)
+				continue
+			}
+			in, err := fetchInput(m)
+			if err != nil {
+				return err
+			}
+			go launchProvisioner(ctx, m.Provisioner, m.Detective, in, prc, &facts)
+			rerun[m.TarballName] = true
+			launched++
+		}
+	}
+	if err = collectProvisionerResponses(ctx, launched, prc, results); err != nil {
+		return err
+	}
+
+	// A rerun that failed would leave the result for the old base image in
+	// place, so nothing is changed
+	rerunOK := map[string]bool{}
+	for c, prs := range results {
+		for _, pr := range prs {
+			rerunOK[fmt.Sprintf(`%v %v:%v`, c, pr.Provisioner.Repository, pr.Provisioner.Tag)] = true
+		}
+	}
+	failed := []string{}
+	for c, cms := range ms {
+		for _, m := range cms {
+			ref := fmt.Sprintf(`%v %v:%v`, c, m.Provisioner.Repository, m.Provisioner.Tag)
+			if rerun[m.TarballName] && !rerunOK[ref] {
+				fmt.Printf("The %v category provisioner %v:%v failed for %v.\n", c, m.Provisioner.Repository, m.Provisioner.Tag, image)
+				failed = append(failed, ref)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf(`The build context was left unchanged because %v provisioners consuming OS facts failed to rerun.`, len(failed))
+	}
+
+	warnPackageManagerMismatch(md.Facts, facts, ms, rerun)
+
+	// Replace the os category and the rerun results, then reassemble
+	dn, _, err := cwdAndPerms()
+	if err != nil {
+		return err
+	}
+	if err = os.RemoveAll(path.Join(dn, `os`)); err != nil {
+		return err
+	}
+	if err = os.Remove(path.Join(dn, `Dockerfile`)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, err = persistProvisionerResults(results); err != nil {
+		return err
+	}
+	md.Facts = &facts
+	if err = persistRunMetadata(md); err != nil {
+		return err
+	}
+	if ms, err = loadManifests(); err != nil {
+		return err
+	}
+	return assemble(ctx, ms, md, o)
+}
+
+// retargetImage resolves the --os argument. A reference without a
+// repository path, like ubuntu:18.04, names a distribution and version and is
+// looked up in the base image mappings. Anything else is used verbatim. The
+// facts handed to provisioners are derived from the repository name and tag.
+func retargetImage(target string) (string, api.OSFacts) {
+	name, tag := target, ``
+	if i := strings.Index(name, `@`); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, `:`); i > strings.LastIndex(name, `/`) {
+		name, tag = name[:i], name[i+1:]
+	}
+	if tag == `latest` {
+		tag = ``
+	}
+	facts := api.OSFacts{
+		ID:        path.Base(name),
+		VersionID: tag,
+		Source:    `retarget`,
+	}
+	if !strings.Contains(name, `/`) {
+		if image, ok := builtin.BaseImageFor(facts); ok {
+			return image, facts
+		}
+	}
+	return target, facts
+}
+
+// retargetOSResult produces the result the os provisioner would have for the
+// new base image.
+func retargetOSResult(ctx context.Context, image string, facts api.OSFacts) (provisionerResponse, error) {
+	var p api.Provisioner
+	for _, bp := range api.BuiltinProvisioners() {
+		if bp.Category == `os` {
+			p = bp
+			break
+		}
+	}
+	if p.Tag == `` {
+		return provisionerResponse{}, errors.New(`No built-in os provisioner is available.`)
+	}
+	b := new(bytes.Buffer)
+	if err := builtin.WriteDockerfileTar(b, []byte(fmt.Sprintf("FROM %v\n", image))); err != nil {
+		return provisionerResponse{}, err
+	}
+	return provisionerResponse{
+		Provisioner: p,
+		Category:    p.Category,
+		Tarball:     b,
+	}, nil
+}
+
+// warnPackageManagerMismatch points out the captured provisioner results that
+// were produced for a different package manager than the new base image uses.
+func warnPackageManagerMismatch(from *api.OSFacts, to api.OSFacts, ms map[string][]manifest, rerun map[string]bool) {
+	if from == nil {
+		fmt.Println(`The original operating system is unknown, package manager compatibility cannot be checked.`)
+		return
+	}
+	fpm, tpm := from.PackageManager(), to.PackageManager()
+	if fpm == tpm || fpm == `` || tpm == `` {
+		return
+	}
+	fmt.Printf("Warning: the original %v %v uses %v but %v %v uses %v.\n", from.ID, from.VersionID, fpm, to.ID, to.VersionID, tpm)
+	for _, c := range []string{`application`, `config`, `init`} {
+		for _, m := range ms[c] {
+			if rerun[m.TarballName] {
+				continue
+			}
+			fmt.Printf("\tReview the %v category contribution from %v:%v\n", c, m.Provisioner.Repository, m.Provisioner.Tag)
+		}
+	}
+}
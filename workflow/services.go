@@ -0,0 +1,378 @@
+package workflow
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aanand/compose-file/loader"
+	"github.com/aanand/compose-file/types"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	path "path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// servicesDirName holds the build context of each service.
+	servicesDirName = `services`
+	// composeFileName wires the services together.
+	composeFileName = `docker-compose.yml`
+	// composeRestoreScriptName restores the data volumes of every service
+	// under the names Compose gives them.
+	composeRestoreScriptName = `restore-volumes.sh`
+)
+
+// service is a group of provisioner results that run as one container.
+type service struct {
+	Name      string
+	Manifests map[string][]manifest
+	Ports     []string
+	Volumes   []string
+	Depends   []string
+}
+
+var serviceDirPattern = regexp.MustCompile(`^/?etc/service/([^/]+)/`)
+var volumeNamePattern = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// assembleServices splits the provisioner results in the build context into
+// one build context per service below services and writes a Compose file
+// that runs them together.
+func assembleServices(ctx context.Context, ms map[string][]manifest, md runMetadata, o Options) error {
+	dn, perm, err := cwdAndPerms()
+	if err != nil {
+		return err
+	}
+	services, err := groupServices(dn, ms)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range services {
+		sd := path.Join(dn, servicesDirName, s.Name)
+		fmt.Printf("Assembling service %v in %v\n", s.Name, sd)
+		if err = linkServiceResults(dn, sd, perm, s.Manifests); err != nil {
+			return err
+		}
+		so := o
+		so.Tag = serviceTag(o.Tag, s.Name)
+		err = inDir(sd, func() error {
+			if err := persistRunMetadata(md); err != nil {
+				return err
+			}
+			return assemble(ctx, s.Manifests, md, so)
+		})
+		if err != nil {
+			return fmt.Errorf(`Unable to assemble service %v: %v`, s.Name, err)
+		}
+	}
+	if err = writeComposeFile(path.Join(dn, composeFileName), perm, services, o.Tag); err != nil {
+		return err
+	}
+	return writeComposeRestoreScript(dn, services)
+}
+
+// writeComposeRestoreScript writes a helper to dn that runs the restore.sh
+// of every service with seeded volumes, with the prefix that makes its
+// volume names those Compose mounts: PROJECT_SERVICE-<volume>.
+func writeComposeRestoreScript(dn string, services []*service) error {
+	b := new(bytes.Buffer)
+	b.WriteString(`#!/bin/sh
+# Restores the data volumes of the services into the Docker volumes that
+# docker-compose up mounts, named PROJECT_SERVICE-<volume>. PROJECT defaults
+# to COMPOSE_PROJECT_NAME or to the name Compose derives from this
+# directory.
+#
+# Usage: ` + composeRestoreScriptName + ` [PROJECT]
+set -e
+cd "$(dirname "$0")"
+project=${1:-${COMPOSE_PROJECT_NAME:-$(basename "$PWD" | tr 'A-Z' 'a-z' | tr -cd 'a-z0-9')}}
+
+`)
+	seeded := 0
+	for _, s := range services {
+		script := path.Join(servicesDirName, s.Name, volumesDirName, restoreScriptName)
+		if _, err := os.Stat(path.Join(dn, script)); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		b.WriteString(fmt.Sprintf("./%v \"${project}_%v\" > /dev/null\n", script, s.Name))
+		seeded++
+	}
+	if seeded == 0 {
+		return nil
+	}
+	fmt.Printf("Run %v before docker-compose up to seed the volumes of %v services\n", path.Join(dn, composeRestoreScriptName), seeded)
+	return ioutil.WriteFile(path.Join(dn, composeRestoreScriptName), b.Bytes(), 0755)
+}
+
+// serviceTag names the image of service s of the product tagged tag, app:1
+// becomes app-s:1.
+func serviceTag(tag string, s string) string {
+	if tag == `` {
+		return ``
+	}
+	name, version := tag, ``
+	if i := strings.LastIndex(tag, `:`); i > strings.LastIndex(tag, `/`) {
+		name, version = tag[:i], tag[i:]
+	}
+	return name + `-` + s + version
+}
+
+// groupServices makes a service of every init category result that names
+// one, by the service label of its provisioner or by the runit service
+// directory it contributes. Results of other categories whose provisioner
+// names a service join that service, all others join every service.
+func groupServices(dn string, ms map[string][]manifest) ([]*service, error) {
+	byName := map[string]*service{}
+	names := []string{}
+	shared := map[string][]manifest{}
+	for _, m := range ms[`init`] {
+		name := m.Provisioner.Service
+		if name == `` && m.TarballName != `` {
+			found, err := runitServices(path.Join(dn, `init`, m.TarballName))
+			if err != nil {
+				return nil, err
+			}
+			if len(found) > 1 {
+				fmt.Printf("The init category provisioner %v:%v contributes the services %v, they stay together as %v.\n", m.Provisioner.Repository, m.Provisioner.Tag, strings.Join(found, `, `), found[0])
+			}
+			if len(found) > 0 {
+				name = found[0]
+			}
+		}
+		if name == `` {
+			shared[`init`] = append(shared[`init`], m)
+			continue
+		}
+		s, ok := byName[name]
+		if !ok {
+			s = &service{Name: name, Manifests: map[string][]manifest{}}
+			byName[name] = s
+			names = append(names, name)
+		}
+		s.Manifests[`init`] = append(s.Manifests[`init`], m)
+	}
+	if len(names) == 0 {
+		return nil, errors.New(`No services were found in the init category. Build without --split-services.`)
+	}
+	sort.Strings(names)
+
+	for _, c := range categoryOrder {
+		if c == `init` {
+			continue
+		}
+		for _, m := range ms[c] {
+			s, ok := byName[m.Provisioner.Service]
+			if !ok {
+				if m.Provisioner.Service != `` {
+					fmt.Printf("No init category provisioner starts the %v service of the %v category provisioner %v:%v, its result is added to every service.\n", m.Provisioner.Service, c, m.Provisioner.Repository, m.Provisioner.Tag)
+				}
+				shared[c] = append(shared[c], m)
+				continue
+			}
+			s.Manifests[c] = append(s.Manifests[c], m)
+		}
+	}
+
+	result := []*service{}
+	for _, name := range names {
+		s := byName[name]
+		for c, cms := range shared {
+			s.Manifests[c] = append(append([]manifest{}, cms...), s.Manifests[c]...)
+		}
+		if err := s.inspect(); err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+
+	// Only services that are part of the split can be waited for
+	for _, s := range result {
+		depends := []string{}
+		for _, d := range s.Depends {
+			if _, ok := byName[d]; ok && d != s.Name {
+				depends = append(depends, d)
+			}
+		}
+		s.Depends = depends
+	}
+	return result, nil
+}
+
+// runitServices lists the service directories below /etc/service in the
+// tarball fn.
+func runitServices(fn string) ([]string, error) {
+	seen := map[string]bool{}
+	result := []string{}
+	err := walkTar(fn, func(h *tar.Header, rd io.Reader) error {
+		if m := serviceDirPattern.FindStringSubmatch(path.Clean(`/` + h.Name)); m != nil && !seen[m[1]] {
+			seen[m[1]] = true
+			result = append(result, m[1])
+		}
+		return nil
+	})
+	sort.Strings(result)
+	return result, err
+}
+
+// inspect collects the ports, volumes and dependencies of the service from
+// the Dockerfile fragments and provisioners of its results.
+func (s *service) inspect() error {
+	w, err := inspectWorkload(s.Manifests)
+	if err != nil {
+		return err
+	}
+	depends := map[string]bool{}
+	for _, cms := range s.Manifests {
+		for _, m := range cms {
+			for _, d := range m.Provisioner.Depends {
+				depends[d] = true
+			}
+		}
+	}
+	s.Ports, s.Volumes, s.Depends = w.Ports, w.Volumes, sortedSet(depends)
+	return nil
+}
+
+func sortedSet(set map[string]bool) []string {
+	result := []string{}
+	for k := range set {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// linkServiceResults makes the results in ms available in the service build
+// context sd, hard linked where possible.
+func linkServiceResults(dn string, sd string, perm os.FileMode, ms map[string][]manifest) error {
+	for c, cms := range ms {
+		if err := os.MkdirAll(path.Join(sd, c), perm|0700); err != nil {
+			return err
+		}
+		for _, m := range cms {
+			names := []string{m.TarballName, strings.TrimSuffix(m.TarballName, `.tar`) + `.manifest`}
+			if m.InputName != `` {
+				names = append(names, m.InputName)
+			}
+			for _, n := range names {
+				if err := linkOrCopy(path.Join(dn, c, n), path.Join(sd, c, n)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func linkOrCopy(from string, to string) error {
+	if err := os.Link(from, to); err == nil {
+		return nil
+	}
+	fi, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(to, b, fi.Mode().Perm())
+}
+
+// composeConfig models the Compose file. The compose-file types describe a
+// service but cannot be marshalled, so services are converted on output.
+func composeConfig(services []*service, tag string) types.Config {
+	cfg := types.Config{Volumes: map[string]types.VolumeConfig{}}
+	published := map[string]int{}
+	for _, s := range services {
+		for _, p := range s.Ports {
+			published[p]++
+		}
+	}
+	for _, s := range services {
+		sc := types.ServiceConfig{Name: s.Name, Image: serviceTag(tag, s.Name), DependsOn: s.Depends}
+		for _, p := range s.Ports {
+			// Ports only one service exposes keep their number on the host
+			if published[p] == 1 {
+				port, proto := p, ``
+				if i := strings.Index(p, `/`); i >= 0 {
+					port, proto = p[:i], p[i:]
+				}
+				sc.Ports = append(sc.Ports, fmt.Sprintf(`%v:%v%v`, port, port, proto))
+			} else {
+				sc.Ports = append(sc.Ports, p)
+			}
+		}
+		for _, v := range s.Volumes {
+			name := s.Name + `-` + volumeBaseName(v)
+			sc.Volumes = append(sc.Volumes, fmt.Sprintf(`%v:%v`, name, v))
+			cfg.Volumes[name] = types.VolumeConfig{}
+		}
+		cfg.Services = append(cfg.Services, sc)
+	}
+	return cfg
+}
+
+// composeDict converts cfg to the layout of a version 3 Compose file that
+// builds each service from its build context.
+func composeDict(cfg types.Config) types.Dict {
+	services := types.Dict{}
+	for _, sc := range cfg.Services {
+		d := types.Dict{`build`: `./` + servicesDirName + `/` + sc.Name}
+		if sc.Image != `` {
+			d[`image`] = sc.Image
+		}
+		if len(sc.Ports) > 0 {
+			d[`ports`] = sc.Ports
+		}
+		if len(sc.Volumes) > 0 {
+			d[`volumes`] = sc.Volumes
+		}
+		if len(sc.DependsOn) > 0 {
+			d[`depends_on`] = sc.DependsOn
+		}
+		services[sc.Name] = d
+	}
+	result := types.Dict{`version`: `3`, `services`: services}
+	if len(cfg.Volumes) > 0 {
+		volumes := types.Dict{}
+		for name := range cfg.Volumes {
+			volumes[name] = types.Dict{}
+		}
+		result[`volumes`] = volumes
+	}
+	return result
+}
+
+// writeComposeFile writes the Compose file for services to fn after checking
+// that it is valid.
+func writeComposeFile(fn string, perm os.FileMode, services []*service, tag string) error {
+	b, err := yaml.Marshal(composeDict(composeConfig(services, tag)))
+	if err != nil {
+		return err
+	}
+	dict, err := loader.ParseYAML(b)
+	if err != nil {
+		return err
+	}
+	_, err = loader.Load(types.ConfigDetails{
+		WorkingDir:  path.Dir(fn),
+		ConfigFiles: []types.ConfigFile{{Filename: fn, Config: dict}},
+	})
+	if err != nil {
+		return fmt.Errorf(`The generated Compose file is invalid: %v`, err)
+	}
+	if err = ioutil.WriteFile(fn, b, perm); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %v with %v services\n", fn, len(services))
+	return nil
+}
@@ -0,0 +1,87 @@
+package workflow
+
+import (
+	"github.com/docker/v2c/api"
+	"io/ioutil"
+	"os"
+	path "path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServiceInspect(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `v2c-services`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestTar(t, path.Join(dir, `config`, `mysql.tar`), map[string]string{
+		`etc/mysql/my.cnf`: "[mysqld]\nport = 3307\n",
+	})
+	writeTestTar(t, path.Join(dir, `data`, `mysql.tar`), map[string]string{
+		`Dockerfile`: "VOLUME /var/lib/mysql /var/log/mysql/\n",
+	})
+	s := &service{Name: `db`, Manifests: map[string][]manifest{
+		`config`: {{Provisioner: api.Provisioner{Category: `config`}, TarballName: `mysql.tar`}},
+		`data`:   {{Provisioner: api.Provisioner{Category: `data`}, TarballName: `mysql.tar`}},
+	}}
+	if err = inDir(dir, s.inspect); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Ports, []string{`3307`}) {
+		t.Errorf("the service has the ports %v, want 3307", s.Ports)
+	}
+	if !reflect.DeepEqual(s.Volumes, []string{`/var/lib/mysql`, `/var/log/mysql`}) {
+		t.Fatalf("the service has the volumes %v", s.Volumes)
+	}
+
+	// restore.sh run with the prefix restore-volumes.sh passes creates the
+	// volumes Compose mounts once it prefixes them with the project
+	cfg := composeConfig([]*service{s}, `example/app:1`)
+	vd := path.Join(dir, servicesDirName, s.Name, volumesDirName)
+	if err = os.MkdirAll(vd, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeRestoreScript(path.Join(vd, restoreScriptName), []dataResult{{volumes: s.Volumes}}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path.Join(vd, restoreScriptName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := []string{}
+	for _, l := range strings.Split(string(b), "\n") {
+		if f := strings.Fields(l); len(f) == 3 && f[0] == `restore` {
+			restored = append(restored, `app_db-`+f[2])
+		}
+	}
+	composed := []string{}
+	for name := range cfg.Volumes {
+		composed = append(composed, `app_`+name)
+	}
+	sortedNames := func(names []string) []string {
+		set := map[string]bool{}
+		for _, n := range names {
+			set[n] = true
+		}
+		return sortedSet(set)
+	}
+	if !reflect.DeepEqual(sortedNames(restored), sortedNames(composed)) || len(restored) != 2 {
+		t.Errorf("restore.sh creates %v but Compose mounts %v", restored, composed)
+	}
+	if !reflect.DeepEqual(cfg.Services[0].Ports, []string{`3307:3307`}) {
+		t.Errorf("the Compose service publishes %v", cfg.Services[0].Ports)
+	}
+
+	if err = writeComposeRestoreScript(dir, []*service{s, {Name: `web`}}); err != nil {
+		t.Fatal(err)
+	}
+	b, err = ioutil.ReadFile(path.Join(dir, composeRestoreScriptName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "./services/db/volumes/restore.sh \"${project}_db\"") || strings.Contains(string(b), `web`) {
+		t.Errorf("%v is\n%s", composeRestoreScriptName, b)
+	}
+}
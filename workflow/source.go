@@ -0,0 +1,83 @@
+package workflow
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/v2c/system"
+)
+
+// sourceMetadata records where the material of a run came from when it was
+// not a disk or filesystem tree.
+type sourceMetadata struct {
+	Kind      string
+	Reference string
+	Digest    string `json:",omitempty"`
+}
+
+// sourceLabels are the product labels that reference the source.
+func (s *sourceMetadata) labels() map[string]string {
+	if s == nil {
+		return map[string]string{}
+	}
+	return map[string]string{
+		`com.docker.v2c.product.source`:        s.Reference,
+		`com.docker.v2c.product.source.kind`:   s.Kind,
+		`com.docker.v2c.product.source.digest`: s.Digest,
+	}
+}
+
+// imageDigest names an image by its registry digest if it has one and by
+// its ID otherwise.
+func imageDigest(ctx context.Context, ref string, id string) string {
+	_, _, rds, err := system.LocalImage(ctx, id)
+	if err == nil {
+		if d := system.RepoDigestFor(ref, rds); d != `` {
+			return d
+		}
+	}
+	return id
+}
+
+// populateFromImage copies the flattened filesystem of a local image into
+// the transport volume.
+func populateFromImage(ctx context.Context, ref string) (*sourceMetadata, error) {
+	found, id, _, err := system.LocalImage(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf(`Image %v is not available locally. Pull it first.`, ref)
+	}
+
+	fmt.Printf("Exporting image %v\n", ref)
+	rc, err := system.ExportImage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if err = system.PopulateTransportVolume(ctx, ``, rc); err != nil {
+		return nil, err
+	}
+
+	return &sourceMetadata{Kind: `image`, Reference: ref, Digest: imageDigest(ctx, ref, id)}, nil
+}
+
+// populateFromContainer copies the filesystem of a container into the
+// transport volume.
+func populateFromContainer(ctx context.Context, cid string) (*sourceMetadata, error) {
+	name, id, err := system.ContainerImage(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Exporting container %v\n", cid)
+	rc, err := system.ExportContainer(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if err = system.PopulateTransportVolume(ctx, ``, rc); err != nil {
+		return nil, err
+	}
+
+	return &sourceMetadata{Kind: `container`, Reference: cid, Digest: imageDigest(ctx, name, id)}, nil
+}
@@ -0,0 +1,191 @@
+package workflow
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/docker/v2c/system"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// defaultHostExcludes are left out of every live capture in addition to
+// the pseudo filesystems mounted on the host.
+var defaultHostExcludes = []string{`/proc`, `/sys`, `/dev`, `/run`, `/tmp`, `/var/run`, `/var/tmp`}
+
+// sshTarget is a host named as ssh://user@host[:port].
+type sshTarget struct {
+	User string
+	Host string
+	Port string
+}
+
+// IsSSHTarget reports whether a build input names a live host.
+func IsSSHTarget(s string) bool {
+	return strings.HasPrefix(s, `ssh://`)
+}
+
+func parseSSHTarget(s string) (sshTarget, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != `ssh` || u.Hostname() == `` || (u.Path != `` && u.Path != `/`) {
+		return sshTarget{}, fmt.Errorf(`%v is not of the form ssh://user@host[:port]`, s)
+	}
+	t := sshTarget{Host: u.Hostname(), Port: u.Port()}
+	if u.User != nil {
+		t.User = u.User.Username()
+	}
+	return t, nil
+}
+
+func (t sshTarget) String() string {
+	s := `ssh://`
+	if t.User != `` {
+		s += t.User + `@`
+	}
+	s += t.Host
+	if t.Port != `` {
+		s += `:` + t.Port
+	}
+	return s
+}
+
+// command runs remote on the host with the ssh client of this machine, so
+// keys, agents, known hosts and ssh_config apply as usual.
+func (t sshTarget) command(ctx context.Context, remote string) *exec.Cmd {
+	args := []string{`-T`}
+	if t.Port != `` {
+		args = append(args, `-p`, t.Port)
+	}
+	if t.User != `` {
+		args = append(args, `-l`, t.User)
+	}
+	args = append(args, t.Host, remote)
+	return exec.CommandContext(ctx, `ssh`, args...)
+}
+
+// captureCommand is the remote command that writes a tar archive of the
+// root filesystem without excludes to its stdout.
+func (t sshTarget) captureCommand(excludes []string) string {
+	remote := `tar --numeric-owner -cpf - -C /`
+	for _, e := range excludes {
+		remote += ` --exclude=` + shellQuote(`.`+e)
+	}
+	remote += ` .`
+	if t.User != `` && t.User != `root` {
+		remote = `sudo -n ` + remote
+	}
+	return remote
+}
+
+// populateFromHost streams the root filesystem of a live host over ssh into
+// the transport volume. Pseudo and network filesystems mounted on the host,
+// the default excludes and the excludes in o are left out. Users other than
+// root read the filesystem through sudo, which must not prompt.
+func populateFromHost(ctx context.Context, target string, o Options) (*sourceMetadata, error) {
+	t, err := parseSSHTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = exec.LookPath(`ssh`); err != nil {
+		return nil, fmt.Errorf(`ssh is needed to capture %v`, t)
+	}
+
+	fmt.Printf("Reading the mounts of %v\n", t)
+	mounts, err := t.command(ctx, `cat /proc/mounts`).Output()
+	if err != nil {
+		return nil, fmt.Errorf(`Unable to read the mounts of %v: %v`, t, err)
+	}
+	excludes := hostExcludes(mounts, `/`, o.Excludes)
+
+	fmt.Printf("Capturing the filesystem of %v without %v\n", t, strings.Join(excludes, `, `))
+	cmd := t.command(ctx, t.captureCommand(excludes))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	perr := system.PopulateTransportVolume(ctx, ``, out)
+	werr := cmd.Wait()
+	if perr != nil {
+		return nil, perr
+	}
+	if werr != nil {
+		// GNU tar exits with 1 when files changed while they were read
+		if ee, ok := werr.(*exec.ExitError); !ok || ee.Sys().(syscall.WaitStatus).ExitStatus() != 1 {
+			return nil, fmt.Errorf(`Capturing %v failed: %v`, t, werr)
+		}
+		fmt.Println(`Some files changed while they were captured.`)
+	}
+
+	return &sourceMetadata{Kind: `host`, Reference: t.String()}, nil
+}
+
+// hostExcludes combines the default and user excludes with the mount points
+// of pseudo and network filesystems listed in /proc/mounts. Mount points are
+// made relative to root and those outside it are ignored.
+func hostExcludes(mounts []byte, root string, user []string) []string {
+	set := map[string]bool{}
+	for _, e := range append(append([]string{}, defaultHostExcludes...), user...) {
+		if e = path.Clean(`/` + e); e != `/` {
+			set[e] = true
+		}
+	}
+	s := bufio.NewScanner(bytes.NewReader(mounts))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) < 3 {
+			continue
+		}
+		mp, ok := rebase(unescapeFstab(f[1]), root)
+		fstype := f[2]
+		if ok && mp != `/` && (pseudoFilesystems[fstype] || networkFilesystems[fstype] || fstype == `overlay` || fstype == `nsfs`) {
+			set[mp] = true
+		}
+	}
+
+	// Paths below an excluded path are covered by it
+	result := []string{}
+	for e := range set {
+		covered := false
+		for p := path.Dir(e); p != `/`; p = path.Dir(p) {
+			if set[p] {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			result = append(result, e)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// rebase makes the absolute path p relative to root, reporting whether p
+// lies below it.
+func rebase(p string, root string) (string, bool) {
+	p, root = path.Clean(p), path.Clean(root)
+	if root == `/` {
+		return p, true
+	}
+	if p == root {
+		return `/`, true
+	}
+	if strings.HasPrefix(p, root+`/`) {
+		return p[len(root):], true
+	}
+	return ``, false
+}
+
+func shellQuote(s string) string {
+	return `'` + strings.Replace(s, `'`, `'\''`, -1) + `'`
+}
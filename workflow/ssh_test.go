@@ -0,0 +1,108 @@
+package workflow
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+const testMounts = `sysfs /sys sysfs rw,nosuid,nodev,noexec,relatime 0 0
+proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0
+/dev/sda1 / ext4 rw,relatime 0 0
+/dev/sda2 /home ext4 rw,relatime 0 0
+tmpfs /dev/shm tmpfs rw,nosuid,nodev 0 0
+tmpfs /srv/scratch\040space tmpfs rw 0 0
+server:/export /mnt/nfs nfs4 rw,relatime 0 0
+overlay /var/lib/docker/overlay2/abc/merged overlay rw 0 0
+nsfs /run/netns/blue nsfs rw 0 0
+binfmt_misc /proc/sys/fs/binfmt_misc binfmt_misc rw 0 0
+`
+
+func TestHostExcludes(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		root  string
+		user  []string
+		wants []string
+	}{
+		{
+			name: `defaults and mounts`,
+			root: `/`,
+			wants: []string{`/dev`, `/mnt/nfs`, `/proc`, `/run`, `/srv/scratch space`, `/sys`, `/tmp`,
+				`/var/lib/docker/overlay2/abc/merged`, `/var/run`, `/var/tmp`},
+		},
+		{
+			name: `user excludes are cleaned and nested paths dropped`,
+			root: `/`,
+			user: []string{`var/lib/docker/`, `/home/../opt`, `/`, `/srv`},
+			wants: []string{`/dev`, `/mnt/nfs`, `/opt`, `/proc`, `/run`, `/srv`, `/sys`, `/tmp`,
+				`/var/lib/docker`, `/var/run`, `/var/tmp`},
+		},
+		{
+			name: `mounts outside root are ignored`,
+			root: `/srv`,
+			wants: []string{`/dev`, `/proc`, `/run`, `/scratch space`, `/sys`, `/tmp`,
+				`/var/run`, `/var/tmp`},
+		},
+	} {
+		if got := hostExcludes([]byte(testMounts), c.root, c.user); !reflect.DeepEqual(got, c.wants) {
+			t.Errorf("%v: got %q, want %q", c.name, got, c.wants)
+		}
+	}
+}
+
+func TestParseSSHTarget(t *testing.T) {
+	for _, c := range []struct {
+		in    string
+		wants sshTarget
+		fails bool
+	}{
+		{in: `ssh://web1`, wants: sshTarget{Host: `web1`}},
+		{in: `ssh://admin@web1:2222`, wants: sshTarget{User: `admin`, Host: `web1`, Port: `2222`}},
+		{in: `ssh://root@[fe80::1]:22/`, wants: sshTarget{User: `root`, Host: `fe80::1`, Port: `22`}},
+		{in: `ssh://web1/etc`, fails: true},
+		{in: `ssh://`, fails: true},
+		{in: `http://web1`, fails: true},
+	} {
+		got, err := parseSSHTarget(c.in)
+		if c.fails {
+			if err == nil {
+				t.Errorf("%v: got %+v, want an error", c.in, got)
+			}
+			continue
+		}
+		if err != nil || got != c.wants {
+			t.Errorf("%v: got %+v and %v, want %+v", c.in, got, err, c.wants)
+		}
+	}
+}
+
+func TestSSHCommand(t *testing.T) {
+	for _, c := range []struct {
+		target sshTarget
+		wants  []string
+	}{
+		{sshTarget{Host: `web1`}, []string{`ssh`, `-T`, `web1`, `true`}},
+		{sshTarget{User: `admin`, Host: `web1`, Port: `2222`}, []string{`ssh`, `-T`, `-p`, `2222`, `-l`, `admin`, `web1`, `true`}},
+	} {
+		if got := c.target.command(context.Background(), `true`).Args; !reflect.DeepEqual(got, c.wants) {
+			t.Errorf("%v: got %q, want %q", c.target, got, c.wants)
+		}
+	}
+}
+
+func TestCaptureCommand(t *testing.T) {
+	excludes := []string{`/proc`, `/srv/it's here`}
+	for _, c := range []struct {
+		target sshTarget
+		wants  string
+	}{
+		{sshTarget{Host: `web1`}, `tar --numeric-owner -cpf - -C / --exclude='./proc' --exclude='./srv/it'\''s here' .`},
+		{sshTarget{User: `root`, Host: `web1`}, `tar --numeric-owner -cpf - -C / --exclude='./proc' --exclude='./srv/it'\''s here' .`},
+		{sshTarget{User: `admin`, Host: `web1`}, `sudo -n tar --numeric-owner -cpf - -C / --exclude='./proc' --exclude='./srv/it'\''s here' .`},
+	} {
+		if got := c.target.captureCommand(excludes); got != c.wants {
+			t.Errorf("%v: got %v, want %v", c.target, got, c.wants)
+		}
+	}
+}
@@ -2,55 +2,125 @@ package workflow
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/v2c/api"
+	"github.com/docker/v2c/builtin"
+	"sort"
 )
 
-func addProductMetadata() error {
+// addProductMetadata labels the product. Empty values are omitted.
+func addProductMetadata(labels map[string]string) error {
+	keys := []string{}
+	for k, v := range labels {
+		if v != `` {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
 	b := new(bytes.Buffer)
-	b.WriteString("LABEL com.docker.v2c.product=1\n\n")
+	b.WriteString("LABEL com.docker.v2c.product=1")
+	for _, k := range keys {
+		b.WriteString(fmt.Sprintf(" \\\n      %v=%q", k, labels[k]))
+	}
+	b.WriteString("\n\n")
 	return appendDockerfile(b)
 }
 
-func applyOSCategory(c []manifest) error {
+// applyOSCategory writes the FROM instruction and returns the base image
+// reference along with the digest or image ID it resolved to locally.
+func applyOSCategory(ctx context.Context, c []manifest, facts *api.OSFacts, o Options) (string, string, error) {
+	c = preferImageProvisioners(c, facts)
 	if len(c) < 1 {
-		return errors.New(`No operating system detected or provisioned.`)
+		return ``, ``, errors.New(`No operating system detected or provisioned.`)
 	}
 	if len(c) > 1 {
-		return errors.New(`OS category contains multiple results.`)
+		return ``, ``, errors.New(`OS category contains multiple results.`)
 	}
 	m := c[0]
 	df, err := fetchContributedDockerfile(m)
 	if err != nil {
-		return err
+		return ``, ``, err
 	}
 	if len(df) <= 0 {
 		appendDockerfile(bytes.NewBufferString(fmt.Sprintf("# No contributed Dockerfile from provisioner: %v:%v \nFROM scratch", m.Provisioner.Repository, m.Provisioner.Tag)))
-		return nil
+		return ``, ``, nil
 	}
 	dfr := bytes.NewReader(df)
 	s := parser.Directive{}
 	if err = parser.SetEscapeToken(parser.DefaultEscapeToken, &s); err != nil {
-		return err
+		return ``, ``, err
 	}
 	root, err := parser.Parse(dfr, &s)
 	if err != nil {
-		return err
+		return ``, ``, err
 	}
 	if len(root.Children) <= 0 {
-		return nil
+		return ``, ``, nil
 	}
 
 	if bad := verifyContributedInstructionsForCategory(`os`, root); bad != `` {
-		return errors.New(fmt.Sprintf(`Provisioners in the OS category may only contribute a single FROM instruction. Illegal instructions: %v`, bad))
+		return ``, ``, errors.New(fmt.Sprintf(`Provisioners in the OS category may only contribute a single FROM instruction. Illegal instructions: %v`, bad))
+	}
+
+	// Rewrite or reject the base image according to policy and make sure it
+	// is available before anything is written
+	b := new(bytes.Buffer)
+	var base, resolved string
+	for _, child := range root.Children {
+		if child.Next == nil {
+			continue
+		}
+		base, err = o.Policy.Apply(child.Next.Value)
+		if err != nil {
+			return ``, ``, fmt.Errorf("The base image contributed by os provisioner %v:%v violates policy: %v", m.Provisioner.Repository, m.Provisioner.Tag, err)
+		}
+		// The base image bundle is loaded before the image is pinned
+		if resolved, err = checkBaseImage(ctx, base, o); err != nil {
+			return ``, ``, err
+		}
+		if base, err = o.Policy.Pin(ctx, base); err != nil {
+			return ``, ``, fmt.Errorf("The base image contributed by os provisioner %v:%v violates policy: %v", m.Provisioner.Repository, m.Provisioner.Tag, err)
+		}
+		if base != child.Next.Value {
+			fmt.Printf("Base image %v rewritten to %v by policy\n", child.Next.Value, base)
+		}
+		b.WriteString(fmt.Sprintf("FROM %v\n", base))
 	}
 
 	// Add an extra newline
-	dfb := bytes.NewBuffer(df)
-	dfb.WriteString("\n\n")
-	return appendDockerfile(dfb)
+	b.WriteString("\n")
+	return base, resolved, appendDockerfile(b)
+}
 
+// preferImageProvisioners drops built-in results when an image provisioner
+// also contributed. Built-in OS detection is a fallback for releases that no
+// installed image targets, unless a --base-images mapping names the base
+// image for the detected release.
+func preferImageProvisioners(ms []manifest, facts *api.OSFacts) []manifest {
+	images, builtins := []manifest{}, []manifest{}
+	for _, m := range ms {
+		if m.Provisioner.InProcess {
+			builtins = append(builtins, m)
+		} else {
+			images = append(images, m)
+		}
+	}
+	if len(images) == 0 {
+		return ms
+	}
+	if len(builtins) > 0 && facts != nil {
+		if image, ok := builtin.UserBaseImageFor(*facts); ok {
+			for _, m := range images {
+				fmt.Printf("Ignoring os provisioner %v:%v, the base image mappings choose %v\n", m.Provisioner.Repository, m.Provisioner.Tag, image)
+			}
+			return builtins
+		}
+	}
+	return images
 }
 
 func applyCategory(c string, ms []manifest) error {
@@ -134,6 +204,12 @@ func verifyContributedInstructionsForCategory(c string, root *parser.Node) strin
 				child.Value == `healthcheck` {
 				return child.Value
 			}
+		case `data`:
+			// only allow volumes and labels
+			if child.Value != `volume` &&
+				child.Value != `label` {
+				return child.Value
+			}
 		case `init`:
 			// only allow these three
 			if child.Value != `entrypoint` &&